@@ -0,0 +1,202 @@
+// Package api is a local HTTP interface for inspecting configuration and runs
+// of a long-running process, and for triggering restic subcommands on demand.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/daemon"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+)
+
+// Backend is what the API operates upon. It's implemented by *daemon.Daemon.
+type Backend interface {
+	Datastores(storenames, destnames []string) []config.ResolvedDatastore
+	Preview(subcmd string, storenames, destnames, args []string) ([]exec.Invocation, error)
+	Trigger(subcmd string, storenames, destnames, args []string) (daemon.Run, error)
+	Runs() []daemon.Run
+}
+
+// TriggerRequest is the body of a request to trigger a subcommand.
+type TriggerRequest struct {
+	Subcommand string   `json:"subcommand"`
+	Storenames []string `json:"storenames"`
+	Destnames  []string `json:"destnames"`
+	// Args are passed along to restic, like the ones after "--" on the command
+	// line.
+	Args []string `json:"args"`
+}
+
+// NewHandler serves these endpoints:
+//
+//	GET  /datastores  the datastores and destinations, with merged defaults
+//	GET  /runs        the running and recently-finished runs
+//	GET  /preview     the arguments restic would be invoked with
+//	POST /runs        start a subcommand, the body is a TriggerRequest
+//
+// The GET endpoints accept the query parameters, storenames and destnames, as
+// comma-separated names. Additionally, /preview requires a subcommand
+// parameter.
+func NewHandler(backend Backend) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/datastores", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+
+		storenames, destnames := selectionParams(r)
+		var datastores []config.Datastore
+		for _, resolved := range backend.Datastores(storenames, destnames) {
+			store := resolved.Datastore()
+			for _, resolvedDest := range resolved.Destinations() {
+				defs, err := resolvedDest.Merge()
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+				dest := store.Destinations[resolvedDest.Name()]
+				dest.Defaults = defs
+				store.Destinations[resolvedDest.Name()] = dest
+			}
+			datastores = append(datastores, store)
+		}
+
+		writeJSON(w, http.StatusOK, datastores)
+	})
+
+	mux.HandleFunc("/preview", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+
+		storenames, destnames := selectionParams(r)
+		invocations, err := backend.Preview(r.URL.Query().Get("subcommand"), storenames, destnames, r.URL.Query()["arg"])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, invocations)
+	})
+
+	mux.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, backend.Runs())
+			return
+		}
+
+		var req TriggerRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		run, err := backend.Trigger(req.Subcommand, req.Storenames, req.Destnames, req.Args)
+		if errors.Is(err, daemon.ErrBusy) {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if errors.Is(err, daemon.ErrNotRunning) {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusAccepted, run)
+	})
+
+	return mux
+}
+
+// Listen opens a listener at addr, which is either a unix socket in the form,
+// "unix:/path/to/socket", or a TCP address on a loopback interface, such as
+// "localhost:8090" or "127.0.0.1:8090". Other TCP addresses are rejected,
+// because the API has no authentication. A unix socket is only accessible to
+// the current user.
+func Listen(addr string) (out net.Listener, err error) {
+	if socket, ok := cutPrefix(addr, "unix:"); ok {
+		// Remove any socket left over from a previous process.
+		if info, statErr := os.Stat(socket); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(socket); err != nil {
+				return
+			}
+		}
+
+		if out, err = net.Listen("unix", socket); err != nil {
+			return
+		}
+		if err = os.Chmod(socket, 0600); err != nil {
+			_ = out.Close()
+			return nil, err
+		}
+		return
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("address %q is not a loopback address or unix socket", addr)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+func selectionParams(r *http.Request) (storenames, destnames []string) {
+	split := func(key string) (out []string) {
+		for _, val := range r.URL.Query()[key] {
+			for _, name := range strings.Split(val, ",") {
+				if name != "" {
+					out = append(out, name)
+				}
+			}
+		}
+		return
+	}
+
+	return split("storenames"), split("destnames")
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// cutPrefix is like strings.CutPrefix, which is not available until go1.20.
+func cutPrefix(s, prefix string) (after string, found bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
@@ -0,0 +1,233 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/api"
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/daemon"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+)
+
+func TestHandler(t *testing.T) {
+	params, err := config.Parse(strings.NewReader(`
+[defaults.password-config]
+template = 'cat secret'
+
+[datastores.stuff.destinations.alfa]
+path = 'alfa'
+
+[datastores.things.destinations.bravo]
+path = 'bravo'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &Backend{resolved: resolved}
+	srv := httptest.NewServer(api.NewHandler(backend))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		expStatus int
+		expBody   string
+	}{
+		{
+			name: "preview", method: http.MethodGet, path: "/preview?subcommand=snapshots&destnames=alfa,bravo&arg=--latest=1",
+			expStatus: http.StatusOK,
+			expBody:   `[{"store":"stuff","destination":"alfa","bin":"restic","args":["snapshots","--repo=alfa","--password-command=cat secret","--latest=1"]},{"store":"things","destination":"bravo","bin":"restic","args":["snapshots","--repo=bravo","--password-command=cat secret","--latest=1"]}]`,
+		},
+		{
+			name: "preview unknown subcommand", method: http.MethodGet, path: "/preview?subcommand=nope",
+			expStatus: http.StatusBadRequest,
+			expBody:   `{"error":"unknown subcommand"}`,
+		},
+		{
+			name: "trigger", method: http.MethodPost, path: "/runs",
+			body:      `{"subcommand":"backup","storenames":["stuff"],"args":["--tag=manual"]}`,
+			expStatus: http.StatusAccepted,
+			expBody:   `{"id":1,"subcommand":"backup","trigger":"request","status":"running","started":"0001-01-01T00:00:00Z","finished":"0001-01-01T00:00:00Z","destinations":null}`,
+		},
+		{
+			name: "trigger busy", method: http.MethodPost, path: "/runs",
+			body:      `{"subcommand":"backup","storenames":["busy"]}`,
+			expStatus: http.StatusConflict,
+			expBody:   `{"error":"every destination is busy"}`,
+		},
+		{
+			name: "trigger bad body", method: http.MethodPost, path: "/runs",
+			body:      `{`,
+			expStatus: http.StatusBadRequest,
+			expBody:   `{"error":"unexpected EOF"}`,
+		},
+		{
+			name: "runs", method: http.MethodGet, path: "/runs",
+			expStatus: http.StatusOK,
+			expBody:   `[{"id":1,"subcommand":"backup","trigger":"request","status":"running","started":"0001-01-01T00:00:00Z","finished":"0001-01-01T00:00:00Z","destinations":null}]`,
+		},
+		{
+			name: "method not allowed", method: http.MethodDelete, path: "/runs",
+			expStatus: http.StatusMethodNotAllowed,
+			expBody:   `{"error":"method DELETE not allowed"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			if resp.StatusCode != test.expStatus {
+				t.Errorf("wrong status; got %d, expected %d", resp.StatusCode, test.expStatus)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(body)); got != test.expBody {
+				t.Errorf("wrong body\ngot %s\nexp %s", got, test.expBody)
+			}
+		})
+	}
+
+	t.Run("datastores", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/datastores?storenames=things")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("wrong status; got %d, expected %d", resp.StatusCode, http.StatusOK)
+		}
+
+		var datastores []config.Datastore
+		if err = json.NewDecoder(resp.Body).Decode(&datastores); err != nil {
+			t.Fatal(err)
+		}
+		if len(datastores) != 1 || datastores[0].Name != "things" {
+			t.Fatalf("wrong datastores %#v", datastores)
+		}
+
+		// Configuration values should be merged into the destination.
+		dest := datastores[0].Destinations["bravo"]
+		if dest.Path != "bravo" {
+			t.Errorf("wrong Path; got %q, expected %q", dest.Path, "bravo")
+		}
+		if tmpl := dest.Defaults.PasswordConfig.Template; tmpl == nil || *tmpl != "cat secret" {
+			t.Errorf("wrong PasswordConfig.Template; got %v, expected %q", tmpl, "cat secret")
+		}
+	})
+
+	if len(backend.triggered) != 1 {
+		t.Fatalf("wrong number of triggered requests; got %d, expected %d", len(backend.triggered), 1)
+	}
+	if got, exp := backend.triggered[0], (api.TriggerRequest{Subcommand: "backup", Storenames: []string{"stuff"}, Args: []string{"--tag=manual"}}); !equalJSON(t, got, exp) {
+		t.Errorf("wrong triggered request; got %#v, expected %#v", got, exp)
+	}
+}
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expError bool
+	}{
+		{addr: "127.0.0.1:0"},
+		{addr: "localhost:0"},
+		{addr: "[::1]:0"},
+		{addr: "unix:" + filepath.Join(t.TempDir(), "wrestic.sock")},
+		{addr: "0.0.0.0:0", expError: true},
+		{addr: ":0", expError: true},
+		{addr: "example.com:80", expError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			ln, err := api.Listen(test.addr)
+			if err != nil && !test.expError {
+				if strings.Contains(err.Error(), "cannot assign requested address") {
+					t.Skip(err)
+				}
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				_ = ln.Close()
+				t.Fatal("expected an error")
+			} else if err == nil {
+				_ = ln.Close()
+			}
+		})
+	}
+}
+
+// Backend is a stand-in for a *daemon.Daemon.
+type Backend struct {
+	resolved  config.Resolved
+	runs      []daemon.Run
+	triggered []api.TriggerRequest
+}
+
+func (b *Backend) Datastores(storenames, destnames []string) []config.ResolvedDatastore {
+	return b.resolved.Select(storenames, destnames)
+}
+
+func (b *Backend) Preview(subcmd string, storenames, destnames, args []string) ([]exec.Invocation, error) {
+	if subcmd != "backup" && subcmd != "snapshots" {
+		return nil, errors.New("unknown subcommand")
+	}
+
+	batch := exec.ResticBatch{Subcommand: subcmd, Args: args}
+	return batch.Preview(b.Datastores(storenames, destnames))
+}
+
+func (b *Backend) Trigger(subcmd string, storenames, destnames, args []string) (out daemon.Run, err error) {
+	if len(storenames) > 0 && storenames[0] == "busy" {
+		err = daemon.ErrBusy
+		return
+	}
+
+	b.triggered = append(b.triggered, api.TriggerRequest{Subcommand: subcmd, Storenames: storenames, Destnames: destnames, Args: args})
+	out = daemon.Run{ID: len(b.runs) + 1, Subcommand: subcmd, Trigger: daemon.TriggerRequest, Status: daemon.StatusRunning}
+	b.runs = append(b.runs, out)
+	return
+}
+
+func (b *Backend) Runs() []daemon.Run { return b.runs }
+
+func equalJSON(t *testing.T, a, b any) bool {
+	t.Helper()
+
+	rawA, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawB, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(rawA) == string(rawB)
+}
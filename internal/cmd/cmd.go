@@ -20,7 +20,10 @@ func New() Root {
 	app.Usage = "restic and a configuration file"
 	app.Commands = []*cli.Command{
 		makeConfig(name, "config"),
+		makeDaemon(name, "daemon"),
 		makeExec(name, "exec"),
+		makeSchedule(name, "schedule"),
+		makeStatus(name, "status"),
 		makeVersion(name, "version"),
 	}
 	app.Description = `Manage backups of your data.
@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/rafaelespinoza/wrestic/internal/config"
 	"github.com/urfave/cli/v2"
@@ -41,12 +44,7 @@ The default configuration directory is:
 				Name:  "init",
 				Usage: "prepare configuration directory structure",
 				Flags: []cli.Flag{
-					&cli.PathFlag{
-						Name:    "config-dir",
-						Aliases: []string{"C"},
-						Usage:   "base configuration directory",
-						Value:   defaultConfigDir,
-					},
+					newConfigDirFlag(),
 				},
 				Description: `Prepare configuration directory structure. Some application data, such as
 encrypted passwords, may also live here.`,
@@ -71,16 +69,26 @@ flags, before invoking a configured restic subcommand via %s.
 
 By default, the displayed configuration values for a destination are merged in
 from the parent datastore. Likewise, the datastore's configuration values are
-merged in from any top-level configuration values.`,
-					execSubcmd, execSubcmd),
+merged in from any top-level configuration values. Sections of the hosts table
+that match the hostname are applied first; use the hostname flag to see the
+config of another host. Then the profile is applied, when there is one, and
+then the values of the set flag, which take precedence over anything in the
+config file. The file where each datastore is defined is also displayed, see
+the include key and the %s directory.
+
+With the explain flag, each merged value of a destination is listed instead,
+along with the table of the config where it's specified, such as
+datastores.foo.defaults, or "%s" for the set flag. When that table is in
+another file, such as the system config file, then the file is also listed.
+Values of the same key that it replaces, from tables of lower precedence, are
+listed below it. A value that does not take effect, such as a restic flag of 0
+or false when one of lower precedence is not, is marked as ignored.`,
+					execSubcmd, execSubcmd, config.ConfDir, config.OverridesOrigin),
 
 				Flags: []cli.Flag{
-					&cli.PathFlag{
-						Name:    "config-dir",
-						Aliases: []string{"C"},
-						Usage:   "base configuration directory",
-						Value:   defaultConfigDir,
-					},
+					newConfigDirFlag(),
+					newConfigFileFlag(),
+					newSystemConfigFlag(),
 					&cli.StringSliceFlag{
 						Name:    "storenames",
 						Aliases: []string{"s"},
@@ -91,6 +99,12 @@ merged in from any top-level configuration values.`,
 						Aliases: []string{"d"},
 						Usage:   "names of destinations to operate on",
 					},
+					newProfileFlag(),
+					newSetFlag(),
+					&cli.StringFlag{
+						Name:  "hostname",
+						Usage: "apply the hosts sections for this hostname, rather than of this host",
+					},
 					&cli.BoolFlag{
 						Name:    "merge",
 						Aliases: []string{"m"},
@@ -103,11 +117,15 @@ merged in from any top-level configuration values.`,
 						Usage:   fmt.Sprintf("output format, one of %q", showOutputFormats),
 						Value:   showOutputFormats[0],
 					},
+					&cli.BoolFlag{
+						Name:  "explain",
+						Usage: "list each merged value of a destination, and where it comes from",
+					},
 				},
 				Action: func(c *cli.Context) error {
-					configDir := c.Path("config-dir")
-					if configDir == "" {
-						return errors.New("config dir cannot be empty; possibly could not determine a default either")
+					paths, err := locateConfig(c)
+					if err != nil {
+						return err
 					}
 					outputFormat := c.String("format")
 					{
@@ -122,12 +140,68 @@ merged in from any top-level configuration values.`,
 							return fmt.Errorf("unknown format %q, should be one of %q", outputFormat, showOutputFormats)
 						}
 					}
-					stores, err := fetchDatastores(configDir, c.StringSlice("storenames"), c.StringSlice("destnames"))
+					resolved, err := paths.resolve()
 					if err != nil {
 						return err
 					}
+					stores := resolved.Select(c.StringSlice("storenames"), c.StringSlice("destnames"))
+					if c.Bool("explain") {
+						return explainDatastores(os.Stdout, outputFormat, paths.file, stores)
+					}
 
-					return displayDatastores(os.Stdout, c.Bool("merge"), outputFormat, stores)
+					return displayDatastores(os.Stdout, c.Bool("merge"), outputFormat, paths.file, stores)
+				},
+			},
+			{
+				Name:  "schema",
+				Usage: "output a JSON Schema for the config file",
+				Description: `Output a JSON Schema (draft-07) for the config file, wrestic.toml.
+
+Editors that support TOML with JSON Schema, such as those using Taplo, may use
+it to autocomplete and validate the config file. A copy of it is at the root of
+the source repository, wrestic.schema.json.`,
+				Action: func(c *cli.Context) error {
+					return config.WriteSchema(os.Stdout)
+				},
+			},
+			{
+				Name:  "validate",
+				Usage: "report problems with the config file",
+				Description: fmt.Sprintf(`Check the config file, without running anything.
+
+The config is read like it is for %s: the system-wide config file, if it
+exists, the config file, any included files and files in wrestic.d are read,
+and then the hosts sections matching this host are applied, then the profile,
+and then the values of -set. Each problem is reported with
+its file, line and column. Problems include TOML syntax, unexpected keys (with
+a suggestion of what was meant), datastores without destinations, destinations
+without a path, relative source paths, destinations that share a repository
+path, password templates that fail to render, restic flag values that restic
+would reject, and conflicting flags.
+
+Each problem is either an error or a warning. The exit code is non-zero if
+there are any errors. With the json format, the output is an object with the
+keys, "file" and "diagnostics", for editor integration. Invoking %s
+checks the same restic flag values.`, execSubcmd, execSubcmd),
+				Flags: []cli.Flag{
+					newConfigDirFlag(),
+					newConfigFileFlag(),
+					newSystemConfigFlag(),
+					newProfileFlag(),
+					newSetFlag(),
+					&cli.StringFlag{
+						Name:    "format",
+						Aliases: []string{"f"},
+						Usage:   fmt.Sprintf("output format, one of %q", validateOutputFormats),
+						Value:   validateOutputFormats[0],
+					},
+				},
+				Action: func(c *cli.Context) error {
+					paths, err := locateConfig(c)
+					if err != nil {
+						return err
+					}
+					return validateConfig(os.Stdout, paths, c.String("format"))
 				},
 			},
 		},
@@ -136,38 +210,297 @@ merged in from any top-level configuration values.`,
 	return &out
 }
 
-func fetchDatastores(configDir string, storenames, destnames []string) (out []config.Datastore, err error) {
-	file, err := os.Open(filepath.Clean(filepath.Join(configDir, "wrestic.toml")))
+func fetchDatastores(paths configPaths, storenames, destnames []string) (resolved config.Resolved, out []config.ResolvedDatastore, err error) {
+	if resolved, err = paths.resolve(); err != nil {
+		return
+	}
+
+	out = resolved.Select(storenames, destnames)
+	return
+}
+
+// These environment variables are alternatives to the flags, config-dir,
+// config-file and system-config. A flag takes precedence over its environment
+// variable.
+const (
+	configDirEnv    = "WRESTIC_CONFIG_DIR"
+	configFileEnv   = "WRESTIC_CONFIG_FILE"
+	systemConfigEnv = "WRESTIC_SYSTEM_CONFIG"
+)
+
+func newConfigDirFlag() *cli.PathFlag {
+	return &cli.PathFlag{
+		Name:    "config-dir",
+		Aliases: []string{"C"},
+		Usage:   "base configuration directory",
+		Value:   defaultConfigDir,
+		EnvVars: []string{configDirEnv},
+	}
+}
+
+func newConfigFileFlag() *cli.PathFlag {
+	return &cli.PathFlag{
+		Name:    "config-file",
+		Usage:   fmt.Sprintf("config file, or %q for stdin; defaults to wrestic.toml in the config dir", config.StdinName),
+		EnvVars: []string{configFileEnv},
+	}
+}
+
+func newSystemConfigFlag() *cli.PathFlag {
+	return &cli.PathFlag{
+		Name:    "system-config",
+		Usage:   "system-wide config file, read before the config file if it exists; empty to ignore it",
+		Value:   config.SystemConfigFile,
+		EnvVars: []string{systemConfigEnv},
+	}
+}
+
+// configPaths says where to find configuration, and which of it applies.
+type configPaths struct {
+	dir  string
+	file string
+	// explicitFile is true when file is specified, rather than implied by dir.
+	explicitFile bool
+	// systemFile is the system-wide config file. It's optional.
+	systemFile string
+	// hostname selects the hosts sections of the config to apply.
+	hostname string
+	// profile, when non-empty, is the name of a profile to apply.
+	profile string
+	// overrides are settings of Defaults, key=value, to apply last.
+	overrides []string
+	// stdin is where a config file named config.StdinName is read from. When
+	// it's nil, it's os.Stdin.
+	stdin io.Reader
+}
+
+// locateConfig outputs configPaths, per the flags of c. When the config file
+// is not specified, it's wrestic.toml in the config dir.
+func locateConfig(c *cli.Context) (out configPaths, err error) {
+	out.dir = c.Path("config-dir")
+	if out.dir == "" {
+		err = errors.New("config dir cannot be empty; possibly could not determine a default either")
+		return
+	}
+
+	out.file = c.Path("config-file")
+	out.explicitFile = out.file != ""
+	if !out.explicitFile {
+		out.file = configFilename(out.dir)
+	}
+	out.systemFile = c.Path("system-config")
+
+	if out.hostname = c.String("hostname"); out.hostname == "" {
+		out.hostname, err = os.Hostname()
+	}
+	out.profile = c.String("profile")
+	if set, ok := c.Generic("set").(*repeatedFlag); ok {
+		out.overrides = *set
+	}
+	return
+}
+
+func newSetFlag() *cli.GenericFlag {
+	return &cli.GenericFlag{
+		Name:  "set",
+		Usage: "override a config value, key=value, such as restic.backup.tag=manual; may be repeated",
+		Value: &repeatedFlag{},
+	}
+}
+
+// repeatedFlag collects each value of a flag, as is. Unlike a
+// cli.StringSliceFlag, a value is not split at commas.
+type repeatedFlag []string
+
+func (f *repeatedFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
+func (f *repeatedFlag) String() string { return strings.Join(*f, " ") }
+
+func newProfileFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:    "profile",
+		Aliases: []string{"p"},
+		Usage:   "name of a profile in the config file to apply",
+	}
+}
+
+func configFilename(configDir string) string {
+	return filepath.Clean(filepath.Join(configDir, "wrestic.toml"))
+}
+
+// resolve loads the system config file, if it exists, and then the config
+// file. When there is a system config file, then the config file may be
+// missing, unless it was specified. Any hosts sections matching the hostname
+// are applied, then the profile, and then the overrides.
+func (p configPaths) resolve() (out config.Resolved, err error) {
+	layers, err := p.readLayers()
 	if err != nil {
 		return
 	}
-	defer func() { _ = file.Close() }()
+	var overrides config.Defaults
+	if overrides, err = config.ParseOverrides(p.overrides...); err != nil {
+		return
+	}
+	out, err = config.Resolve(layers, config.ResolveOptions{
+		ConfigDir: p.dir,
+		Hostname:  p.hostname,
+		Profile:   p.profile,
+		Overrides: overrides,
+	})
+	return
+}
+
+// readLayers loads the system config file, if it exists, and then the config
+// file, without combining them.
+func (p configPaths) readLayers() (layers []config.Params, err error) {
+	if p.systemFile != "" && filepath.Clean(p.systemFile) != filepath.Clean(p.file) {
+		var params config.Params
+		params, err = config.Load(p.systemFile)
+		if err == nil {
+			layers = append(layers, params)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		err = nil
+	}
+
+	var params config.Params
+	if p.file == config.StdinName {
+		var stdin io.Reader = os.Stdin
+		if p.stdin != nil {
+			stdin = p.stdin
+		}
+		params, err = config.LoadReader(stdin, p.file, p.dir)
+	} else {
+		params, err = config.Load(p.file)
+	}
+	if err == nil {
+		layers = append(layers, params)
+	} else if len(layers) < 1 || p.explicitFile || !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	err = nil
+	return
+}
 
-	params, err := config.Parse(file)
+var validateOutputFormats = []string{"text", "json"}
+
+func validateConfig(w io.Writer, paths configPaths, format string) (err error) {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, should be one of %q", format, validateOutputFormats)
+	}
+
+	readFile := os.ReadFile
+	if paths.file == config.StdinName {
+		// It's read twice: once to load it, and again to find the positions.
+		var raw []byte
+		if raw, err = io.ReadAll(os.Stdin); err != nil {
+			return
+		}
+		paths.stdin = bytes.NewReader(raw)
+		readFile = func(name string) ([]byte, error) {
+			if name == config.StdinName {
+				return raw, nil
+			}
+			return os.ReadFile(name)
+		}
+	}
+
+	diagnostics, err := lintConfig(paths, readFile)
 	if err != nil {
 		return
 	}
 
-	out = config.SelectDatastores(params.Datastores, storenames, destnames)
+	switch format {
+	case "text":
+		for _, d := range diagnostics {
+			if d.File == "" {
+				fmt.Fprintf(w, "%s\n", d)
+			} else {
+				fmt.Fprintf(w, "%s:%s\n", d.File, d)
+			}
+		}
+	case "json":
+		if diagnostics == nil {
+			diagnostics = []config.Diagnostic{}
+		}
+		err = json.NewEncoder(w).Encode(map[string]any{"file": paths.file, "diagnostics": diagnostics})
+		if err != nil {
+			return
+		}
+	}
+
+	var numErrors int
+	for _, d := range diagnostics {
+		if d.Severity == config.SeverityError {
+			numErrors++
+		}
+	}
+	if numErrors > 0 {
+		err = fmt.Errorf("found %d error(s) in the config", numErrors)
+	}
 	return
 }
 
-func displayDatastores(w io.Writer, merge bool, format string, stores []config.Datastore) (err error) {
-	for _, store := range stores {
+// lintConfig resolves the config like resolve, and then outputs its
+// problems. When one of its files cannot be parsed, then only the problems of
+// that file are output, since the rest of the config cannot be resolved. Any
+// other problem with resolving the config, such as a datastore that's in two
+// files, is output as a Diagnostic without a position.
+func lintConfig(paths configPaths, readFile func(name string) ([]byte, error)) (out []config.Diagnostic, err error) {
+	resolved, err := paths.resolve()
+	var fileErr *config.FileError
+	if errors.As(err, &fileErr) {
+		var raw []byte
+		if raw, err = readFile(fileErr.File); err != nil {
+			return
+		}
+		if out, err = config.Lint(bytes.NewReader(raw), paths.dir); err != nil {
+			return
+		}
+		if len(out) < 1 {
+			out = []config.Diagnostic{{Severity: config.SeverityError, Message: fileErr.Err.Error()}}
+		}
+		for i := range out {
+			out[i].File = fileErr.File
+		}
+		return
+	} else if err != nil {
+		out = []config.Diagnostic{{Severity: config.SeverityError, Message: err.Error()}}
+		err = nil
+		return
+	}
+
+	return config.LintResolved(resolved, readFile)
+}
+
+// displayDatastores outputs each datastore. In TOML, the file of a datastore is
+// only displayed when it's not configFile.
+func displayDatastores(w io.Writer, merge bool, format, configFile string, resolved []config.ResolvedDatastore) (err error) {
+	for _, resolvedStore := range resolved {
+		store := resolvedStore.Datastore()
 		if merge {
-			for name, dest := range store.Destinations {
-				defs, err := dest.Merge()
+			for _, resolvedDest := range resolvedStore.Destinations() {
+				defs, err := resolvedDest.Merge()
 				if err != nil {
 					return err
 				}
+				dest := store.Destinations[resolvedDest.Name()]
 				dest.Defaults = defs
-				store.Destinations[name] = dest
+				store.Destinations[resolvedDest.Name()] = dest
 			}
 		}
 
 		switch format {
 		case "toml":
-			fmt.Fprintf(w, "#\n# %s\n#\n", store.Name)
+			if store.File == "" || store.File == configFile {
+				fmt.Fprintf(w, "#\n# %s\n#\n", store.Name)
+			} else {
+				fmt.Fprintf(w, "#\n# %s\n# file: %s\n#\n", store.Name, store.File)
+			}
 			if err = config.EncodeTOML(w, store); err != nil {
 				return
 			}
@@ -183,3 +516,64 @@ func displayDatastores(w io.Writer, merge bool, format string, stores []config.D
 
 	return nil
 }
+
+// explainDatastores lists the explanations of each destination. The file of an
+// origin is only displayed when it's not configFile.
+func explainDatastores(w io.Writer, format, configFile string, stores []config.ResolvedDatastore) (err error) {
+	for _, store := range stores {
+		for _, dest := range store.Destinations() {
+			var explanations []config.Explanation
+			if explanations, err = dest.Explain(); err != nil {
+				return
+			}
+
+			switch format {
+			case "toml":
+				fmt.Fprintf(w, "#\n# %s.%s\n#\n", store.Name(), dest.Name())
+				for _, explanation := range explanations {
+					fmt.Fprintf(w, "%s = %s # %s\n", explanation.Key, formatExplained(explanation.Value), formatOrigin(explanation.Sourced, configFile))
+					for _, shadowed := range explanation.Shadowed {
+						fmt.Fprintf(w, "#   shadows %s # %s\n", formatExplained(shadowed.Value), formatOrigin(shadowed, configFile))
+					}
+				}
+				fmt.Fprintln(w)
+			case "json":
+				if explanations == nil {
+					explanations = []config.Explanation{}
+				}
+				var raw []byte
+				raw, err = json.Marshal(map[string]any{"datastore": store.Name(), "destination": dest.Name(), "values": explanations})
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "%s\n", raw)
+			}
+		}
+	}
+
+	return
+}
+
+// formatExplained formats a value of a config.Explanation. For most types in
+// config.Defaults, the JSON of a value is also how it's written in TOML.
+func formatExplained(val any) string {
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return string(raw)
+}
+
+func formatOrigin(sourced config.Sourced, configFile string) string {
+	origin := sourced.Origin
+	if sourced.File != "" && filepath.Clean(sourced.File) != filepath.Clean(configFile) {
+		origin = fmt.Sprintf("%s (%s)", origin, sourced.File)
+	}
+	if sourced.Merge != "" {
+		origin = fmt.Sprintf("%s, merge = %q", origin, sourced.Merge)
+	}
+	if sourced.Ignored {
+		origin += ", ignored"
+	}
+	return origin
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		system   string
+		profile  string
+		expected []string
+		expErr   bool
+	}{
+		{
+			name: "ok",
+			files: map[string]string{
+				"wrestic.toml":         "[datastores.stuff.destinations.foo]\npath = '/mnt/foo'",
+				"wrestic.d/other.toml": "[datastores.things.destinations.foo]\npath = '/mnt/bar'",
+			},
+		},
+		{
+			name: "problem in conf dir",
+			files: map[string]string{
+				"wrestic.toml":         "[datastores.stuff.destinations.foo]\npath = '/mnt/foo'",
+				"wrestic.d/other.toml": "[datastores.things.destinations.bar]\npath = '/mnt/bar'\ndefaults.restic.global.compression = 'most'",
+			},
+			expected: []string{filepath.Join("wrestic.d", "other.toml") + ":3:1: error: datastores.things.destinations.bar.defaults.restic.global.compression"},
+			expErr:   true,
+		},
+		{
+			name: "syntax in conf dir",
+			files: map[string]string{
+				"wrestic.toml":         "[datastores.stuff.destinations.foo]\npath = '/mnt/foo'",
+				"wrestic.d/other.toml": "[datastores.things.destinations.bar]\npath = '/mnt/bar\n",
+			},
+			expected: []string{filepath.Join("wrestic.d", "other.toml") + ":2:17: error: datastores.things.destinations.bar.path: strings cannot contain newlines"},
+			expErr:   true,
+		},
+		{
+			name: "datastore in two files",
+			files: map[string]string{
+				"wrestic.toml":         "[datastores.stuff.destinations.foo]\npath = '/mnt/foo'",
+				"wrestic.d/other.toml": "[datastores.stuff.destinations.bar]\npath = '/mnt/bar'",
+			},
+			expected: []string{`datastore "stuff" is in both`},
+			expErr:   true,
+		},
+		{
+			name: "problem in system config",
+			files: map[string]string{
+				"system/wrestic.toml": "[defaults.restic.global]\ncompression = 'most'\n[datastores.shared.destinations.bar]\npath = '/mnt/bar'",
+				"wrestic.toml":        "[datastores.stuff.destinations.foo]\npath = '/mnt/foo'",
+			},
+			system:   "system/wrestic.toml",
+			expected: []string{filepath.Join("system", "wrestic.toml") + ":2:1: error: defaults.restic.global.compression"},
+			expErr:   true,
+		},
+		{
+			name: "only system config",
+			files: map[string]string{
+				"system/wrestic.toml": "[datastores.shared.destinations.bar]\npath = '/mnt/bar'\ndefaults.restic.global.compression = 'most'",
+			},
+			system:   "system/wrestic.toml",
+			expected: []string{filepath.Join("system", "wrestic.toml") + ":3:1: error: datastores.shared.destinations.bar.defaults.restic.global.compression"},
+			expErr:   true,
+		},
+		{
+			name: "profile",
+			files: map[string]string{
+				"wrestic.toml": "[datastores.stuff.destinations.foo]\npath = '/mnt/foo'\n[profiles.slow.defaults.restic.global]\ncompression = 'most'",
+			},
+			profile:  "slow",
+			expected: []string{"wrestic.toml:4:1: error: profiles.slow.defaults.restic.global.compression"},
+			expErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				filename := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			paths := configPaths{dir: dir, file: configFilename(dir), profile: test.profile}
+			if test.system != "" {
+				paths.systemFile = filepath.Join(dir, test.system)
+			}
+			var out strings.Builder
+			err := validateConfig(&out, paths, "text")
+			if test.expErr && err == nil {
+				t.Fatal("expected an error")
+			} else if !test.expErr && err != nil {
+				t.Fatal(err)
+			}
+
+			if len(test.expected) < 1 && out.Len() > 0 {
+				t.Errorf("expected no output, got\n%s", out.String())
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expected output to contain %q\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/api"
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/daemon"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+	"github.com/rafaelespinoza/wrestic/internal/lock"
+	"github.com/rafaelespinoza/wrestic/internal/notify"
+	"github.com/urfave/cli/v2"
+)
+
+func makeDaemon(parentName, name string) *cli.Command {
+	return &cli.Command{
+		Name:  name,
+		Usage: "run scheduled restic subcommands in a long-running process",
+		Description: fmt.Sprintf(`Run restic subcommands per the schedule table of each datastore, until
+stopped. This is an alternative to %s schedule, for hosts without systemd
+or cron.
+
+A destination is never operated upon by more than one subcommand at a time.
+If a destination is still busy when another subcommand is due, then it's
+skipped until the next time that subcommand is due. The same goes for a
+destination that's locked by another %s process.
+
+The config is reloaded upon SIGHUP, or when either config file changes. Upon
+SIGINT or SIGTERM, no more subcommands are started and running restic
+processes are sent an interrupt signal. If they are still running after the
+grace period, then they are killed.
+
+With the listen flag, a local HTTP API is served for inspecting the
+configuration and runs, previewing restic invocations and triggering
+subcommands on demand. The API has no authentication, so it only listens on a
+unix socket, such as "unix:/run/user/1000/wrestic.sock", or on a loopback
+address, such as "localhost:8090". The endpoints are:
+
+	GET  /datastores?storenames=&destnames=
+	GET  /preview?subcommand=&storenames=&destnames=&arg=
+	GET  /runs
+	POST /runs  {"subcommand": "", "storenames": [], "destnames": [], "args": []}`, parentName, parentName),
+		Flags: []cli.Flag{
+			newConfigDirFlag(),
+			newConfigFileFlag(),
+			newSystemConfigFlag(),
+			&cli.DurationFlag{
+				Name:  "grace",
+				Usage: "how long to wait for restic to exit after interrupting it",
+				Value: defaultGracePeriod,
+			},
+			&cli.DurationFlag{
+				Name:  "poll",
+				Usage: "how often to check the config files for changes",
+				Value: defaultPollInterval,
+			},
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "serve the HTTP API at this unix socket or loopback address",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			paths, err := locateConfig(c)
+			if err != nil {
+				return err
+			}
+			configDir := paths.dir
+			if paths.file == config.StdinName {
+				return errors.New("the config file is reloaded, so it cannot be stdin")
+			}
+			grace := c.Duration("grace")
+
+			// Either config file may appear later. The files that the config
+			// is loaded from are watched too, see daemon.Daemon.Watch.
+			watch := []string{paths.file}
+			if paths.systemFile != "" && filepath.Clean(paths.systemFile) != filepath.Clean(paths.file) {
+				watch = append(watch, paths.systemFile)
+			}
+
+			ctx := c.Context
+
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+
+			reload := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-hup:
+						select {
+						case reload <- struct{}{}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+			}()
+
+			d := daemon.Daemon{
+				Load: paths.resolve,
+				NewBatch: func(params config.Params, subcmd string) exec.ResticBatch {
+					return exec.ResticBatch{
+						Sink:       os.Stderr,
+						Subcommand: subcmd,
+						Run:        true,
+						NewCommand: func() exec.Command { return exec.NewResticGraceful(os.Stdout, os.Stderr, grace) },
+						Observer: &notify.Dispatcher{
+							Defaults: params.Defaults,
+							StateDir: filepath.Join(configDir, "state"),
+							ErrSink:  os.Stderr,
+						},
+						LockDir:  lockDir(configDir),
+						LockMode: lock.ModeSkip,
+					}
+				},
+				Subcommands:  execSubcmds,
+				Watch:        watch,
+				PollInterval: c.Duration("poll"),
+				Log:          os.Stderr,
+			}
+
+			if addr := c.String("listen"); addr != "" {
+				ln, err := api.Listen(addr)
+				if err != nil {
+					return err
+				}
+
+				srv := &http.Server{Handler: api.NewHandler(&d), ReadHeaderTimeout: 10 * time.Second}
+				go func() {
+					if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						fmt.Fprintf(os.Stderr, "api: %v\n", err)
+					}
+				}()
+				defer func() { _ = srv.Shutdown(context.Background()) }()
+			}
+
+			return d.Run(ctx, reload)
+		},
+	}
+}
+
+const (
+	defaultGracePeriod  = 30 * time.Second
+	defaultPollInterval = 10 * time.Second
+)
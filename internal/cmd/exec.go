@@ -1,14 +1,19 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/rafaelespinoza/wrestic/internal/exec"
+	"github.com/rafaelespinoza/wrestic/internal/lock"
+	"github.com/rafaelespinoza/wrestic/internal/notify"
 	"github.com/urfave/cli/v2"
 )
 
+// execSubcmds are the restic subcommands that may be invoked.
+var execSubcmds = []string{"backup", "check", "ls", "snapshots", "stats"}
+
 func makeExec(parentName, name string) *cli.Command {
 	fullName := parentName + " " + name
 
@@ -20,18 +25,20 @@ func makeExec(parentName, name string) *cli.Command {
 and repository metadata saved in a config file.`,
 	}
 
-	subcmds := []string{"backup", "check", "ls", "snapshots", "stats"}
-	out.Subcommands = make([]*cli.Command, len(subcmds))
+	out.Subcommands = make([]*cli.Command, len(execSubcmds))
 
-	for i, subcmd := range subcmds {
+	for i, subcmd := range execSubcmds {
 		out.Subcommands[i] = &cli.Command{
 			Name: subcmd,
 			Flags: []cli.Flag{
-				&cli.PathFlag{
-					Name:    "config-dir",
-					Aliases: []string{"C"},
-					Usage:   "base configuration directory",
-					Value:   defaultConfigDir,
+				newConfigDirFlag(),
+				newConfigFileFlag(),
+				newSystemConfigFlag(),
+				newProfileFlag(),
+				newSetFlag(),
+				&cli.DurationFlag{
+					Name:  "budget",
+					Usage: "if positive, do not start on any more destinations after this long",
 				},
 				&cli.StringSliceFlag{
 					Name:    "destnames",
@@ -43,6 +50,21 @@ and repository metadata saved in a config file.`,
 					Aliases: []string{"s"},
 					Usage:   "comma-separated storenames to operate on",
 				},
+				&cli.DurationFlag{
+					Name:  "grace",
+					Usage: "how long to wait for restic to exit after interrupting it",
+					Value: defaultGracePeriod,
+				},
+				&cli.StringSliceFlag{
+					Name:  "fail-on",
+					Usage: fmt.Sprintf("comma-separated outcomes upon a destination that stop with an error, any of %q", exec.FailureOutcomes),
+					Value: cli.NewStringSlice(outcomeStrings(exec.DefaultFailOn)...),
+				},
+				&cli.StringFlag{
+					Name:  "lock-mode",
+					Usage: fmt.Sprintf("what to do when a destination is locked by another process, one of %q", lock.Modes),
+					Value: string(lock.ModeWait),
+				},
 				&cli.BoolFlag{
 					Name:  "x",
 					Usage: "actually execute the commands; if false then preview",
@@ -72,7 +94,47 @@ These restic flags are unnecessary to specify because they are generated by
 this application:
 	-r, --repo
 	--password-command
-`, fullName, fullName, fullName,
+Specifying them anyway overrides the generated ones, with a warning.
+
+A restic flag after the two dashes takes precedence over the same flag from the
+config file, which is left out. Flags that may be repeated, such as --tag, are
+combined instead.
+
+When running restic with -x, a lock upon each destination is taken, so that
+separate %s processes never operate upon the same restic repository at
+the same time. If a destination is locked, then the lock-mode flag says
+whether to wait for it, skip it, or stop with an error. Use %s status to
+see what's holding the locks.
+
+Upon SIGINT or SIGTERM, restic is sent an interrupt signal, so it may clean
+up and remove its repository lock. If it's still running after the grace
+period, then it's killed. Any remaining destinations are skipped.
+
+The exit code of restic upon each destination is classified into an outcome:
+	success       restic exited with 0
+	warning       a snapshot was created, but some files could not be read
+	repo-missing  the repository does not exist
+	lock-failure  the repository could not be locked
+	timeout       restic ran longer than the timeout for the subcommand
+	fatal         any other failure
+If the outcome is one of the values of the fail-on flag, then no more
+destinations are operated upon and the exit code is non-zero. Otherwise, it
+continues onto the next destination. When running restic with -x, the number
+of destinations with each outcome is printed at the end, such as
+"# outcomes: 2 success, 1 warning".
+
+A timeout for each subcommand may be configured, such as
+timeout.backup = "4h". The budget flag limits the whole batch; once
+it's used up, any remaining destinations are skipped.
+
+When running restic with -x, outcomes may be reported through the channels
+configured under the notify key of the config file.
+
+The profile flag applies a profile from the profiles table of the config file,
+such as one without offsite destinations, before selecting destinations. The
+set flag overrides any config value, such as -set restic.backup.tag=manual,
+with precedence over the config file and the profile.
+`, fullName, fullName, fullName, parentName, parentName,
 			),
 			Action: makeExecAction(subcmd),
 		}
@@ -83,25 +145,59 @@ this application:
 
 func makeExecAction(subcmd string) cli.ActionFunc {
 	return func(c *cli.Context) error {
-		configDir := c.Path("config-dir")
-		if configDir == "" {
-			return errors.New("config dir cannot be empty; possibly could not determine a default either")
+		paths, err := locateConfig(c)
+		if err != nil {
+			return err
+		}
+		configDir := paths.dir
+
+		grace := c.Duration("grace")
+		lockMode, err := lock.ParseMode(c.String("lock-mode"))
+		if err != nil {
+			return err
 		}
 
-		datastores, err := fetchDatastores(configDir, c.StringSlice("storenames"), c.StringSlice("destnames"))
+		failOn, err := exec.ParseOutcomes(c.StringSlice("fail-on"))
 		if err != nil {
 			return err
 		}
 
+		resolved, datastores, err := fetchDatastores(paths, c.StringSlice("storenames"), c.StringSlice("destnames"))
+		if err != nil {
+			return err
+		}
+
+		dispatcher := notify.Dispatcher{
+			Defaults: resolved.Params().Defaults,
+			StateDir: filepath.Join(configDir, "state"),
+			ErrSink:  os.Stderr,
+		}
+
 		batch := exec.ResticBatch{
-			ConfigDir:  configDir,
 			Sink:       os.Stderr,
 			Subcommand: subcmd,
 			Args:       c.Args().Slice(),
 			Run:        c.Bool("x"),
-			NewCommand: func() exec.Command { return exec.NewRestic(os.Stdout, os.Stderr) },
+			NewCommand: func() exec.Command { return exec.NewResticGraceful(os.Stdout, os.Stderr, grace) },
+			Observer:   &dispatcher,
+			LockDir:    lockDir(configDir),
+			LockMode:   lockMode,
+			FailOn:     failOn,
+			Budget:     c.Duration("budget"),
+		}
+
+		result, err := batch.Do(c.Context, datastores)
+		if summary := result.Summary(); batch.Run && summary != "" {
+			fmt.Fprintf(os.Stderr, "# outcomes: %s\n", summary)
 		}
+		return err
+	}
+}
 
-		return batch.Do(c.Context, datastores)
+func outcomeStrings(outcomes []exec.Outcome) []string {
+	out := make([]string, len(outcomes))
+	for i, outcome := range outcomes {
+		out[i] = string(outcome)
 	}
+	return out
 }
@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMakeExecDescription(t *testing.T) {
+	exec := makeExec("wrestic", "exec")
+
+	for _, subcmd := range exec.Subcommands {
+		if !strings.Contains(subcmd.Description, "Use wrestic status to") {
+			t.Errorf("%s: expected the description to mention %q", subcmd.Name, "wrestic status")
+		}
+		if strings.Contains(subcmd.Description, "status status") {
+			t.Errorf("%s: repeated command name in description", subcmd.Name)
+		}
+	}
+}
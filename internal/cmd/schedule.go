@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/schedule"
+	"github.com/urfave/cli/v2"
+)
+
+func makeSchedule(parentName, name string) *cli.Command {
+	fullName := parentName + " " + name
+	generateFormats := []string{"systemd", "cron"}
+
+	defaultSystemdDir, err := schedule.DefaultSystemdDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not determine default systemd user directory: %s\n", err)
+	}
+
+	configDirFlag := newConfigDirFlag()
+	configFileFlag := newConfigFileFlag()
+	systemConfigFlag := newSystemConfigFlag()
+	storenamesFlag := &cli.StringSliceFlag{
+		Name:    "storenames",
+		Aliases: []string{"s"},
+		Usage:   "names of stores to operate on",
+	}
+	binFlag := &cli.PathFlag{
+		Name:  "bin",
+		Usage: "path to the wrestic executable to invoke; defaults to the currently-running one",
+	}
+	systemdDirFlag := &cli.PathFlag{
+		Name:  "systemd-dir",
+		Usage: "directory of systemd user units",
+		Value: defaultSystemdDir,
+	}
+	runFlag := &cli.BoolFlag{
+		Name:  "x",
+		Usage: "actually make the changes; if false then preview",
+	}
+
+	return &cli.Command{
+		Name:  name,
+		Usage: "run restic subcommands periodically",
+		Description: fmt.Sprintf(`Generate systemd units or crontab entries from the config file.
+
+A datastore may have a schedule table, which maps the name of a subcommand of
+%s exec to a schedule. For example:
+
+	[datastores.stuff.schedule]
+	backup = 'daily 02:00'
+	check = 'weekly'
+
+Each scheduled subcommand invokes:
+
+	%s exec <subcommand> -x -storenames <store> -config-dir <config-dir>
+
+Accepted schedules are:
+
+	hourly [:MM]
+	daily [HH:MM]
+	weekly [DAY] [HH:MM]
+	monthly [DD] [HH:MM]
+	MINUTE HOUR DAY_OF_MONTH MONTH DAY_OF_WEEK (a cron expression)`,
+			parentName, parentName),
+		Subcommands: []*cli.Command{
+			{
+				Name:  "generate",
+				Usage: "output systemd units or crontab entries",
+				Flags: []cli.Flag{
+					configDirFlag, configFileFlag, systemConfigFlag, storenamesFlag, binFlag,
+					&cli.StringFlag{
+						Name:    "format",
+						Aliases: []string{"f"},
+						Usage:   fmt.Sprintf("output format, one of %q", generateFormats),
+						Value:   generateFormats[0],
+					},
+				},
+				Action: func(c *cli.Context) error {
+					jobs, err := fetchJobs(c)
+					if err != nil {
+						return err
+					}
+
+					switch format := c.String("format"); format {
+					case "systemd":
+						for _, job := range jobs {
+							for _, unit := range schedule.SystemdUnits(job) {
+								fmt.Fprintf(os.Stdout, "### %s\n%s\n", unit.Name, unit.Contents)
+							}
+						}
+					case "cron":
+						for _, job := range jobs {
+							fmt.Fprintln(os.Stdout, schedule.CrontabLine(job))
+						}
+					default:
+						return fmt.Errorf("unknown format %q, should be one of %q", format, generateFormats)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "install",
+				Usage: "write systemd units and enable timers",
+				Flags: []cli.Flag{configDirFlag, configFileFlag, systemConfigFlag, storenamesFlag, binFlag, systemdDirFlag, runFlag},
+				Description: fmt.Sprintf(`Write systemd units for scheduled subcommands into the systemd user directory,
+then reload systemd and enable the timers. Units previously generated by
+%s that are no longer scheduled are disabled and removed. By default, the
+changes are only previewed. To actually make changes, use flag -x.`, fullName),
+				Action: func(c *cli.Context) error {
+					jobs, err := fetchJobs(c)
+					if err != nil {
+						return err
+					}
+					dir := c.Path("systemd-dir")
+
+					var units []schedule.Unit
+					var timers []string
+					for _, job := range jobs {
+						units = append(units, schedule.SystemdUnits(job)...)
+						timers = append(timers, job.Name()+".timer")
+					}
+
+					write, remove, err := schedule.Plan(dir, units)
+					if err != nil {
+						return err
+					}
+					for _, name := range write {
+						fmt.Fprintf(os.Stderr, "# write %s\n", filepath.Join(dir, name))
+					}
+					for _, name := range remove {
+						fmt.Fprintf(os.Stderr, "# remove %s\n", filepath.Join(dir, name))
+					}
+
+					if !c.Bool("x") {
+						return nil
+					}
+
+					if staleTimers := filterTimers(remove); len(staleTimers) > 0 {
+						if err = systemctl(append([]string{"disable", "--now"}, staleTimers...)...); err != nil {
+							return err
+						}
+					}
+					if err = schedule.Install(dir, units); err != nil {
+						return err
+					}
+					if err = systemctl("daemon-reload"); err != nil {
+						return err
+					}
+					if len(timers) < 1 {
+						return nil
+					}
+					return systemctl(append([]string{"enable", "--now"}, timers...)...)
+				},
+			},
+			{
+				Name:  "uninstall",
+				Usage: "disable timers and remove systemd units",
+				Flags: []cli.Flag{systemdDirFlag, runFlag},
+				Description: fmt.Sprintf(`Disable the timers and remove every systemd unit generated by %s from
+the systemd user directory. By default, the changes are only previewed. To
+actually make changes, use flag -x.`, fullName),
+				Action: func(c *cli.Context) error {
+					dir := c.Path("systemd-dir")
+
+					_, remove, err := schedule.Plan(dir, nil)
+					if err != nil {
+						return err
+					}
+					for _, name := range remove {
+						fmt.Fprintf(os.Stderr, "# remove %s\n", filepath.Join(dir, name))
+					}
+
+					if !c.Bool("x") || len(remove) < 1 {
+						return nil
+					}
+
+					if timers := filterTimers(remove); len(timers) > 0 {
+						if err = systemctl(append([]string{"disable", "--now"}, timers...)...); err != nil {
+							return err
+						}
+					}
+					if _, err = schedule.Uninstall(dir); err != nil {
+						return err
+					}
+					return systemctl("daemon-reload")
+				},
+			},
+		},
+	}
+}
+
+func fetchJobs(c *cli.Context) (out []schedule.Job, err error) {
+	paths, err := locateConfig(c)
+	if err != nil {
+		return
+	}
+	if paths.file == config.StdinName {
+		return nil, errors.New("scheduled subcommands read the config file later, so it cannot be stdin")
+	}
+	if paths.dir, err = filepath.Abs(paths.dir); err != nil {
+		return
+	}
+
+	bin := c.Path("bin")
+	if bin == "" {
+		if bin, err = os.Executable(); err != nil {
+			return
+		}
+	}
+
+	resolved, err := paths.resolve()
+	if err != nil {
+		return
+	}
+	var datastores []config.Datastore
+	for _, store := range resolved.Select(c.StringSlice("storenames"), nil) {
+		datastores = append(datastores, store.Datastore())
+	}
+
+	if out, err = schedule.Jobs(datastores, execSubcmds, bin, paths.dir); err != nil {
+		return
+	}
+
+	// Only pass along config files that were specified, so that the defaults
+	// are the same as for the running wrestic.
+	var (
+		configFile       string
+		systemConfigFile *string
+	)
+	if paths.explicitFile {
+		if configFile, err = filepath.Abs(paths.file); err != nil {
+			return
+		}
+	}
+	if c.IsSet("system-config") {
+		// An empty one ignores the system-wide config file, and so must the
+		// scheduled subcommands.
+		file := paths.systemFile
+		if file != "" {
+			if file, err = filepath.Abs(file); err != nil {
+				return
+			}
+		}
+		systemConfigFile = &file
+	}
+	for i := range out {
+		out[i].ConfigFile = configFile
+		out[i].SystemConfigFile = systemConfigFile
+	}
+	return
+}
+
+func filterTimers(names []string) (out []string) {
+	for _, name := range names {
+		if strings.HasSuffix(name, ".timer") {
+			out = append(out, name)
+		}
+	}
+	return
+}
+
+func systemctl(args ...string) error {
+	args = append([]string{"--user"}, args...)
+	fmt.Fprintf(os.Stderr, "# systemctl %s\n", strings.Join(args, " "))
+
+	cmd := osexec.Command("systemctl", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
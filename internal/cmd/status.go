@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/lock"
+	"github.com/urfave/cli/v2"
+)
+
+func makeStatus(parentName, name string) *cli.Command {
+	outputFormats := []string{"text", "json"}
+
+	return &cli.Command{
+		Name:  name,
+		Usage: "show which destinations are being operated upon",
+		Description: fmt.Sprintf(`Show the destinations that are locked by a running %s process, along
+with the process ID and command line of the holder.
+
+While running restic with %s exec -x or %s daemon, a lock upon each
+destination is taken so that separate processes never operate upon the same
+restic repository at the same time.
+
+The locks are in the config dir, wherever the config file is, so there's no
+-config-file flag here. Pass the same -config-dir as the running process.`, parentName, parentName, parentName),
+		Flags: []cli.Flag{
+			newConfigDirFlag(),
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: fmt.Sprintf("output format, one of %q", outputFormats),
+				Value: outputFormats[0],
+			},
+		},
+		Action: func(c *cli.Context) error {
+			configDir := c.Path("config-dir")
+			if configDir == "" {
+				return errors.New("config dir cannot be empty; possibly could not determine a default either")
+			}
+
+			holders, err := lock.List(lockDir(configDir))
+			if err != nil {
+				return err
+			}
+
+			switch format := c.String("format"); format {
+			case "json":
+				if holders == nil {
+					holders = []lock.Holder{}
+				}
+				return json.NewEncoder(os.Stdout).Encode(holders)
+			case "text":
+				if len(holders) < 1 {
+					fmt.Fprintln(os.Stderr, "nothing is running")
+					return nil
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "STORE\tDESTINATION\tSUBCOMMAND\tPID\tSINCE\tCOMMAND")
+				for _, h := range holders {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+						h.Store, h.Destination, h.Subcommand, h.PID, h.Acquired.Format(time.RFC3339), strings.Join(h.Command, " "),
+					)
+				}
+				return w.Flush()
+			default:
+				return fmt.Errorf("invalid format %q, should be one of %q", format, outputFormats)
+			}
+		},
+	}
+}
+
+// lockDir is where the locks upon destinations are kept.
+func lockDir(configDir string) string { return filepath.Join(configDir, "locks") }
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/rafaelespinoza/wrestic/internal/version"
+)
+
+// These are values for the unsupported-flags key of Defaults.
+const (
+	// UnsupportedFlagsFail stops a batch before running restic upon any
+	// destination. It's the default.
+	UnsupportedFlagsFail = "fail"
+	// UnsupportedFlagsDrop leaves out the flag, with a warning.
+	UnsupportedFlagsDrop = "drop"
+)
+
+// FlagVersions outputs the minimum restic version of each flag for subcmd,
+// including global flags, that needs one. The keys are flag names. A flag
+// that's not in the output is supported by every version of restic.
+func FlagVersions(subcmd string) map[string]version.Version {
+	out := make(map[string]version.Version)
+	sections := []string{"global", subcmd}
+	for i, t := range flagTypes(subcmd) {
+		addFlagVersions(out, t, flagVersions[sections[i]])
+	}
+	return out
+}
+
+// flagVersions are the minimum restic versions of flags, keyed by the toml key
+// of the section in ResticDefaults, and then by flag name. Each one is the
+// release that added the flag, per restic's changelog:
+// https://github.com/restic/restic/blob/master/CHANGELOG.md.
+var flagVersions = map[string]map[string]string{
+	"global": {
+		// 0.14.0: "Add support for compression".
+		"compression": "0.14.0",
+		// 0.15.0: "Add --insecure-tls option".
+		"insecure-tls": "0.15.0",
+		// 0.14.0: "Allow pack size customization".
+		"pack-size": "0.14.0",
+	},
+	"backup": {
+		// 0.10.0: "Support excluding files by their size".
+		"exclude-larger-than": "0.10.0",
+		// 0.12.0: "Add --files-from-verbatim and --files-from-raw options".
+		"files-from-raw":      "0.12.0",
+		"files-from-verbatim": "0.12.0",
+	},
+}
+
+// flagSince outputs the minimum restic version of the flag, key, of the struct
+// type, t, which is a section of ResticDefaults. It's empty if every version of
+// restic has the flag.
+func flagSince(t reflect.Type, key string) string {
+	sections := reflect.TypeOf(ResticDefaults{})
+	for i := 0; i < sections.NumField(); i++ {
+		if field := sections.Field(i); field.Type.Elem() == t {
+			return flagVersions[tomlKey(field)][key]
+		}
+	}
+	return ""
+}
+
+// flagTypes outputs the struct types with the flags for subcmd. The global
+// flags are first.
+func flagTypes(subcmd string) (out []reflect.Type) {
+	out = append(out, reflect.TypeOf(ResticGlobal{}))
+
+	all := ResticDefaults{
+		Backup:    &ResticBackup{},
+		Check:     &ResticCheck{},
+		LS:        &ResticLS{},
+		Snapshots: &ResticSnapshots{},
+		Stats:     &ResticStats{},
+	}
+	if restic := selectResticSubcommand(&all, subcmd); restic != nil {
+		out = append(out, reflect.TypeOf(restic).Elem())
+	}
+	return
+}
+
+// A FlagKind says how restic parses a flag.
+type FlagKind int
+
+const (
+	// FlagSingle is a flag with a value, either after "=" or in the next
+	// argument. When it's specified more than once, the last one wins.
+	FlagSingle FlagKind = iota
+	// FlagSwitch is a flag, such as a bool, that only has a value after "=".
+	// It's otherwise like FlagSingle.
+	FlagSwitch
+	// FlagRepeatable is a flag that may be specified more than once, and each
+	// value is kept.
+	FlagRepeatable
+)
+
+// FlagKinds outputs the FlagKind of each flag for subcmd, including global
+// flags. The keys are flag names.
+func FlagKinds(subcmd string) map[string]FlagKind {
+	out := make(map[string]FlagKind)
+	for _, t := range flagTypes(subcmd) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+			switch {
+			case field.Type.Elem().Kind() == reflect.Slice:
+				out[key] = FlagRepeatable
+			case field.Type.Elem().Kind() == reflect.Bool, key == "verbose":
+				// The verbose flag is a count, so it's like a bool.
+				out[key] = FlagSwitch
+			default:
+				out[key] = FlagSingle
+			}
+		}
+	}
+	return out
+}
+
+// addFlagVersions adds the versions of the flags of the struct type, t. A flag
+// of the subcommand takes precedence over a global flag with the same name.
+func addFlagVersions(out map[string]version.Version, t reflect.Type, versions map[string]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if since := versions[key]; since != "" {
+			out[key] = version.MustParse(since)
+		} else {
+			delete(out, key)
+		}
+	}
+}
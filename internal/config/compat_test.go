@@ -0,0 +1,102 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/version"
+)
+
+func TestFlagVersions(t *testing.T) {
+	tests := []struct {
+		subcmd   string
+		expected map[string]string
+	}{
+		{
+			subcmd: "backup",
+			expected: map[string]string{
+				"compression":         "0.14.0",
+				"exclude-larger-than": "0.10.0",
+				"files-from-raw":      "0.12.0",
+				"files-from-verbatim": "0.12.0",
+				"insecure-tls":        "0.15.0",
+				"pack-size":           "0.14.0",
+			},
+		},
+		{
+			subcmd:   "snapshots",
+			expected: map[string]string{"compression": "0.14.0", "insecure-tls": "0.15.0", "pack-size": "0.14.0"},
+		},
+		{
+			subcmd:   "unknown",
+			expected: map[string]string{"compression": "0.14.0", "insecure-tls": "0.15.0", "pack-size": "0.14.0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.subcmd, func(t *testing.T) {
+			expected := make(map[string]version.Version)
+			for key, val := range test.expected {
+				expected[key] = version.MustParse(val)
+			}
+
+			got := config.FlagVersions(test.subcmd)
+			if diff := cmp.Diff(got, expected); diff != "" {
+				t.Errorf("wrong FlagVersions (- means something in actual) (+ means something in expected)\n%s", diff)
+			}
+
+			// Catch a typo in the table of versions.
+			kinds := config.FlagKinds(test.subcmd)
+			for key := range got {
+				if _, ok := kinds[key]; !ok {
+					t.Errorf("unknown flag %q", key)
+				}
+			}
+		})
+	}
+}
+
+func TestFlagKinds(t *testing.T) {
+	tests := []struct {
+		subcmd   string
+		expected map[string]config.FlagKind
+	}{
+		{
+			subcmd: "backup",
+			expected: map[string]config.FlagKind{
+				"repo":             config.FlagSingle,
+				"password-command": config.FlagSingle,
+				"verbose":          config.FlagSwitch,
+				"option":           config.FlagRepeatable,
+				"host":             config.FlagSingle,
+				"tag":              config.FlagRepeatable,
+				"dry-run":          config.FlagSwitch,
+			},
+		},
+		{
+			subcmd: "check",
+			expected: map[string]config.FlagKind{
+				"read-data":        config.FlagSwitch,
+				"read-data-subset": config.FlagSingle,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.subcmd, func(t *testing.T) {
+			got := config.FlagKinds(test.subcmd)
+			for key, expected := range test.expected {
+				if kind, ok := got[key]; !ok {
+					t.Errorf("missing flag %q", key)
+				} else if kind != expected {
+					t.Errorf("wrong kind for %q; got %d, expected %d", key, kind, expected)
+				}
+			}
+		})
+	}
+
+	if _, ok := config.FlagKinds("check")["tag"]; ok {
+		t.Error("flags of backup should not be in check")
+	}
+}
@@ -10,48 +10,57 @@ import (
 	"github.com/imdario/mergo"
 )
 
-// Parse not only constructs Params from configuration file data, it also
-// prepares some internal state necessary for merging data later on.
+// Parse constructs Params from configuration file data. The Name of each
+// Datastore and Destination is set from its key.
 func Parse(r io.Reader) (out Params, err error) {
-	meta, err := toml.NewDecoder(r).Decode(&out)
+	out, unexpectedKeys, err := decode(r)
 	if err != nil {
 		return
 	}
 
-	unexpectedKeys := meta.Undecoded()
 	if len(unexpectedKeys) > 0 {
 		err = fmt.Errorf("unexpected keys %q", unexpectedKeys)
+	}
+	return
+}
+
+// decode is like Parse, but outputs any keys that are not part of Params,
+// rather than an error.
+func decode(r io.Reader) (out Params, undecoded []toml.Key, err error) {
+	meta, err := toml.NewDecoder(r).Decode(&out)
+	if err != nil {
 		return
 	}
+	undecoded = meta.Undecoded()
+	out.setNames()
+	return
+}
 
-	for storeName, datastore := range out.Datastores {
-		// Ensure consistent Datastore, otherwise goofy things happen such as
-		// the wrong parent value getting assigned to a Destination. Direct use
-		// of the variable defined in the range statement above seems to lead to
-		// nondeterministic results.
-		currDatastore := datastore
+// setNames sets the Name of each Datastore, including those of Hosts, and of
+// each Destination.
+func (p *Params) setNames() {
+	nameDatastores(p.Datastores)
+	for _, host := range p.Hosts {
+		nameDatastores(host.Datastores)
+	}
+}
 
+func nameDatastores(datastores map[string]Datastore) {
+	for storeName, store := range datastores {
 		// Why not specify the Name field in the configuration file? It's easier
 		// to maintain the configuration file if there are less things to
 		// specify. Here, we want the Name to be unique among a set. Naturally,
 		// a map data structure provides this. Use the key as Name here.
-		currDatastore.Name = storeName
-
-		currDatastore.parent = &out.Defaults
-		out.Datastores[storeName] = currDatastore
+		store.Name = storeName
 
-		for destName, dest := range currDatastore.Destinations {
-			dest.parent = &currDatastore
-			if dest.Name != destName {
-				// Same reasoning as the datastore.Name field described above.
-				// Ease maintainence of the configuration file.
-				dest.Name = destName
-			}
-
-			currDatastore.Destinations[destName] = dest
+		for destName, dest := range store.Destinations {
+			// Same reasoning as the datastore.Name field described above.
+			dest.Name = destName
+			store.Destinations[destName] = dest
 		}
+
+		datastores[storeName] = store
 	}
-	return
 }
 
 // EncodeTOML formats in to TOML and writes to w.
@@ -62,14 +71,53 @@ func EncodeTOML(w io.Writer, in any) error {
 
 // Params represents the entire config file after it's parsed.
 type Params struct {
+	// Include are more config files to read datastores from, see Load.
+	Include    []string             `toml:"include"`
 	Defaults   Defaults             `toml:"defaults"`
 	Datastores map[string]Datastore `toml:"datastores"`
+	// Hosts maps a hostname, or a glob pattern of one, to config that only
+	// applies upon matching hosts. See ForHost.
+	Hosts map[string]Host `toml:"hosts"`
+	// Profiles are overlays of config, by name, which apply when selected at
+	// runtime. See WithProfile.
+	Profiles map[string]Profile `toml:"profiles"`
+	// File is the main config file, where the Defaults, Hosts and Profiles
+	// are defined. It's only set by Load.
+	File string `toml:"-"`
+	// Files are every config file that's read, such as by Load, including
+	// File. Some of them may not define anything.
+	Files []string `toml:"-"`
+	// Dirs are the directories, such as ConfDir, where Load looks for more
+	// config files. They may not exist. See Load.
+	Dirs []string `toml:"-"`
 }
 
 // Defaults defines configuration values.
 type Defaults struct {
 	PasswordConfig *PasswordConfig `toml:"password-config"`
 	Restic         *ResticDefaults `toml:"restic"`
+	Notify         *NotifyConfig   `toml:"notify,omitempty"`
+	Process        *ProcessConfig  `toml:"process,omitempty"`
+	// ResticBin is the path to the restic executable. When empty, then the
+	// environment variable, RESTIC_BIN, is consulted. Otherwise, the first
+	// restic executable found in PATH is used.
+	ResticBin *string `toml:"restic-bin"`
+	// ResticVersion is a constraint, such as ">= 0.16, < 0.18", that the
+	// version of the restic executable must satisfy.
+	ResticVersion *string `toml:"restic-version"`
+	// UnsupportedFlags says what to do with a flag that's not supported by the
+	// version of the restic executable. It's either UnsupportedFlagsFail or
+	// UnsupportedFlagsDrop. When empty, it's UnsupportedFlagsFail.
+	UnsupportedFlags *string `toml:"unsupported-flags"`
+	// Timeout maps the name of a restic subcommand, such as "backup", to how
+	// long it may run upon a destination, such as "4h". It's parsed by
+	// time.ParseDuration. The keys from each level are merged together.
+	Timeout *map[string]string `toml:"timeout"`
+	// Merge maps the dotted key of a value, such as "restic.backup.exclude",
+	// to how it's combined with the value inherited from the level beneath:
+	// "replace", "append" or "unset". See MergeReplace, MergeAppend and
+	// MergeUnset.
+	Merge map[string]string `toml:"merge"`
 }
 
 func mergeDefaults(dst, src *Defaults) {
@@ -77,13 +125,51 @@ func mergeDefaults(dst, src *Defaults) {
 		return
 	}
 
+	before := mergeStrategyValues(dst)
+	defer applyMergeStrategies(dst, src, before)
+
 	mergeConfig(dst.PasswordConfig, src.PasswordConfig)
 	mergeConfig(dst.Restic, src.Restic)
+	mergeConfig(dst.Notify, src.Notify)
+	mergeProcessConfig(dst.Process, src.Process)
+	if dst.ResticBin == nil {
+		dst.ResticBin = duplicateString(src.ResticBin)
+	}
+	if dst.ResticVersion == nil {
+		dst.ResticVersion = duplicateString(src.ResticVersion)
+	}
+	if dst.UnsupportedFlags == nil {
+		dst.UnsupportedFlags = duplicateString(src.UnsupportedFlags)
+	}
+	if src.Timeout != nil {
+		timeout := duplicateTimeout(dst.Timeout)
+		if timeout == nil {
+			timeout = &map[string]string{}
+		}
+		for subcmd, val := range *src.Timeout {
+			if _, ok := (*timeout)[subcmd]; !ok {
+				(*timeout)[subcmd] = val
+			}
+		}
+		dst.Timeout = timeout
+	}
 }
 
 func duplicateDefaults(in Defaults) (out Defaults) {
+	out.ResticBin = duplicateString(in.ResticBin)
+	out.ResticVersion = duplicateString(in.ResticVersion)
+	out.UnsupportedFlags = duplicateString(in.UnsupportedFlags)
 	out.PasswordConfig = duplicatePasswordConfig(in.PasswordConfig)
 	out.Restic = duplicateResticDefaults(in.Restic)
+	out.Notify = duplicateNotifyConfig(in.Notify)
+	out.Process = duplicateProcessConfig(in.Process)
+	out.Timeout = duplicateTimeout(in.Timeout)
+	if in.Merge != nil {
+		out.Merge = make(map[string]string, len(in.Merge))
+		for key, strategy := range in.Merge {
+			out.Merge[key] = strategy
+		}
+	}
 	return
 }
 
@@ -105,12 +191,75 @@ func duplicatePasswordConfig(in *PasswordConfig) (out *PasswordConfig) {
 		return
 	}
 
-	mergeConfig(out, in)
+	*out = deepCopy(reflect.ValueOf(*in)).Interface().(PasswordConfig)
 	return
 }
 
+func duplicateTimeout(in *map[string]string) *map[string]string {
+	if in == nil {
+		return nil
+	}
+
+	out := make(map[string]string, len(*in))
+	for subcmd, val := range *in {
+		out[subcmd] = val
+	}
+	return &out
+}
+
+func duplicateString(in *string) *string {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
+
+// deepCopy outputs a copy of in, where every pointer, slice and map is also
+// copied. Unexported struct fields are left empty.
+func deepCopy(in reflect.Value) reflect.Value {
+	switch in.Kind() {
+	case reflect.Pointer:
+		if in.IsNil() {
+			return in
+		}
+		out := reflect.New(in.Type().Elem())
+		out.Elem().Set(deepCopy(in.Elem()))
+		return out
+	case reflect.Struct:
+		out := reflect.New(in.Type()).Elem()
+		for i := 0; i < in.NumField(); i++ {
+			if out.Field(i).CanSet() {
+				out.Field(i).Set(deepCopy(in.Field(i)))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if in.IsNil() {
+			return in
+		}
+		out := reflect.MakeSlice(in.Type(), in.Len(), in.Len())
+		for i := 0; i < in.Len(); i++ {
+			out.Index(i).Set(deepCopy(in.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if in.IsNil() {
+			return in
+		}
+		out := reflect.MakeMapWithSize(in.Type(), in.Len())
+		iter := in.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return out
+	default:
+		return in
+	}
+}
+
 type mergeableConfig interface {
-	PasswordConfig | ResticDefaults
+	PasswordConfig | ResticDefaults | NotifyConfig
 }
 
 func mergeConfig[C mergeableConfig](dst, src *C) {
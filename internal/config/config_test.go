@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/rafaelespinoza/wrestic/internal/config"
 )
 
@@ -133,6 +134,226 @@ args = ['secrets/foo']
 
 		testDefaults(t, "", actual.Defaults, expected.Defaults)
 	})
+
+	t.Run("parses NotifyConfig", func(t *testing.T) {
+		const input = `
+[defaults.notify]
+on = 'recovery'
+scope = 'batch'
+
+[defaults.notify.webhook]
+url = 'http://localhost:8080/hook'
+template = '{"text": {{ json .Summary }}}'
+headers = { Authorization = 'Bearer foo' }
+
+[defaults.notify.healthchecks]
+url = 'http://localhost:8000/ping/abc'
+
+[defaults.notify.smtp]
+addr = 'localhost:25'
+from = 'wrestic@localhost'
+to = ['root@localhost']
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.stuff.destinations.foo.defaults.notify.healthchecks]
+url = 'http://localhost:8000/ping/foo'
+`
+		actual, err := config.Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := &config.NotifyConfig{
+			On:    pointTo("recovery"),
+			Scope: pointTo("batch"),
+			Webhook: &config.NotifyWebhook{
+				URL:      pointTo("http://localhost:8080/hook"),
+				Template: pointTo(`{"text": {{ json .Summary }}}`),
+				Headers:  &map[string]string{"Authorization": "Bearer foo"},
+			},
+			Healthchecks: &config.NotifyHealthchecks{URL: pointTo("http://localhost:8000/ping/abc")},
+			SMTP: &config.NotifySMTP{
+				Addr: pointTo("localhost:25"),
+				From: pointTo("wrestic@localhost"),
+				To:   pointToStrings("root@localhost"),
+			},
+		}
+		if diff := cmp.Diff(actual.Defaults.Notify, expected); diff != "" {
+			t.Errorf("Defaults.Notify (- means something in actual) (+ means something in expected)\n%s", diff)
+		}
+
+		dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, "foo")
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected.Healthchecks = &config.NotifyHealthchecks{URL: pointTo("http://localhost:8000/ping/foo")}
+		if diff := cmp.Diff(merged.Notify, expected); diff != "" {
+			t.Errorf("merged Notify (- means something in actual) (+ means something in expected)\n%s", diff)
+		}
+	})
+
+	t.Run("parses ProcessConfig", func(t *testing.T) {
+		const input = `
+[defaults.process]
+nice = 10
+ionice = { class = 'best-effort', level = 7 }
+env = { RESTIC_READ_CONCURRENCY = '2', RESTIC_PACK_SIZE = '32' }
+
+[datastores.photos.defaults.process]
+ionice = { class = 'idle' }
+gomaxprocs = 1
+env = { RESTIC_READ_CONCURRENCY = '1' }
+
+[datastores.photos.destinations.foo]
+path = 'foo'
+
+[datastores.code.defaults.process]
+nice = 0
+ionice = { level = 0 }
+
+[datastores.code.destinations.bar]
+path = 'bar'
+
+[datastores.code.destinations.bar.defaults.restic.global]
+verbose = 0
+
+[defaults.restic.global]
+verbose = 1
+`
+		actual, err := config.Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			store, dest string
+			expected    *config.ProcessConfig
+		}{
+			{
+				store: "photos", dest: "foo",
+				expected: &config.ProcessConfig{
+					Nice:       pointTo(10),
+					IONice:     &config.IONiceConfig{Class: pointTo("idle"), Level: pointTo(7)},
+					GOMAXPROCS: pointTo(1),
+					Env:        &map[string]string{"RESTIC_READ_CONCURRENCY": "1", "RESTIC_PACK_SIZE": "32"},
+				},
+			},
+			{
+				store: "code", dest: "bar",
+				expected: &config.ProcessConfig{
+					Nice:   pointTo(0),
+					IONice: &config.IONiceConfig{Class: pointTo("best-effort"), Level: pointTo(0)},
+					Env:    &map[string]string{"RESTIC_READ_CONCURRENCY": "2", "RESTIC_PACK_SIZE": "32"},
+				},
+			},
+		}
+
+		for _, test := range tests {
+			dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, test.dest)
+			merged, err := dest.Merge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(merged.Process, test.expected); diff != "" {
+				t.Errorf("%s/%s merged Process (- means something in actual) (+ means something in expected)\n%s", test.store, test.dest, diff)
+			}
+
+			// Changing the output should not change the config.
+			*merged.Process.IONice.Class = "changed"
+			*merged.Process.IONice.Level = -1
+			again, err := dest.Merge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(again.Process, test.expected); diff != "" {
+				t.Errorf("%s/%s merged Process again (- means something in actual) (+ means something in expected)\n%s", test.store, test.dest, diff)
+			}
+		}
+
+		// Unlike those of ProcessConfig, a zero int of restic is replaced by a
+		// value of lower precedence.
+		dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, "bar")
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := merged.Restic.Global.Verbose; got == nil || *got != 1 {
+			t.Errorf("wrong verbose; got %v, expected %d", got, 1)
+		}
+	})
+
+	t.Run("parses restic-bin and restic-version", func(t *testing.T) {
+		const input = `
+[defaults]
+restic-bin = '/usr/bin/restic'
+restic-version = '>= 0.16'
+
+[datastores.photos.defaults]
+restic-version = '>= 0.17'
+
+[datastores.photos.destinations.foo]
+path = 'foo'
+
+[datastores.code.destinations.bar]
+path = 'bar'
+
+[datastores.code.destinations.bar.defaults]
+restic-bin = '/opt/restic/bin/restic'
+`
+		actual, err := config.Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			store, dest                    string
+			expResticBin, expResticVersion string
+		}{
+			{store: "photos", dest: "foo", expResticBin: "/usr/bin/restic", expResticVersion: ">= 0.17"},
+			{store: "code", dest: "bar", expResticBin: "/opt/restic/bin/restic", expResticVersion: ">= 0.16"},
+		}
+
+		for _, test := range tests {
+			dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, test.dest)
+			merged, err := dest.Merge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(merged.ResticBin, pointTo(test.expResticBin)); diff != "" {
+				t.Errorf("%s/%s merged ResticBin (- means something in actual) (+ means something in expected)\n%s", test.store, test.dest, diff)
+			}
+			if diff := cmp.Diff(merged.ResticVersion, pointTo(test.expResticVersion)); diff != "" {
+				t.Errorf("%s/%s merged ResticVersion (- means something in actual) (+ means something in expected)\n%s", test.store, test.dest, diff)
+			}
+		}
+	})
+
+	t.Run("parses Schedule", func(t *testing.T) {
+		const input = `
+[datastores.stuff.schedule]
+backup = 'daily 02:00'
+check = 'weekly'
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+`
+		actual, err := config.Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{"backup": "daily 02:00", "check": "weekly"}
+		selected := config.SelectDatastores(actual.Datastores, nil, nil)
+		if len(selected) != 1 {
+			t.Fatalf("wrong number of Datastores; got %d, expected %d", len(selected), 1)
+		}
+		if diff := cmp.Diff(selected[0].Schedule, expected); diff != "" {
+			t.Errorf("Schedule (- means something in actual) (+ means something in expected)\n%s", diff)
+		}
+	})
 }
 
 func testDefaults(t *testing.T, errPrefix string, got, exp config.Defaults) {
@@ -203,3 +424,30 @@ func testStrings(t *testing.T, errPrefix string, actual, expected []string) {
 		}
 	}
 }
+
+func TestEncodeTOML(t *testing.T) {
+	params, err := config.Parse(strings.NewReader(`
+[datastores.stuff]
+[[datastores.stuff.sources]]
+path = '/foo'
+[datastores.stuff.destinations.alfa]
+path = '/alfa'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range config.SelectDatastores(params.Datastores, nil, nil) {
+		var out strings.Builder
+		if err = config.EncodeTOML(&out, store); err != nil {
+			t.Fatal(err)
+		}
+
+		// Values which aren't specified should not be output.
+		for _, notExpected := range []string{"override", "notify", "process"} {
+			if strings.Contains(out.String(), notExpected) {
+				t.Errorf("output should not contain %q\n%s", notExpected, out.String())
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
-import "sort"
+import (
+	"sort"
+)
 
 // SelectDatastores filters for Datastores with an exactly-matching Name in
 // names, or have a Destination exactly matching one in destNames. If names is
@@ -54,18 +56,20 @@ type Datastore struct {
 	Defaults     Defaults               `toml:"defaults"`
 	Sources      []Source               `toml:"sources"`
 	Destinations map[string]Destination `toml:"destinations"`
+	// Schedule maps the name of a restic subcommand to a schedule for running
+	// it upon the Datastore, such as "daily 02:00". See package schedule for
+	// accepted forms.
+	Schedule map[string]string `toml:"schedule"`
+	// Override says that the Datastore replaces one of the same name from a
+	// config file of lower precedence. See MergeLayers.
+	Override bool `toml:"override,omitempty"`
 	// Name is not specified in the config file, but is implied by the
 	// Datastore's place in the config data. The intention is to ease
 	// maintenance of the configuration file.
 	Name string `toml:"-"`
-
-	parent *Defaults
-}
-
-func (d *Datastore) merge() (out Datastore) {
-	out, _ = makeDatastore(*d)
-	mergeDefaults(&out.Defaults, d.parent)
-	return
+	// File is the config file where the Datastore is defined. It's only set
+	// by Load.
+	File string `toml:"-"`
 }
 
 // makeDatastore also returns a boolean to signal to the caller that at least 1
@@ -91,12 +95,22 @@ func makeDatastore(in Datastore, destNames ...string) (out Datastore, destMatch
 		}
 	}
 
+	var schedule map[string]string
+	if in.Schedule != nil {
+		schedule = make(map[string]string, len(in.Schedule))
+		for subcmd, spec := range in.Schedule {
+			schedule[subcmd] = spec
+		}
+	}
+
 	out = Datastore{
 		Name:         in.Name,
+		File:         in.File,
 		Sources:      srcs,
 		Destinations: dests,
+		Schedule:     schedule,
+		Override:     in.Override,
 		Defaults:     duplicateDefaults(in.Defaults),
-		parent:       in.parent,
 	}
 
 	return
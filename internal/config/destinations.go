@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 // Destination is a restic repository.
 type Destination struct {
 	// Name is not specified in the config file, but is implied by the
@@ -11,79 +16,72 @@ type Destination struct {
 	Defaults Defaults `toml:"defaults"`
 	// Path is the restic repository path.
 	Path string `toml:"path"`
-
-	parent *Datastore
 }
 
-// Merge combines the Defaults from the config file's top-level Defaults into
-// the Datastore's Defaults, and then combines that into the Destination's
-// Defaults. Any config values specified for the Destination are not overridden
-// by the same config value specified in the Datastore.
-func (d *Destination) Merge() (out Defaults, err error) {
-	var srcDefaults Defaults
-	if d.parent != nil {
-		mergedParent := d.parent.merge()
-		d.parent = &mergedParent
-		srcDefaults = d.parent.Defaults
-	}
+func buildFlags(defaults Defaults, path, configDir, subcmd string) ([]Flag, error) {
+	out := []Flag{{Key: "repo", Val: path}}
 
-	dupe := duplicateDestination(*d)
-	mergeDefaults(&dupe.Defaults, &srcDefaults)
-	out = dupe.Defaults
-	return
-}
+	if pwcmd, err := parsePasswordCommand(configDir, defaults.PasswordConfig); err != nil {
+		return nil, err
+	} else if pwcmd != "" {
+		out = append(out, Flag{Key: "password-command", Val: pwcmd})
+	}
 
-func duplicateDestination(in Destination) (out Destination) {
-	out.Name = in.Name
-	out.Path = in.Path
-	out.Defaults = duplicateDefaults(in.Defaults)
-	out.parent = in.parent
-	return
-}
+	restic := selectResticSubcommand(defaults.Restic, subcmd)
+	if restic == nil {
+		return out, nil
+	}
 
-// BuildFlags merges in default config values and outputs a list of tuples
-// representing the merged config.
-func (d *Destination) BuildFlags(configDir string, subcmd string) ([]Flag, error) {
-	defaults, err := d.Merge()
+	resticFlags, err := restic.makeFlags(defaults.Restic.Global)
 	if err != nil {
 		return nil, err
 	}
 
-	out := []Flag{{Key: "repo", Val: d.Path}}
+	return append(out, resticFlags...), nil
+}
 
-	if pwcmd, err := parsePasswordCommand(configDir, defaults.PasswordConfig); err != nil {
-		return nil, err
-	} else if pwcmd != "" {
-		out = append(out, Flag{Key: "password-command", Val: pwcmd})
+func subcommandTimeout(defaults Defaults, subcmd string) (out time.Duration, err error) {
+	if defaults.Timeout == nil {
+		return
+	}
+	val, ok := (*defaults.Timeout)[subcmd]
+	if !ok {
+		return
 	}
 
-	var restic interface {
-		makeFlags(*ResticGlobal) ([]Flag, error)
+	if out, err = time.ParseDuration(val); err != nil {
+		err = fmt.Errorf("%w: timeout.%s is invalid", err, subcmd)
+	} else if out < 0 {
+		err = fmt.Errorf("timeout.%s cannot be negative", subcmd)
+	}
+	return
+}
+
+// resticSubcommand is the configuration for one restic subcommand.
+type resticSubcommand interface {
+	makeFlags(*ResticGlobal) ([]Flag, error)
+}
+
+// resticSubcommands are the restic subcommands with a section in
+// ResticDefaults.
+var resticSubcommands = []string{"backup", "check", "ls", "snapshots", "stats"}
+
+func selectResticSubcommand(defaults *ResticDefaults, subcmd string) (out resticSubcommand) {
+	if defaults == nil {
+		return
 	}
 
 	switch subcmd {
 	case "backup":
-		restic = defaults.Restic.Backup
+		out = defaults.Backup
 	case "check":
-		restic = defaults.Restic.Check
+		out = defaults.Check
 	case "ls":
-		restic = defaults.Restic.LS
+		out = defaults.LS
 	case "snapshots":
-		restic = defaults.Restic.Snapshots
+		out = defaults.Snapshots
 	case "stats":
-		restic = defaults.Restic.Stats
-	default:
-		break
+		out = defaults.Stats
 	}
-
-	if restic == nil {
-		return out, nil
-	}
-
-	resticFlags, err := restic.makeFlags(defaults.Restic.Global)
-	if err != nil {
-		return nil, err
-	}
-
-	return append(out, resticFlags...), nil
+	return
 }
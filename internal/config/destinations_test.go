@@ -3,6 +3,7 @@ package config_test
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rafaelespinoza/wrestic/internal/config"
 )
@@ -40,7 +41,7 @@ func TestDestination(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		dest := params.Datastores["stuff"].Destinations["foo"]
+		dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{ConfigDir: test.flags.inConfigDir}, "foo")
 
 		merged, err := dest.Merge()
 		if err != nil && !test.merge.expError {
@@ -52,7 +53,7 @@ func TestDestination(t *testing.T) {
 		}
 		testDefaults(t, "", merged, test.merge.expDefaults)
 
-		flags, err := dest.BuildFlags(test.flags.inConfigDir, test.flags.inSubcommand)
+		flags, err := dest.BuildFlags(test.flags.inSubcommand)
 		if err != nil && !test.flags.expError {
 			t.Fatal(err)
 		} else if err == nil && test.flags.expError {
@@ -557,6 +558,53 @@ restic.backup.host = 'custom_host'
 		})
 	})
 
+	t.Run("Timeout", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(`
+[defaults]
+timeout = { backup = '4h', check = '30m', stats = 'soon', prune = '2h' }
+
+[datastores.stuff.defaults]
+timeout = { check = '1h' }
+
+[datastores.stuff.destinations.foo]
+path = 'test'
+
+[datastores.stuff.destinations.foo.defaults]
+timeout = { backup = '90m' }
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, "foo")
+
+		tests := []struct {
+			subcmd   string
+			exp      time.Duration
+			expError bool
+		}{
+			{subcmd: "backup", exp: 90 * time.Minute},
+			{subcmd: "check", exp: time.Hour},
+			{subcmd: "snapshots", exp: 0},
+			{subcmd: "stats", expError: true},
+			{subcmd: "prune", exp: 2 * time.Hour},
+			{subcmd: "unknown", exp: 0},
+		}
+
+		for _, test := range tests {
+			t.Run(test.subcmd, func(t *testing.T) {
+				got, err := dest.Timeout(test.subcmd)
+				if err != nil && !test.expError {
+					t.Fatal(err)
+				} else if err == nil && test.expError {
+					t.Fatal("expected an error")
+				}
+				if got != test.exp {
+					t.Errorf("wrong timeout; got %s, expected %s", got, test.exp)
+				}
+			})
+		}
+	})
+
 	t.Run("Restic.Check", func(t *testing.T) {
 		runTest(t, testCase{
 			inputFileContents: `
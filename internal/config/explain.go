@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Explanation is one value of the merged Defaults of a Destination, and where
+// it comes from. See ResolvedDestination.Explain.
+type Explanation struct {
+	// Key is the dotted key of the value within Defaults, such as
+	// "restic.backup.tag".
+	Key string `json:"key"`
+	Sourced
+	// Shadowed are the values of the same key that are specified elsewhere,
+	// with lower precedence. They're replaced by this one, or appended to when
+	// its Merge is MergeAppend. They're ordered by precedence, highest first.
+	Shadowed []Sourced `json:"shadowed,omitempty"`
+}
+
+// Sourced is a config value and where it's specified.
+type Sourced struct {
+	// Value is nil when Merge is MergeUnset.
+	Value any `json:"value"`
+	// Origin is the table of the config where the value is specified, such as
+	// "defaults", "hosts.web.defaults", "datastores.foo.defaults" or
+	// "profiles.bar.defaults". For a value from overrides, it's
+	// OverridesOrigin.
+	Origin string `json:"origin"`
+	// File is the config file of the Origin, when it's in one. It tells apart
+	// the same Origin in layers of config, see MergeLayers.
+	File string `json:"file,omitempty"`
+	// Merge is the merge strategy of the value in its Origin, if any.
+	Merge string `json:"merge,omitempty"`
+	// Ignored is true when the value does not take effect, despite its
+	// precedence. That's the case for a zero int or false, such as
+	// verbose = 0, when a value of lower precedence is not. Only a Shadowed
+	// value is ignored.
+	Ignored bool `json:"ignored,omitempty"`
+}
+
+// OverridesOrigin is the Origin of a value from the overrides of
+// ResolveOptions.
+const OverridesOrigin = "overrides"
+
+// level is one table of Defaults that's merged for a Destination.
+type level struct {
+	origin   toml.Key
+	file     string
+	defaults Defaults
+}
+
+// mergeLevels merges levels, which are ordered by precedence from lowest to
+// highest, like overlayDefaults. As it goes, it notes where each value of the
+// output comes from, ordered by Key. A value that's unset by a merge strategy
+// is in the explanations too, so that it's clear where it went. A map, such as
+// process.env, is merged one key at a time, so each of its keys is a separate
+// value. It's an error if the merge strategies of a level cannot be applied.
+func mergeLevels(levels []level) (out Defaults, explanations []Explanation, err error) {
+	// The Value of an Explanation is after any appending, but own is what's
+	// specified in its Origin, for when it's shadowed.
+	explained := make(map[string]*Explanation)
+	own := make(map[string]Sourced)
+	for _, lvl := range levels {
+		origin := joinKey(lvl.origin)
+		if err = checkMergeStrategies(lvl.defaults); err != nil {
+			err = fmt.Errorf("%w: in %s.merge", err, origin)
+			return
+		}
+		out = overlayDefaults(lvl.defaults, out)
+
+		merged := make(map[string]any)
+		collectValues(nil, reflect.ValueOf(out), func(key toml.Key, val any) {
+			merged[joinKey(key)] = val
+		})
+		values := make(map[string]any)
+		collectValues(nil, reflect.ValueOf(lvl.defaults), func(key toml.Key, val any) {
+			values[joinKey(key)] = val
+		})
+		strategies := make(map[string]string, len(lvl.defaults.Merge))
+		for key, strategy := range lvl.defaults.Merge {
+			key = joinKey(splitKey(key))
+			strategies[key] = strategy
+			if _, ok := values[key]; !ok && strategy == MergeUnset {
+				values[key] = nil
+			}
+		}
+
+		for key, val := range values {
+			sourced := Sourced{Value: val, Origin: origin, File: lvl.file, Merge: strategies[key]}
+			curr, ok := explained[key]
+			if ok && sourced.Merge != MergeAppend && !reflect.DeepEqual(val, merged[key]) {
+				// The value of lower precedence is kept, like a non-zero int
+				// in place of a zero one.
+				sourced.Ignored = true
+				curr.Shadowed = append([]Sourced{sourced}, curr.Shadowed...)
+				continue
+			}
+
+			next := &Explanation{Key: key, Sourced: sourced}
+			if ok {
+				next.Shadowed = append([]Sourced{own[key]}, curr.Shadowed...)
+			}
+			// It's the merged value, since one that's appended to is the whole
+			// list, and one that's unset is not in it.
+			next.Value = merged[key]
+			explained[key], own[key] = next, sourced
+		}
+	}
+
+	// Every merge strategy is applied, so there's nothing left to merge into.
+	out.Merge = nil
+
+	for _, explanation := range explained {
+		explanations = append(explanations, *explanation)
+	}
+	sort.Slice(explanations, func(i, j int) bool { return explanations[i].Key < explanations[j].Key })
+	return
+}
+
+// collectValues calls add for each specified value within v, with its key. A
+// value is specified if it's a non-nil pointer, or a non-empty slice, which is
+// how mergeConfig tells whether to merge in a value.
+func collectValues(key toml.Key, v reflect.Value, add func(key toml.Key, val any)) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if elem := v.Elem(); elem.Kind() == reflect.Struct || elem.Kind() == reflect.Map {
+			collectValues(key, elem, add)
+		} else {
+			add(key, elem.Interface())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := tomlKey(field)
+			if !field.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if v.Type() == reflect.TypeOf(Defaults{}) && field.Name == "Merge" {
+				// It's not a value, but says how to merge the values.
+				continue
+			}
+			collectValues(append(key[:len(key):len(key)], name), v.Field(i), add)
+		}
+	case reflect.Map:
+		mapKeys := v.MapKeys()
+		sort.Slice(mapKeys, func(i, j int) bool { return mapKeys[i].String() < mapKeys[j].String() })
+		for _, mapKey := range mapKeys {
+			add(append(key[:len(key):len(key)], mapKey.String()), v.MapIndex(mapKey).Interface())
+		}
+	case reflect.Slice:
+		if v.Len() > 0 {
+			add(key, v.Interface())
+		}
+	default:
+		add(key, v.Interface())
+	}
+}
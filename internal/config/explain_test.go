@@ -0,0 +1,319 @@
+package config_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestExplain(t *testing.T) {
+	params, err := config.Parse(strings.NewReader(`
+[defaults]
+restic-bin = "/usr/bin/restic"
+
+[defaults.restic.global]
+verbose = 1
+compression = "max"
+
+[defaults.process.env]
+A = "top"
+B = "top"
+
+[datastores.foo.defaults.restic.global]
+verbose = 2
+
+[datastores.foo.defaults.restic.backup]
+tag = ["store"]
+
+[datastores.foo.defaults.process.env]
+B = "store"
+
+[datastores.foo.destinations.alfa]
+path = "/repos/alfa"
+
+[datastores.foo.destinations.alfa.defaults.restic.backup]
+tag = ["dest"]
+exclude = []
+
+[profiles.quiet.defaults.restic.global]
+compression = "off"
+
+[profiles.quiet.datastores.foo.destinations.alfa.defaults.restic.global]
+verbose = 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := config.ParseOverrides("restic.backup.tag=manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{Profile: "quiet", Overrides: overrides}, "alfa")
+		actual, err := dest.Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []config.Explanation{
+			{
+				Key:     "process.env.A",
+				Sourced: config.Sourced{Value: "top", Origin: "defaults"},
+			},
+			{
+				Key:      "process.env.B",
+				Sourced:  config.Sourced{Value: "store", Origin: "datastores.foo.defaults"},
+				Shadowed: []config.Sourced{{Value: "top", Origin: "defaults"}},
+			},
+			{
+				Key:     "restic-bin",
+				Sourced: config.Sourced{Value: "/usr/bin/restic", Origin: "defaults"},
+			},
+			{
+				Key:     "restic.backup.exclude",
+				Sourced: config.Sourced{Value: []string{}, Origin: "datastores.foo.destinations.alfa.defaults"},
+			},
+			{
+				Key:     "restic.backup.tag",
+				Sourced: config.Sourced{Value: []string{"manual"}, Origin: config.OverridesOrigin},
+				Shadowed: []config.Sourced{
+					{Value: []string{"dest"}, Origin: "datastores.foo.destinations.alfa.defaults"},
+					{Value: []string{"store"}, Origin: "datastores.foo.defaults"},
+				},
+			},
+			{
+				Key:      "restic.global.compression",
+				Sourced:  config.Sourced{Value: "off", Origin: "profiles.quiet.defaults"},
+				Shadowed: []config.Sourced{{Value: "max", Origin: "defaults"}},
+			},
+			{
+				Key:     "restic.global.verbose",
+				Sourced: config.Sourced{Value: 2, Origin: "datastores.foo.defaults"},
+				// A zero int does not replace a non-zero one.
+				Shadowed: []config.Sourced{
+					{Value: 0, Origin: "profiles.quiet.datastores.foo.destinations.alfa.defaults", Ignored: true},
+					{Value: 1, Origin: "defaults"},
+				},
+			},
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("wrong output (-expected +actual):\n%s", diff)
+		}
+
+		// The values should be those of the merged destination.
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDefaults(t, "merged", merged, config.Defaults{
+			PasswordConfig: &config.PasswordConfig{},
+			Restic: &config.ResticDefaults{
+				Global: &config.ResticGlobal{Verbose: pointTo(2), Compression: pointTo("off")},
+				Backup: &config.ResticBackup{Tag: pointToStrings("manual"), Exclude: pointToStrings()},
+			},
+			Process: &config.ProcessConfig{Env: &map[string]string{"A": "top", "B": "store"}},
+		})
+		testStringPointer(t, "ResticBin", merged.ResticBin, pointTo("/usr/bin/restic"))
+	})
+
+	t.Run("without profile", func(t *testing.T) {
+		actual, err := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, "alfa").Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var verbose config.Explanation
+		for _, explanation := range actual {
+			if explanation.Origin == config.OverridesOrigin || strings.HasPrefix(explanation.Origin, "profiles.") {
+				t.Errorf("unexpected origin %q for %s", explanation.Origin, explanation.Key)
+			}
+			if explanation.Key == "restic.global.verbose" {
+				verbose = explanation
+			}
+		}
+		if verbose.Value != 2 || verbose.Origin != "datastores.foo.defaults" {
+			t.Errorf("wrong verbose; got %v from %q", verbose.Value, verbose.Origin)
+		}
+	})
+
+	t.Run("layers and hosts", func(t *testing.T) {
+		system, err := config.LoadReader(strings.NewReader(`
+[defaults.restic.global]
+verbose = 1
+compression = "max"
+
+[defaults.process.env]
+A = "system"
+`), "/etc/wrestic/wrestic.toml", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := config.LoadReader(strings.NewReader(`
+[defaults.restic.global]
+verbose = 2
+
+[datastores.foo.destinations.alfa]
+path = "/repos/alfa"
+
+[hosts."web-*".defaults.restic.global]
+compression = "off"
+
+[hosts.web-1.datastores.bar.defaults.restic.backup]
+tag = ["web"]
+
+[hosts.web-1.datastores.bar.destinations.bravo]
+path = "/repos/bravo"
+`), "wrestic.toml", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers := []config.Params{system, user}
+		opts := config.ResolveOptions{Hostname: "web-1"}
+
+		// The system and user defaults are told apart by their File, and each
+		// section of hosts is its own Origin.
+		actual, err := resolveDestination(t, layers, opts, "alfa").Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []config.Explanation{
+			{
+				Key:     "process.env.A",
+				Sourced: config.Sourced{Value: "system", Origin: "defaults", File: "/etc/wrestic/wrestic.toml"},
+			},
+			{
+				Key:      "restic.global.compression",
+				Sourced:  config.Sourced{Value: "off", Origin: `hosts."web-*".defaults`, File: "wrestic.toml"},
+				Shadowed: []config.Sourced{{Value: "max", Origin: "defaults", File: "/etc/wrestic/wrestic.toml"}},
+			},
+			{
+				Key:      "restic.global.verbose",
+				Sourced:  config.Sourced{Value: 2, Origin: "defaults", File: "wrestic.toml"},
+				Shadowed: []config.Sourced{{Value: 1, Origin: "defaults", File: "/etc/wrestic/wrestic.toml"}},
+			},
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("wrong output (-expected +actual):\n%s", diff)
+		}
+
+		actual, err = resolveDestination(t, layers, opts, "bravo").Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag := config.Explanation{
+			Key:     "restic.backup.tag",
+			Sourced: config.Sourced{Value: []string{"web"}, Origin: "hosts.web-1.datastores.bar.defaults", File: "wrestic.toml"},
+		}
+		if len(actual) != 4 {
+			t.Fatalf("wrong number of values; got %d, expected %d", len(actual), 4)
+		}
+		if diff := cmp.Diff(tag, actual[1]); diff != "" {
+			t.Errorf("wrong tag (-expected +actual):\n%s", diff)
+		}
+	})
+
+	t.Run("merge strategies", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(`
+[defaults.restic.backup]
+exclude = ["top"]
+tag = ["top"]
+
+[datastores.foo.defaults]
+merge = { "restic.backup.exclude" = "append", "restic.backup.tag" = "unset" }
+
+[datastores.foo.defaults.restic.backup]
+exclude = ["store"]
+
+[datastores.foo.destinations.alfa.defaults]
+merge = { "restic.backup.exclude" = "append" }
+
+[datastores.foo.destinations.alfa.defaults.restic.backup]
+exclude = ["dest"]
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, "alfa")
+		actual, err := dest.Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []config.Explanation{
+			{
+				Key: "restic.backup.exclude",
+				Sourced: config.Sourced{
+					Value:  []string{"top", "store", "dest"},
+					Origin: "datastores.foo.destinations.alfa.defaults",
+					Merge:  config.MergeAppend,
+				},
+				Shadowed: []config.Sourced{
+					{Value: []string{"store"}, Origin: "datastores.foo.defaults", Merge: config.MergeAppend},
+					{Value: []string{"top"}, Origin: "defaults"},
+				},
+			},
+			{
+				Key:      "restic.backup.tag",
+				Sourced:  config.Sourced{Value: nil, Origin: "datastores.foo.defaults", Merge: config.MergeUnset},
+				Shadowed: []config.Sourced{{Value: []string{"top"}, Origin: "defaults"}},
+			},
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("wrong output (-expected +actual):\n%s", diff)
+		}
+
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDefaults(t, "merged", merged, config.Defaults{
+			PasswordConfig: &config.PasswordConfig{},
+			Restic: &config.ResticDefaults{
+				Backup: &config.ResticBackup{Exclude: pointToStrings("top", "store", "dest")},
+			},
+		})
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := config.Resolve([]config.Params{params}, config.ResolveOptions{Profile: "nope"}); err == nil || !strings.Contains(err.Error(), `unknown profile "nope"`) {
+			t.Errorf("expected an unknown profile error; got %v", err)
+		}
+
+		invalid, err := config.Parse(strings.NewReader(`
+[datastores.foo.defaults]
+merge = { "restic.backup.tags" = "append" }
+
+[datastores.foo.destinations.alfa]
+path = "/repos/alfa"
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = resolveDestination(t, []config.Params{invalid}, config.ResolveOptions{}, "alfa").Explain()
+		if !errors.Is(err, config.ErrMergeStrategy) {
+			t.Errorf("expected error %v to wrap %v", err, config.ErrMergeStrategy)
+		} else if expected := "in datastores.foo.defaults.merge"; !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %q to contain %q", err, expected)
+		}
+	})
+}
+
+// resolveDestination outputs the ResolvedDestination named destName.
+func resolveDestination(t *testing.T, layers []config.Params, opts config.ResolveOptions, destName string) config.ResolvedDestination {
+	t.Helper()
+
+	resolved, err := config.Resolve(layers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := resolved.Select(nil, []string{destName})
+	if len(stores) != 1 {
+		t.Fatalf("wrong number of datastores with destination %q; got %d, expected %d", destName, len(stores), 1)
+	}
+	return stores[0].Destinations()[0]
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// Host is config that only applies upon matching hosts. See Params.ForHost.
+type Host struct {
+	// Defaults override the top-level Defaults. Unspecified fields are merged
+	// in from the top-level Defaults.
+	Defaults Defaults `toml:"defaults"`
+	// Datastores are added to the top-level Datastores. One with the same name
+	// as a top-level Datastore must have override = true to replace it.
+	Datastores map[string]Datastore `toml:"datastores"`
+	// RemoveDatastores are names of Datastores to leave out.
+	RemoveDatastores []string `toml:"remove-datastores"`
+	// DisableDestinations are names of Destinations to leave out.
+	DisableDestinations []string `toml:"disable-destinations"`
+	// File is the config file where the Host is defined. It's only set by
+	// Load.
+	File string `toml:"-"`
+}
+
+// ForHost applies each of the Hosts that match hostname. A key of Hosts is
+// either a hostname, or a glob pattern, such as "web-*", per path.Match. The
+// patterns are applied first, in lexical order, and then an exact match, so
+// that later ones take precedence. The Defaults and Datastores of each are
+// combined like with MergeLayers. Then the named datastores and destinations
+// are left out; it's an error if there isn't one by that name. The output has
+// no Hosts. The input is not modified.
+func (p Params) ForHost(hostname string) (out Params, err error) {
+	patterns := p.matchHosts(hostname)
+
+	out = p
+	out.Hosts = nil
+	if len(patterns) < 1 {
+		return
+	}
+
+	for _, key := range patterns {
+		host := p.Hosts[key]
+		if out, err = MergeLayers(out, Params{Defaults: host.Defaults, Datastores: host.Datastores}); err != nil {
+			err = fmt.Errorf("%w: hosts.%s", err, key)
+			return
+		}
+		if err = out.removeDatastores(host.RemoveDatastores); err != nil {
+			err = fmt.Errorf("%w: hosts.%s", err, key)
+			return
+		}
+		if err = out.disableDestinations(host.DisableDestinations); err != nil {
+			err = fmt.Errorf("%w: hosts.%s", err, key)
+			return
+		}
+	}
+
+	return
+}
+
+// matchHosts outputs the keys of the Hosts that match hostname, in the order
+// that ForHost applies them.
+func (p Params) matchHosts(hostname string) (out []string) {
+	var exact bool
+	for key := range p.Hosts {
+		if key == hostname {
+			exact = true
+		} else if ok, _ := path.Match(key, hostname); ok {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	if exact {
+		out = append(out, hostname)
+	}
+	return
+}
+
+func (p *Params) removeDatastores(names []string) error {
+	for _, name := range names {
+		if _, ok := p.Datastores[name]; !ok {
+			return fmt.Errorf("no datastore %q to remove", name)
+		}
+		delete(p.Datastores, name)
+	}
+	return nil
+}
+
+func (p *Params) disableDestinations(names []string) error {
+	for _, name := range names {
+		var found bool
+		for storeName, store := range p.Datastores {
+			if _, ok := store.Destinations[name]; !ok {
+				continue
+			}
+
+			// Copy the destinations, which may be shared with the input.
+			store, _ = makeDatastore(store)
+			delete(store.Destinations, name)
+			p.Datastores[storeName] = store
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("no destination %q to disable", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestParamsForHost(t *testing.T) {
+	const data = `
+[defaults.restic.global]
+cache-dir = "/var/cache/restic"
+verbose = 1
+
+[datastores.photos]
+sources = [{ path = "/home/me/photos" }]
+
+[datastores.photos.destinations.usb]
+path = "/mnt/usb/photos"
+
+[datastores.photos.destinations.offsite]
+path = "sftp:backup:/photos"
+
+[hosts."laptop-*"]
+disable-destinations = ["usb"]
+
+[hosts."laptop-*".defaults.restic.global]
+cache-dir = "/home/me/.cache/restic"
+verbose = 2
+
+[hosts.laptop-work.defaults.restic.global]
+verbose = 3
+
+[hosts.server]
+remove-datastores = ["photos"]
+
+[hosts.server.datastores.web.destinations.nas]
+path = "/mnt/nas/web"
+
+[hosts.nas.datastores.photos]
+override = true
+sources = [{ path = "/srv/photos" }]
+
+[hosts.nas.datastores.photos.destinations.offsite]
+path = "sftp:backup:/photos"
+`
+	params, err := config.LoadReader(strings.NewReader(data), "wrestic.toml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hostname     string
+		expectedDest []string // store.destination
+		expectedSrc  string   // first source path of photos
+		cacheDir     string
+		verbose      int
+	}{
+		{
+			hostname:     "desktop",
+			expectedDest: []string{"photos.offsite", "photos.usb"},
+			expectedSrc:  "/home/me/photos",
+			cacheDir:     "/var/cache/restic",
+			verbose:      1,
+		},
+		{
+			hostname:     "laptop-home",
+			expectedDest: []string{"photos.offsite"},
+			expectedSrc:  "/home/me/photos",
+			cacheDir:     "/home/me/.cache/restic",
+			verbose:      2,
+		},
+		{
+			// An exact match takes precedence over a pattern.
+			hostname:     "laptop-work",
+			expectedDest: []string{"photos.offsite"},
+			expectedSrc:  "/home/me/photos",
+			cacheDir:     "/home/me/.cache/restic",
+			verbose:      3,
+		},
+		{
+			hostname:     "server",
+			expectedDest: []string{"web.nas"},
+			cacheDir:     "/var/cache/restic",
+			verbose:      1,
+		},
+		{
+			hostname:     "nas",
+			expectedDest: []string{"photos.offsite"},
+			expectedSrc:  "/srv/photos",
+			cacheDir:     "/var/cache/restic",
+			verbose:      1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.hostname, func(t *testing.T) {
+			actual, err := params.ForHost(test.hostname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual.Hosts != nil {
+				t.Errorf("expected Hosts to be nil, got %v", actual.Hosts)
+			}
+
+			resolved, err := config.Resolve([]config.Params{actual}, config.ResolveOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotDest []string
+			for _, store := range resolved.Datastores() {
+				if store.Name() == "photos" && store.Sources()[0].Path != test.expectedSrc {
+					t.Errorf("wrong source; got %q, expected %q", store.Sources()[0].Path, test.expectedSrc)
+				}
+
+				for _, dest := range store.Destinations() {
+					destName := dest.Name()
+					gotDest = append(gotDest, store.Name()+"."+destName)
+
+					merged, err := dest.Merge()
+					if err != nil {
+						t.Fatal(err)
+					}
+					testStringPointer(t, destName+".cache-dir", merged.Restic.Global.CacheDir, pointTo(test.cacheDir))
+					if got := merged.Restic.Global.Verbose; got == nil || *got != test.verbose {
+						t.Errorf("wrong verbose for %s; got %v, expected %d", destName, got, test.verbose)
+					}
+				}
+			}
+			testStrings(t, "destinations", gotDest, test.expectedDest)
+		})
+	}
+
+	t.Run("input is not modified", func(t *testing.T) {
+		if _, err := params.ForHost("laptop-home"); err != nil {
+			t.Fatal(err)
+		}
+		if len(params.Datastores["photos"].Destinations) != 2 {
+			t.Errorf("destinations of input were modified")
+		}
+		if len(params.Hosts) != 4 {
+			t.Errorf("hosts of input were modified")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			data     string
+			expected []string
+		}{
+			{
+				name:     "unknown datastore",
+				data:     "[hosts.x]\nremove-datastores = [\"nope\"]",
+				expected: []string{`no datastore "nope"`, "hosts.x"},
+			},
+			{
+				name:     "unknown destination",
+				data:     "[hosts.x]\ndisable-destinations = [\"nope\"]",
+				expected: []string{`no destination "nope"`, "hosts.x"},
+			},
+			{
+				name:     "datastore without override",
+				data:     "[datastores.a.destinations.b]\n[hosts.x.datastores.a.destinations.c]",
+				expected: []string{`datastore "a"`, "override", "hosts.x"},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				params, err := config.LoadReader(strings.NewReader(test.data), "wrestic.toml", t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = params.ForHost("x")
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, substr := range test.expected {
+					if !strings.Contains(err.Error(), substr) {
+						t.Errorf("expected error %q to contain %q", err, substr)
+					}
+				}
+			})
+		}
+	})
+}
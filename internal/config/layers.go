@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SystemConfigFile is where an administrator may put config shared by all
+// users of a host. See MergeLayers.
+const SystemConfigFile = "/etc/wrestic/wrestic.toml"
+
+// MergeLayers combines config, such as from SystemConfigFile and then from the
+// config file of a user, into one. Each layer is the output of Load or
+// LoadReader. They're ordered by precedence, from lowest to highest.
+//
+// Defaults are merged like the Defaults of a Datastore and its Destination: a
+// value specified in a later layer is kept, otherwise it's merged in from an
+// earlier layer. A datastore may only be defined in one layer, unless the
+// later definition has override = true; then it replaces the earlier one
+// entirely. Hosts and Profiles of the same key in a later layer replace those of an
+// earlier layer. The File of the output is that of the last layer with one,
+// and its Files and Dirs are those of every layer.
+func MergeLayers(layers ...Params) (out Params, err error) {
+	if len(layers) == 1 {
+		out = layers[0]
+		return
+	}
+
+	out.Datastores = make(map[string]Datastore)
+
+	for _, layer := range layers {
+		out.Defaults = overlayDefaults(layer.Defaults, out.Defaults)
+		out.Include = append(out.Include, layer.Include...)
+		out.Files = append(out.Files, layer.Files...)
+		out.Dirs = append(out.Dirs, layer.Dirs...)
+		if layer.File != "" {
+			out.File = layer.File
+		}
+
+		for key, host := range layer.Hosts {
+			if out.Hosts == nil {
+				out.Hosts = make(map[string]Host)
+			}
+			out.Hosts[key] = host
+		}
+		for key, profile := range layer.Profiles {
+			if out.Profiles == nil {
+				out.Profiles = make(map[string]Profile)
+			}
+			out.Profiles[key] = profile
+		}
+
+		storeNames := make([]string, 0, len(layer.Datastores))
+		for name := range layer.Datastores {
+			storeNames = append(storeNames, name)
+		}
+		sort.Strings(storeNames)
+
+		for _, name := range storeNames {
+			store := layer.Datastores[name]
+			if prev, ok := out.Datastores[name]; ok && !store.Override {
+				err = fmt.Errorf("datastore %q is in both %s and %s; set override = true in the latter to replace it", name, prev.File, store.File)
+				return
+			}
+			// Copy it, since naming it within out modifies it.
+			out.Datastores[name], _ = makeDatastore(store)
+		}
+	}
+
+	out.setNames()
+	return
+}
+
+// overlayDefaults outputs a copy of upper, with unspecified values merged in
+// from a copy of lower. The merge strategies of upper apply to lower, and the
+// output has the strategies for merging the result into the level beneath.
+func overlayDefaults(upper, lower Defaults) (out Defaults) {
+	out = duplicateDefaults(upper)
+	lowerCopy := duplicateDefaults(lower)
+	mergeDefaults(&out, &lowerCopy)
+	out.Merge = overlayMergeStrategies(upper, lower)
+	return
+}
@@ -0,0 +1,140 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestMergeLayers(t *testing.T) {
+	load := func(t *testing.T, name, data string) config.Params {
+		t.Helper()
+		params, err := config.LoadReader(strings.NewReader(data), name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return params
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		system := load(t, "system.toml", `
+[defaults]
+restic-bin = "/usr/bin/restic"
+
+[defaults.restic.global]
+verbose = 1
+compression = "max"
+
+[datastores.shared.destinations.alfa]
+path = "/repos/alfa"
+
+[datastores.replaced.destinations.bravo]
+path = "/repos/bravo"
+`)
+		user := load(t, "user.toml", `
+[defaults.restic.global]
+compression = "auto"
+
+[datastores.mine.destinations.charlie]
+path = "/repos/charlie"
+
+[datastores.replaced]
+override = true
+
+[datastores.replaced.destinations.delta]
+path = "/repos/delta"
+`)
+
+		params, err := config.MergeLayers(system, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testDefaults(t, "merged", params.Defaults, config.Defaults{
+			PasswordConfig: &config.PasswordConfig{},
+			Restic: &config.ResticDefaults{
+				Global: &config.ResticGlobal{
+					Compression: pointTo("auto"),
+					Verbose:     pointTo(1),
+				},
+			},
+		})
+
+		testStringPointer(t, "merged.ResticBin", params.Defaults.ResticBin, pointTo("/usr/bin/restic"))
+
+		expectedFiles := map[string]string{"shared": "system.toml", "mine": "user.toml", "replaced": "user.toml"}
+		if len(params.Datastores) != len(expectedFiles) {
+			t.Fatalf("wrong number of datastores; got %d, expected %d", len(params.Datastores), len(expectedFiles))
+		}
+		for name, expected := range expectedFiles {
+			if got := params.Datastores[name].File; got != expected {
+				t.Errorf("wrong File for %q; got %q, expected %q", name, got, expected)
+			}
+		}
+		if _, ok := params.Datastores["replaced"].Destinations["bravo"]; ok {
+			t.Error("overridden datastore should not keep its destinations")
+		}
+
+		// The merged defaults should be the parent of each datastore.
+		dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, "alfa")
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := merged.Restic.Global.Compression; got == nil || *got != "auto" {
+			t.Errorf("wrong compression; got %v, expected %q", got, "auto")
+		}
+
+		// The layers should not be modified.
+		if got := system.Defaults.Restic.Global.Compression; *got != "max" {
+			t.Errorf("system layer was modified; got %q", *got)
+		}
+	})
+
+	t.Run("destination name in several datastores", func(t *testing.T) {
+		system := load(t, "system.toml", "[datastores.shared.destinations.alfa]\npath = '/shared/alfa'")
+		user := load(t, "user.toml", "[datastores.mine.destinations.alfa]\npath = '/mine/alfa'")
+
+		params, err := config.MergeLayers(system, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, storeName := range []string{"shared", "mine"} {
+			if _, ok := params.Datastores[storeName].Destinations["alfa"]; !ok {
+				t.Errorf("datastore %q should have destination %q", storeName, "alfa")
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			user     string
+			expected []string
+		}{
+			{
+				name:     "datastore without override",
+				user:     `[datastores.shared.destinations.bravo]`,
+				expected: []string{`datastore "shared"`, "system.toml", "user.toml", "override"},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				system := load(t, "system.toml", `[datastores.shared.destinations.alfa]`)
+				user := load(t, "user.toml", test.user)
+
+				_, err := config.MergeLayers(system, user)
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, substr := range test.expected {
+					if !strings.Contains(err.Error(), substr) {
+						t.Errorf("expected error %q to contain %q", err, substr)
+					}
+				}
+			})
+		}
+	})
+}
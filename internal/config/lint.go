@@ -0,0 +1,460 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Diagnostic is a problem found in a config file by Lint or LintResolved.
+type Diagnostic struct {
+	// File is the config file with the problem. It's only set by
+	// LintResolved, and then only when the problem is in a file.
+	File string `json:"file,omitempty"`
+	// Severity is SeverityError or SeverityWarning.
+	Severity string `json:"severity"`
+	// Line and Column are the position in the file, starting at 1. They're 0
+	// when the position is not known.
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	// Key is the path to the value with the problem, when there is one.
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	if d.Key == "" {
+		return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Column, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s: %s", d.Line, d.Column, d.Severity, d.Key, d.Message)
+}
+
+// Lint reads a config file from r and reports problems with it. That includes
+// TOML syntax, keys that are not part of the configuration, structural
+// mistakes, password templates that fail to render, and anything reported by
+// ValidateResolved. The configDir is where the password templates are
+// rendered. The output is sorted by position; Diagnostics without a position
+// are last.
+func Lint(r io.Reader, configDir string) (out []Diagnostic, err error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	params, pos, out, ok := lintSource(string(raw))
+	if !ok {
+		return
+	}
+	resolved, err := Resolve([]Params{params}, ResolveOptions{ConfigDir: configDir})
+	if err != nil {
+		return
+	}
+	lintResolved(resolved, func(severity, _ string, key []string, msg string) {
+		d := Diagnostic{Severity: severity, Key: joinKey(key), Message: msg}
+		d.Line, d.Column = pos.find(key)
+		out = append(out, d)
+	})
+
+	sortDiagnostics(out, nil)
+	return
+}
+
+// LintResolved is like Lint, but for config that's resolved from several
+// files, as it's used. The files have already been parsed, such as by Load,
+// so it's the datastores that are checked, after the layers, hosts, profile and
+// overrides are applied. The File of a Diagnostic is where the problem is, when
+// it's in one of the Files of the config, and its position is in that file. The
+// func, readFile, outputs the contents of a file, such as os.ReadFile. The
+// output is sorted by the order of the files, and then by position.
+func LintResolved(resolved Resolved, readFile func(name string) ([]byte, error)) (out []Diagnostic, err error) {
+	files := resolved.params.Files
+	filePositions := make(map[string]positions, len(files))
+	for _, file := range files {
+		var raw []byte
+		if raw, err = readFile(file); err != nil {
+			return
+		}
+		filePositions[file] = newPositions(string(raw))
+	}
+
+	lintResolved(resolved, func(severity, file string, key []string, msg string) {
+		d := Diagnostic{Severity: severity, File: file, Key: joinKey(key), Message: msg}
+		if pos, ok := filePositions[file]; ok {
+			d.Line, d.Column = pos.find(key)
+		}
+		out = append(out, d)
+	})
+
+	sortDiagnostics(out, files)
+	return
+}
+
+// lintSource reports problems with the TOML of one config file, and keys that
+// are not part of the configuration. The output is only ok when src could be
+// decoded into Params.
+func lintSource(src string) (params Params, pos positions, out []Diagnostic, ok bool) {
+	params, undecoded, decodeErr := decode(strings.NewReader(src))
+	var parseErr toml.ParseError
+	if errors.As(decodeErr, &parseErr) {
+		out = append(out, Diagnostic{
+			Severity: SeverityError,
+			Line:     parseErr.Position.Line,
+			Column:   column(src, parseErr.Position.Start),
+			Key:      parseErr.LastKey,
+			Message:  parseErrorMessage(parseErr),
+		})
+		return
+	}
+
+	pos = newPositions(src)
+	if decodeErr != nil {
+		// Errors about types are not a toml.ParseError, but they still say
+		// which key it's about.
+		d := Diagnostic{Severity: SeverityError, Message: decodeErr.Error()}
+		if m := decodeErrorPattern.FindStringSubmatch(d.Message); m != nil {
+			d.Key, d.Message = m[1], m[2]
+			d.Line, d.Column = pos.find(splitKey(d.Key))
+		}
+		out = append(out, d)
+		return
+	}
+
+	for _, key := range undecoded {
+		msg := "unexpected key"
+		if suggestion := suggestKey(key); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %q?", suggestion)
+		}
+		d := Diagnostic{Severity: SeverityError, Key: joinKey(key), Message: msg}
+		d.Line, d.Column = pos.find(key)
+		out = append(out, d)
+	}
+
+	ok = true
+	return
+}
+
+// sortDiagnostics sorts in by the order of their File in files, and then by
+// position. Diagnostics without a File, or without a position, are last.
+func sortDiagnostics(in []Diagnostic, files []string) {
+	order := make(map[string]int, len(files))
+	for i, file := range files {
+		if _, ok := order[file]; !ok {
+			order[file] = i
+		}
+	}
+	fileOrder := func(d Diagnostic) int {
+		if i, ok := order[d.File]; ok {
+			return i
+		}
+		return len(files)
+	}
+
+	sort.SliceStable(in, func(i, j int) bool {
+		a, b := in[i], in[j]
+		if fileOrder(a) != fileOrder(b) {
+			return fileOrder(a) < fileOrder(b)
+		}
+		if (a.Line == 0) != (b.Line == 0) {
+			return b.Line == 0
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// parseErrorPrefix is at the start of a toml.ParseError, which Lint reports
+// separately.
+var parseErrorPrefix = regexp.MustCompile(`^toml: line \d+( \(last key ".*?"\))?: `)
+
+// decodeErrorPattern matches an error from decoding a TOML value into Params.
+var decodeErrorPattern = regexp.MustCompile(`^toml: (?:line \d+ )?\(last key "(.*?)"\): (.*)$`)
+
+func parseErrorMessage(pe toml.ParseError) string {
+	if pe.Message != "" {
+		return pe.Message
+	}
+	return parseErrorPrefix.ReplaceAllString(pe.Error(), "")
+}
+
+// lintResolved checks the datastores of resolved for structural mistakes and
+// password templates that fail to render, and then with ValidateResolved. The
+// func, add, reports a problem with the value at key, in file.
+func lintResolved(resolved Resolved, add func(severity, file string, key []string, msg string)) {
+	repos := make(map[string][]string) // repo path => key of first destination
+	for _, store := range resolved.datastores {
+		storeKey := []string(store.key)
+
+		if len(store.destinations) < 1 {
+			add(SeverityWarning, store.File(), storeKey, "datastore has no destinations")
+		}
+
+		for i, src := range store.store.Sources {
+			if src.Path == "" {
+				add(SeverityError, store.File(), append(storeKey, "sources"), fmt.Sprintf("source %d has no path", i+1))
+			} else if !filepath.IsAbs(src.Path) {
+				add(SeverityWarning, store.File(), append(storeKey, "sources"), fmt.Sprintf("source path %q is not absolute", src.Path))
+			}
+		}
+
+		for _, dest := range store.destinations {
+			destKey := append(storeKey[:len(storeKey):len(storeKey)], "destinations", dest.Name())
+
+			if strings.TrimSpace(dest.Path()) == "" {
+				add(SeverityError, store.File(), destKey, "destination has no path")
+			} else {
+				repo := strings.TrimSuffix(strings.TrimSpace(dest.Path()), "/")
+				if first, ok := repos[repo]; ok {
+					add(SeverityWarning, store.File(), append(destKey, "path"), fmt.Sprintf("same path as %s", joinKey(first)))
+				} else {
+					repos[repo] = destKey
+				}
+			}
+
+			merged, err := dest.Merge()
+			if err != nil {
+				add(SeverityError, store.File(), destKey, err.Error())
+				continue
+			}
+			if _, err = parsePasswordCommand(dest.r.configDir, merged.PasswordConfig); err != nil {
+				add(SeverityError, store.File(), destKey, err.Error())
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, problem := range ValidateResolved(resolved.datastores) {
+		key := append(append([]string{}, problem.Level...), splitKey(problem.Key)...)
+		msg := fmt.Sprintf("%s %s", formatValue(problem.Value), problem.Message)
+
+		// Values from a parent level would be reported once per destination.
+		if id := problem.File + joinKey(key) + msg; !seen[id] {
+			seen[id] = true
+			add(problem.Severity, problem.File, key, msg)
+		}
+	}
+}
+
+func formatValue(val any) string {
+	if s, ok := val.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+func joinKey(key []string) string { return toml.Key(key).String() }
+
+// column outputs the column, starting at 1, of the byte offset in src.
+func column(src string, offset int) int {
+	if offset > len(src) {
+		offset = len(src)
+	}
+	return offset - strings.LastIndex(src[:offset], "\n")
+}
+
+// positions finds keys in a TOML document. It's a best effort, since the toml
+// package doesn't say where undecoded keys are. It understands table headers,
+// and dotted keys. A key inside of an inline table is found by its name on
+// the line of the nearest parent key.
+type positions struct {
+	lines []positionedLine
+}
+
+type positionedLine struct {
+	key    []string // key is the full key defined on the line.
+	text   string
+	number int
+}
+
+var (
+	tableHeaderPattern = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?`)
+	keyValuePattern    = regexp.MustCompile(`^\s*([A-Za-z0-9_\-."' ]+?)\s*=`)
+)
+
+func newPositions(src string) (out positions) {
+	var table []string
+	for i, text := range strings.Split(src, "\n") {
+		line := positionedLine{text: text, number: i + 1}
+
+		if m := tableHeaderPattern.FindStringSubmatch(text); m != nil {
+			table = splitKey(m[1])
+			line.key = table
+		} else if m := keyValuePattern.FindStringSubmatch(text); m != nil {
+			line.key = append(append([]string{}, table...), splitKey(m[1])...)
+		}
+
+		out.lines = append(out.lines, line)
+	}
+	return
+}
+
+// find outputs the line and column, both starting at 1, of key. Both are 0 if
+// the key could not be found.
+func (p positions) find(key []string) (line, col int) {
+	var best positionedLine
+	for _, candidate := range p.lines {
+		if len(candidate.key) > len(best.key) && hasKeyPrefix(key, candidate.key) {
+			best = candidate
+		}
+		if len(best.key) == len(key) {
+			break
+		}
+	}
+	if best.number == 0 {
+		return
+	}
+
+	line, col = best.number, 1+len(best.text)-len(strings.TrimLeft(best.text, " \t"))
+	if len(best.key) < len(key) {
+		// Look for the rest of the key in an inline table.
+		name := key[len(key)-1]
+		pattern := regexp.MustCompile(`[{,\s]` + regexp.QuoteMeta(name) + `\s*=`)
+		if loc := pattern.FindStringIndex(best.text); loc != nil {
+			col = loc[0] + 2
+		}
+	}
+	return
+}
+
+func hasKeyPrefix(key, prefix []string) bool {
+	if len(prefix) > len(key) {
+		return false
+	}
+	for i := range prefix {
+		if key[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitKey splits a dotted TOML key. Quoted parts may contain dots.
+func splitKey(in string) (out []string) {
+	var (
+		bld   strings.Builder
+		quote rune
+	)
+	for _, r := range in {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			bld.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			out = append(out, strings.TrimSpace(bld.String()))
+			bld.Reset()
+		case r != ' ' && r != '\t':
+			bld.WriteRune(r)
+		}
+	}
+	return append(out, strings.TrimSpace(bld.String()))
+}
+
+// suggestKey outputs the known key that's most similar to the last part of an
+// unexpected key. It's empty if nothing is similar enough.
+func suggestKey(key toml.Key) string {
+	if len(key) < 1 {
+		return ""
+	}
+
+	name := key[len(key)-1]
+	var (
+		best     string
+		bestDist = len(name)/3 + 2
+	)
+	for _, candidate := range knownKeys(reflect.TypeOf(Params{}), key[:len(key)-1]) {
+		dist := levenshtein(name, candidate)
+		if len(name) > 2 && strings.HasPrefix(candidate, name) {
+			dist = 1 // It's probably cut short.
+		}
+		if dist < bestDist {
+			best, bestDist = candidate, dist
+		}
+	}
+	return best
+}
+
+// knownKeys outputs the keys of the table at path, starting from the type t.
+// The names of datastores and destinations may be anything.
+func knownKeys(t reflect.Type, path []string) (out []string) {
+	for {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice:
+			t = t.Elem()
+			continue
+		case reflect.Map:
+			if len(path) < 1 {
+				return
+			}
+			t, path = t.Elem(), path[1:]
+			continue
+		case reflect.Struct:
+		default:
+			return
+		}
+
+		if len(path) < 1 {
+			break
+		}
+
+		var found bool
+		for i := 0; i < t.NumField(); i++ {
+			if tomlKey(t.Field(i)) == path[0] {
+				t, path, found = t.Field(i).Type, path[1:], true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		if key := tomlKey(t.Field(i)); key != "" && key != "-" && t.Field(i).IsExported() {
+			out = append(out, key)
+		}
+	}
+	return
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	out := first
+	for _, n := range rest {
+		if n < out {
+			out = n
+		}
+	}
+	return out
+}
@@ -0,0 +1,188 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []config.Diagnostic
+	}{
+		{
+			name: "ok",
+			input: `
+[defaults.password-config]
+template = 'cat {{ index . 0 }}'
+args = ['secret']
+
+[datastores.stuff]
+sources = [{ path = '/home' }]
+
+[datastores.stuff.destinations.foo]
+path = '/mnt/foo'
+`,
+		},
+		{
+			name: "syntax",
+			input: `
+[defaults]
+restic-bin = '/usr/bin/restic
+`,
+			expected: []config.Diagnostic{
+				{Severity: config.SeverityError, Line: 3, Column: 30, Key: "defaults.restic-bin", Message: "strings cannot contain newlines"},
+			},
+		},
+		{
+			name: "wrong type",
+			input: `
+[datastores.stuff.destinations.foo]
+path = 1
+`,
+			expected: []config.Diagnostic{
+				{Severity: config.SeverityError, Line: 3, Column: 1, Key: "datastores.stuff.destinations.foo.path", Message: "incompatible types: TOML value has type int64; destination has type string"},
+			},
+		},
+		{
+			name: "unexpected keys",
+			input: `
+[defaults.restic]
+global = { pack-sise = 16 }
+
+[datastores.stuff.destinations.foo]
+pth = '/mnt/foo'
+
+[datastores.stuff.destinations.foo.defaults.restic.backup]
+exclude-larger = '1G'
+nonsense = true
+`,
+			expected: []config.Diagnostic{
+				{Severity: config.SeverityError, Line: 3, Column: 12, Key: "defaults.restic.global.pack-sise", Message: `unexpected key, did you mean "pack-size"?`},
+				{Severity: config.SeverityError, Line: 5, Column: 1, Key: "datastores.stuff.destinations.foo", Message: "destination has no path"},
+				{Severity: config.SeverityError, Line: 6, Column: 1, Key: "datastores.stuff.destinations.foo.pth", Message: `unexpected key, did you mean "path"?`},
+				{Severity: config.SeverityError, Line: 9, Column: 1, Key: "datastores.stuff.destinations.foo.defaults.restic.backup.exclude-larger", Message: `unexpected key, did you mean "exclude-larger-than"?`},
+				{Severity: config.SeverityError, Line: 10, Column: 1, Key: "datastores.stuff.destinations.foo.defaults.restic.backup.nonsense", Message: "unexpected key"},
+			},
+		},
+		{
+			name: "structure",
+			input: `
+[defaults.password-config]
+template = 'cat {{ nope }}'
+
+[datastores.empty]
+
+[datastores.stuff]
+sources = [{ path = 'relative/path' }]
+
+[datastores.stuff.destinations.foo]
+path = '/mnt/repo'
+
+[datastores.stuff.destinations.bar]
+path = '/mnt/repo/'
+
+[datastores.stuff.destinations.bar.defaults.restic]
+stats = { mode = 'rawdata' }
+`,
+			expected: []config.Diagnostic{
+				{Severity: config.SeverityWarning, Line: 5, Column: 1, Key: "datastores.empty", Message: "datastore has no destinations"},
+				{Severity: config.SeverityWarning, Line: 8, Column: 1, Key: "datastores.stuff.sources", Message: `source path "relative/path" is not absolute`},
+				{Severity: config.SeverityError, Line: 10, Column: 1, Key: "datastores.stuff.destinations.foo", Message: `template: password-config:1: function "nope" not defined: password-config.template is invalid`},
+				{Severity: config.SeverityWarning, Line: 11, Column: 1, Key: "datastores.stuff.destinations.foo.path", Message: "same path as datastores.stuff.destinations.bar"},
+				{Severity: config.SeverityError, Line: 13, Column: 1, Key: "datastores.stuff.destinations.bar", Message: `template: password-config:1: function "nope" not defined: password-config.template is invalid`},
+				{Severity: config.SeverityError, Line: 17, Column: 11, Key: "datastores.stuff.destinations.bar.defaults.restic.stats.mode", Message: `"rawdata" should be one of ["restore-size" "files-by-contents" "blobs-per-file" "raw-data"]`},
+			},
+		},
+		{
+			name: "dotted names",
+			input: `
+[datastores."photos.old".destinations."nas.local"]
+path = '/mnt/repo'
+
+[datastores."photos.old".defaults.timeout]
+"back.up" = 'never'
+`,
+			expected: []config.Diagnostic{
+				{Severity: config.SeverityError, Line: 6, Column: 1, Key: `datastores."photos.old".defaults.timeout."back.up"`, Message: `"never" should be a non-negative duration, such as "30m" or "4h"`},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := config.Lint(strings.NewReader(test.input), t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, test.expected); diff != "" {
+				t.Errorf("wrong Diagnostics (- means something in actual) (+ means something in expected)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLintResolved(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"wrestic.toml": `
+[defaults.restic.global]
+compression = 'most'
+
+[datastores.stuff.destinations.foo]
+path = '/mnt/foo'
+
+[hosts.web.datastores.web.destinations.bar]
+path = '/mnt/foo'
+`,
+		"wrestic.d/other.toml": `
+[datastores.things]
+sources = [{ path = 'relative/path' }]
+
+[datastores.things.destinations.qux]
+path = '/mnt/qux'
+
+[datastores.things.destinations.qux.defaults.restic.stats]
+mode = 'rawdata'
+`,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mainFile, otherFile := filepath.Join(dir, "wrestic.toml"), filepath.Join(dir, "wrestic.d", "other.toml")
+
+	params, err := config.Load(mainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{ConfigDir: dir, Hostname: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := config.LintResolved(resolved, os.ReadFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []config.Diagnostic{
+		{File: mainFile, Severity: config.SeverityError, Line: 3, Column: 1, Key: "defaults.restic.global.compression", Message: `"most" should be one of ["auto" "off" "max" "fastest" "better"]`},
+		{File: mainFile, Severity: config.SeverityWarning, Line: 9, Column: 1, Key: "hosts.web.datastores.web.destinations.bar.path", Message: "same path as datastores.stuff.destinations.foo"},
+		{File: otherFile, Severity: config.SeverityWarning, Line: 3, Column: 1, Key: "datastores.things.sources", Message: `source path "relative/path" is not absolute`},
+		{File: otherFile, Severity: config.SeverityError, Line: 9, Column: 1, Key: "datastores.things.destinations.qux.defaults.restic.stats.mode", Message: `"rawdata" should be one of ["restore-size" "files-by-contents" "blobs-per-file" "raw-data"]`},
+	}
+	if diff := cmp.Diff(got, expected); diff != "" {
+		t.Errorf("wrong Diagnostics (- means something in actual) (+ means something in expected)\n%s", diff)
+	}
+}
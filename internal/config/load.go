@@ -0,0 +1,236 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// ConfDir is the name of a directory, beside the main config file, where any
+// *.toml files are read for more datastores.
+const ConfDir = "wrestic.d"
+
+// Load reads the config file at filename. Datastores are also read from the
+// files named by the include key, and from any *.toml files in the ConfDir
+// directory beside filename. An include is relative to the directory of the
+// file with the include key, and may be a glob pattern.
+//
+// Only the main config file may have defaults, hosts and profiles. Included
+// files may have datastores and more includes. A datastore name must be unique
+// among the files. The File of each Datastore, Host and Profile is where it's
+// defined, the File of the output is filename, and its Files are every file
+// that's read, starting with filename. Its Dirs are where more files would be
+// read from, if they were added: ConfDir, and the directory of each include
+// that's a glob pattern.
+func Load(filename string) (out Params, err error) {
+	main, err := parseFile(filename)
+	if err != nil {
+		return
+	}
+
+	return load(filename, filepath.Dir(filename), main)
+}
+
+// StdinName is the name of a config file that's read from standard input.
+const StdinName = "-"
+
+// LoadReader is like Load, but the main config file is read from r. Since r
+// has no directory, includes in it are relative to dir, and so is ConfDir. The
+// name identifies r in errors, and it's the File of the output, its datastores,
+// hosts and profiles.
+func LoadReader(r io.Reader, name, dir string) (out Params, err error) {
+	main, err := Parse(r)
+	if err != nil {
+		err = &FileError{File: name, Err: err}
+		return
+	}
+
+	return load(name, dir, main)
+}
+
+func load(name, dir string, main Params) (out Params, err error) {
+	files, dirs, err := readConfigFiles(name, dir, main)
+	if err != nil {
+		return
+	}
+	out.Dirs = dirs
+
+	storeFiles := make(map[string]string)
+	out.Datastores = make(map[string]Datastore)
+
+	for i, cf := range files {
+		file, params := cf.name, cf.params
+		out.Files = append(out.Files, file)
+
+		if i == 0 {
+			out.Include, out.Defaults, out.Hosts, out.Profiles = params.Include, params.Defaults, params.Hosts, params.Profiles
+			out.File = file
+			for key, host := range out.Hosts {
+				host.File = file
+				for storeName, store := range host.Datastores {
+					store.File = file
+					host.Datastores[storeName] = store
+				}
+				out.Hosts[key] = host
+			}
+			for key, profile := range out.Profiles {
+				profile.File = file
+				out.Profiles[key] = profile
+			}
+		} else if !reflect.DeepEqual(params.Defaults, Defaults{}) {
+			err = fmt.Errorf("%s: defaults may only be in %s", file, name)
+			return
+		} else if len(params.Hosts) > 0 {
+			err = fmt.Errorf("%s: hosts may only be in %s", file, name)
+			return
+		} else if len(params.Profiles) > 0 {
+			err = fmt.Errorf("%s: profiles may only be in %s", file, name)
+			return
+		}
+
+		storeNames := make([]string, 0, len(params.Datastores))
+		for name := range params.Datastores {
+			storeNames = append(storeNames, name)
+		}
+		sort.Strings(storeNames)
+
+		for _, name := range storeNames {
+			if prev, ok := storeFiles[name]; ok {
+				err = fmt.Errorf("datastore %q is in both %s and %s", name, prev, file)
+				return
+			}
+			storeFiles[name] = file
+
+			store := params.Datastores[name]
+			store.File = file
+			out.Datastores[name] = store
+		}
+	}
+
+	return
+}
+
+func parseFile(filename string) (out Params, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	if out, err = Parse(file); err != nil {
+		err = &FileError{File: filename, Err: err}
+	}
+	return
+}
+
+// FileError is a config file that could not be parsed.
+type FileError struct {
+	File string
+	Err  error
+}
+
+func (e *FileError) Error() string { return fmt.Sprintf("%v: %s", e.Err, e.File) }
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+type configFile struct {
+	name   string
+	params Params
+}
+
+// readConfigFiles outputs the main config file, then the files it includes,
+// recursively, and then the files in ConfDir of dir. Each file is only read
+// once, so an include cycle is not a problem. The dirs are the directories
+// that are searched for files: that of each glob pattern, and then ConfDir.
+func readConfigFiles(name, dir string, main Params) (out []configFile, dirs []string, err error) {
+	seen := make(map[string]bool)
+
+	var (
+		visit    func(file, dir string, params Params) error
+		readFile func(file string) error
+	)
+
+	visit = func(file, dir string, params Params) error {
+		out = append(out, configFile{name: file, params: params})
+
+		for _, include := range params.Include {
+			pattern := include
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(dir, pattern)
+			}
+
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("%w: include %q in %s", err, include, file)
+			}
+			if hasGlobMeta(include) {
+				dirs = append(dirs, filepath.Dir(pattern))
+			} else if len(matches) < 1 {
+				return fmt.Errorf("%w: include %q in %s", os.ErrNotExist, include, file)
+			}
+
+			for _, match := range matches {
+				if err = readFile(match); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	readFile = func(file string) error {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			return nil
+		}
+		seen[abs] = true
+
+		params, err := parseFile(file)
+		if err != nil {
+			return err
+		}
+		return visit(file, filepath.Dir(file), params)
+	}
+
+	if name != StdinName {
+		var abs string
+		if abs, err = filepath.Abs(name); err != nil {
+			return
+		}
+		seen[abs] = true
+	}
+	if err = visit(name, dir, main); err != nil {
+		return
+	}
+
+	confDir := filepath.Join(dir, ConfDir)
+	dirs = append(dirs, confDir)
+	matches, err := filepath.Glob(filepath.Join(confDir, "*.toml"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		if err = readFile(match); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func hasGlobMeta(pattern string) bool {
+	for _, r := range pattern {
+		switch r {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
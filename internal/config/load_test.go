@@ -0,0 +1,238 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestLoad(t *testing.T) {
+	writeFiles := func(t *testing.T, files map[string]string) (dir string) {
+		t.Helper()
+		dir = t.TempDir()
+		for name, content := range files {
+			filename := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	t.Run("includes and conf dir", func(t *testing.T) {
+		dir := writeFiles(t, map[string]string{
+			"wrestic.toml": `
+include = ["stores/*.toml", "extra.toml"]
+
+[defaults.restic.global]
+verbose = 1
+
+[datastores.main.destinations.alfa]
+path = "/repos/alfa"
+`,
+			"stores/photos.toml": `
+include = ["../extra.toml"] # already included, should only be read once.
+
+[datastores.photos.defaults.restic.global]
+verbose = 2
+
+[datastores.photos.destinations.bravo]
+path = "/repos/bravo"
+`,
+			"extra.toml": `
+[datastores.extra.destinations.charlie]
+path = "/repos/charlie"
+`,
+			"wrestic.d/music.toml": `
+[datastores.music.destinations.delta]
+path = "/repos/delta"
+`,
+			"wrestic.d/ignored.txt": `not = "toml"`,
+		})
+
+		params, err := config.Load(filepath.Join(dir, "wrestic.toml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedFiles := map[string]string{
+			"main":   filepath.Join(dir, "wrestic.toml"),
+			"photos": filepath.Join(dir, "stores", "photos.toml"),
+			"extra":  filepath.Join(dir, "extra.toml"),
+			"music":  filepath.Join(dir, "wrestic.d", "music.toml"),
+		}
+		if len(params.Datastores) != len(expectedFiles) {
+			t.Fatalf("wrong number of datastores; got %d, expected %d", len(params.Datastores), len(expectedFiles))
+		}
+		for name, expected := range expectedFiles {
+			store, ok := params.Datastores[name]
+			if !ok {
+				t.Errorf("missing datastore %q", name)
+				continue
+			}
+			if store.Name != name {
+				t.Errorf("wrong Name; got %q, expected %q", store.Name, name)
+			}
+			if filepath.Clean(store.File) != expected {
+				t.Errorf("wrong File for %q; got %q, expected %q", name, store.File, expected)
+			}
+		}
+
+		expectedDirs := []string{filepath.Join(dir, "stores"), filepath.Join(dir, "wrestic.d")}
+		var dirs []string
+		for _, d := range params.Dirs {
+			dirs = append(dirs, filepath.Clean(d))
+		}
+		testStrings(t, "Dirs", dirs, expectedDirs)
+
+		// Defaults of the main file should be merged into included datastores.
+		tests := []struct {
+			store, dest string
+			expected    int
+		}{
+			{store: "music", dest: "delta", expected: 1},
+			{store: "photos", dest: "bravo", expected: 2},
+		}
+		for _, test := range tests {
+			dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, test.dest)
+			merged, err := dest.Merge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := merged.Restic.Global.Verbose; got == nil || *got != test.expected {
+				t.Errorf("wrong verbose for %s; got %v, expected %d", test.dest, got, test.expected)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			files    map[string]string
+			expected []string
+		}{
+			{
+				name: "duplicate datastore",
+				files: map[string]string{
+					"wrestic.toml":         `[datastores.foo.destinations.alfa]`,
+					"wrestic.d/other.toml": `[datastores.foo.destinations.bravo]`,
+				},
+				expected: []string{`datastore "foo"`, "wrestic.toml", "other.toml"},
+			},
+			{
+				name: "defaults in included file",
+				files: map[string]string{
+					"wrestic.toml": `include = ["other.toml"]`,
+					"other.toml":   "[defaults.restic.global]\nverbose = 1",
+				},
+				expected: []string{"other.toml", "defaults may only be in"},
+			},
+			{
+				name: "hosts in included file",
+				files: map[string]string{
+					"wrestic.toml": `include = ["other.toml"]`,
+					"other.toml":   "[hosts.x]\nremove-datastores = [\"y\"]",
+				},
+				expected: []string{"other.toml", "hosts may only be in"},
+			},
+			{
+				name: "missing include",
+				files: map[string]string{
+					"wrestic.toml": `include = ["nope.toml"]`,
+				},
+				expected: []string{`include "nope.toml"`},
+			},
+			{
+				name: "invalid included file",
+				files: map[string]string{
+					"wrestic.toml": `include = ["other.toml"]`,
+					"other.toml":   `[datastores.foo] nope`,
+				},
+				expected: []string{"other.toml"},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				dir := writeFiles(t, test.files)
+
+				_, err := config.Load(filepath.Join(dir, "wrestic.toml"))
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, substr := range test.expected {
+					if !strings.Contains(err.Error(), substr) {
+						t.Errorf("expected error %q to contain %q", err, substr)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("destination name in several datastores", func(t *testing.T) {
+		// Selecting the destination by name selects it in each datastore.
+		dir := writeFiles(t, map[string]string{
+			"wrestic.toml":         "[datastores.foo.destinations.alfa]\npath = '/foo/alfa'\n[datastores.bar.destinations.alfa]\npath = '/bar/alfa'",
+			"wrestic.d/other.toml": "[datastores.qux.destinations.alfa]\npath = '/qux/alfa'",
+		})
+
+		params, err := config.Load(filepath.Join(dir, "wrestic.toml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		selected := config.SelectDatastores(params.Datastores, nil, []string{"alfa"})
+		var got []string
+		for _, store := range selected {
+			got = append(got, store.Destinations["alfa"].Path)
+		}
+		testStrings(t, "paths", got, []string{"/bar/alfa", "/foo/alfa", "/qux/alfa"})
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		dir := writeFiles(t, map[string]string{
+			"other.toml":           `[datastores.other.destinations.bravo]`,
+			"wrestic.d/music.toml": `[datastores.music.destinations.charlie]`,
+		})
+		r := strings.NewReader(`
+include = ["other.toml"]
+
+[datastores.main.destinations.alfa]
+`)
+
+		params, err := config.LoadReader(r, config.StdinName, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedFiles := map[string]string{
+			"main":  config.StdinName,
+			"other": filepath.Join(dir, "other.toml"),
+			"music": filepath.Join(dir, "wrestic.d", "music.toml"),
+		}
+		if len(params.Datastores) != len(expectedFiles) {
+			t.Fatalf("wrong number of datastores; got %d, expected %d", len(params.Datastores), len(expectedFiles))
+		}
+		for name, expected := range expectedFiles {
+			if got := params.Datastores[name].File; got != expected {
+				t.Errorf("wrong File for %q; got %q, expected %q", name, got, expected)
+			}
+		}
+	})
+
+	t.Run("missing glob include is ok", func(t *testing.T) {
+		dir := writeFiles(t, map[string]string{
+			"wrestic.toml": `include = ["nope/*.toml"]`,
+		})
+
+		if _, err := config.Load(filepath.Join(dir, "wrestic.toml")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// These are the merge strategies of Defaults.Merge. They say how a value at
+// one level is combined with the value it would otherwise inherit from the
+// level beneath it.
+const (
+	// MergeReplace replaces the inherited value. It's the default.
+	MergeReplace = "replace"
+	// MergeAppend appends to the inherited list, rather than replacing it.
+	MergeAppend = "append"
+	// MergeUnset discards the inherited value, as if it was never specified.
+	// The value may still be specified at a level of higher precedence.
+	MergeUnset = "unset"
+)
+
+var mergeStrategies = []string{MergeReplace, MergeAppend, MergeUnset}
+
+// ErrMergeStrategy is the error for an entry of Defaults.Merge that cannot be
+// applied.
+var ErrMergeStrategy = errors.New("invalid merge strategy")
+
+// checkMergeStrategies outputs an error for the first entry of d.Merge, by key,
+// that's not a known key and strategy, or that does not apply to the type of
+// the value. A list may be replaced, appended to or unset, and any other value
+// that's not a table may be unset.
+func checkMergeStrategies(d Defaults) error {
+	keys := make([]string, 0, len(d.Merge))
+	for key := range d.Merge {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		strategy := d.Merge[key]
+		typ, ok := mergeFieldType(key)
+		if !ok {
+			msg := fmt.Sprintf("unknown key %q", key)
+			if suggestion := suggestKey(append(toml.Key{"defaults"}, splitKey(key)...)); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			return fmt.Errorf("%w: %s", ErrMergeStrategy, msg)
+		}
+
+		var strategyOK bool
+		for _, known := range mergeStrategies {
+			strategyOK = strategyOK || strategy == known
+		}
+		switch {
+		case !strategyOK:
+			return fmt.Errorf("%w: %q for %q should be one of %q", ErrMergeStrategy, strategy, key, mergeStrategies)
+		case strategy == MergeUnset && !isMergeList(typ) && !isMergeScalar(typ):
+			return fmt.Errorf("%w: %q is a table, so it cannot be unset", ErrMergeStrategy, key)
+		case strategy != MergeUnset && !isMergeList(typ):
+			return fmt.Errorf("%w: %q is not a list, so it can only be unset", ErrMergeStrategy, key)
+		case strategy == MergeUnset && isMergeSet(lookupMergeField(&d, key, false)):
+			return fmt.Errorf("%w: %q is both specified and unset", ErrMergeStrategy, key)
+		}
+	}
+
+	return nil
+}
+
+// mergeFieldType outputs the type of the field of Defaults at key, a dotted
+// key such as "restic.backup.tag".
+func mergeFieldType(key string) (out reflect.Type, ok bool) {
+	out = reflect.TypeOf(Defaults{})
+	for _, part := range splitKey(key) {
+		for out.Kind() == reflect.Pointer {
+			out = out.Elem()
+		}
+		if out.Kind() != reflect.Struct {
+			return
+		}
+
+		var field reflect.StructField
+		for i := 0; i < out.NumField(); i++ {
+			if name := tomlKey(out.Field(i)); name == part && name != "-" && out.Field(i).IsExported() {
+				field, ok = out.Field(i), true
+				break
+			}
+		}
+		if !ok {
+			return
+		}
+		out, ok = field.Type, false
+	}
+
+	ok = true
+	return
+}
+
+func isMergeList(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Slice
+}
+
+func isMergeScalar(t reflect.Type) bool {
+	if t.Kind() != reflect.Pointer {
+		return false
+	}
+	kind := t.Elem().Kind()
+	return kind != reflect.Struct && kind != reflect.Map && kind != reflect.Slice
+}
+
+// lookupMergeField outputs the field of d at key. It's the zero Value if a
+// table along the way is not specified. When forWrite is true, then such tables
+// are allocated instead, and the others are copied, so that the field may be
+// set without modifying a table that's shared with another Defaults. Merging
+// may share them, see mergeConfig.
+func lookupMergeField(d *Defaults, key string, forWrite bool) (out reflect.Value) {
+	out = reflect.ValueOf(d).Elem()
+	for _, part := range splitKey(key) {
+		if out.Kind() == reflect.Pointer {
+			if out.IsNil() && !forWrite {
+				return reflect.Value{}
+			}
+			if forWrite {
+				table := reflect.New(out.Type().Elem())
+				if !out.IsNil() {
+					table.Elem().Set(out.Elem())
+				}
+				out.Set(table)
+			}
+			out = out.Elem()
+		}
+		if out.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+
+		var found bool
+		for i := 0; i < out.NumField(); i++ {
+			if tomlKey(out.Type().Field(i)) == part {
+				out, found = out.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}
+		}
+	}
+	return
+}
+
+// isMergeSet says whether a field of Defaults is specified, in the same way as
+// mergeConfig: it's a non-nil pointer, or a non-empty slice.
+func isMergeSet(v reflect.Value) bool {
+	switch {
+	case !v.IsValid():
+		return false
+	case v.Kind() == reflect.Pointer:
+		return !v.IsNil()
+	case v.Kind() == reflect.Slice:
+		return v.Len() > 0
+	default:
+		return true
+	}
+}
+
+// appendMergeValues outputs a new list of lower followed by upper. Both are
+// fields of the same type, either a slice or a pointer to one.
+func appendMergeValues(lower, upper reflect.Value) reflect.Value {
+	if !isMergeSet(lower) {
+		return upper
+	}
+
+	if upper.Kind() == reflect.Pointer {
+		elems := appendMergeValues(lower.Elem(), upper.Elem())
+		out := reflect.New(elems.Type())
+		out.Elem().Set(elems)
+		return out
+	}
+
+	out := reflect.MakeSlice(upper.Type(), 0, lower.Len()+upper.Len())
+	return reflect.AppendSlice(reflect.AppendSlice(out, lower), upper)
+}
+
+// applyMergeStrategies finishes merging src into dst, per dst.Merge, where
+// before are the values of dst from before the rest of the values were merged.
+// A key with an invalid strategy is left alone; see checkMergeStrategies.
+func applyMergeStrategies(dst, src *Defaults, before map[string]reflect.Value) {
+	for key, strategy := range dst.Merge {
+		val, ok := before[key]
+		if !ok {
+			continue
+		}
+
+		switch strategy {
+		case MergeAppend:
+			if isMergeSet(val) {
+				field := lookupMergeField(dst, key, true)
+				field.Set(appendMergeValues(lookupMergeField(src, key, false), val))
+			}
+		case MergeUnset:
+			if isMergeSet(lookupMergeField(dst, key, false)) {
+				field := lookupMergeField(dst, key, true)
+				field.Set(reflect.Zero(field.Type()))
+			}
+		}
+	}
+}
+
+// mergeStrategyValues outputs the current values of d with a merge strategy,
+// for applyMergeStrategies.
+func mergeStrategyValues(d *Defaults) (out map[string]reflect.Value) {
+	for key := range d.Merge {
+		typ, ok := mergeFieldType(key)
+		if !ok || (!isMergeList(typ) && !isMergeScalar(typ)) {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]reflect.Value, len(d.Merge))
+		}
+		out[key] = reflect.Value{}
+		if field := lookupMergeField(d, key, false); field.IsValid() {
+			out[key] = reflect.ValueOf(field.Interface())
+		}
+	}
+	return
+}
+
+// overlayMergeStrategies outputs the merge strategies of the output of
+// overlayDefaults. Its values are like those of merging upper into lower, and
+// then lower into the level beneath it, so the strategies say how to do the
+// latter step.
+func overlayMergeStrategies(upper, lower Defaults) (out map[string]string) {
+	keys := make(map[string]bool, len(upper.Merge)+len(lower.Merge))
+	for key := range upper.Merge {
+		keys[key] = true
+	}
+	for key := range lower.Merge {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		u, l := upper.Merge[key], lower.Merge[key]
+		uSet := isMergeSet(lookupMergeField(&upper, key, false))
+		lSet := isMergeSet(lookupMergeField(&lower, key, false))
+
+		var strategy string
+		switch {
+		case u == MergeUnset:
+			strategy = MergeUnset
+		case uSet && u == MergeAppend && l == MergeUnset:
+			// The upper value is appended to nothing, so it replaces.
+		case uSet && u == MergeAppend && lSet:
+			// The upper value is appended to the lower one, which is then
+			// merged like the lower one.
+			if l == MergeAppend {
+				strategy = MergeAppend
+			}
+		case uSet:
+			strategy = u
+		default:
+			strategy = l
+		}
+
+		if strategy == "" {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string)
+		}
+		out[key] = strategy
+	}
+	return
+}
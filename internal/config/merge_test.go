@@ -0,0 +1,266 @@
+package config_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestMergeStrategies(t *testing.T) {
+	const topLevel = `
+[defaults.password-config]
+args = ["secrets/top"]
+
+[defaults.restic.global]
+verbose = 1
+
+[defaults.restic.backup]
+exclude = ["top"]
+tag = ["top"]
+`
+
+	tests := []struct {
+		name     string
+		config   string
+		profile  string
+		expected config.Defaults
+	}{
+		{
+			name: "replace by default",
+			config: topLevel + `
+[datastores.stuff.defaults.restic.backup]
+exclude = ["store"]
+
+[datastores.stuff.destinations.foo.defaults.restic.backup]
+exclude = ["dest"]
+`,
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("dest"), Tag: pointToStrings("top")},
+				},
+			},
+		},
+		{
+			name: "append at each level",
+			config: topLevel + `
+[datastores.stuff.defaults]
+merge = { "restic.backup.exclude" = "append", "password-config.args" = "append" }
+
+[datastores.stuff.defaults.password-config]
+args = ["secrets/store"]
+
+[datastores.stuff.defaults.restic.backup]
+exclude = ["store"]
+
+[datastores.stuff.destinations.foo.defaults]
+merge = { "restic.backup.exclude" = "append" }
+
+[datastores.stuff.destinations.foo.defaults.restic.backup]
+exclude = ["dest"]
+`,
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top", "secrets/store"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("top", "store", "dest"), Tag: pointToStrings("top")},
+				},
+			},
+		},
+		{
+			name: "append to a replaced list",
+			config: topLevel + `
+[datastores.stuff.defaults.restic.backup]
+exclude = ["store"]
+
+[datastores.stuff.destinations.foo.defaults]
+merge = { "restic.backup.exclude" = "append" }
+
+[datastores.stuff.destinations.foo.defaults.restic.backup]
+exclude = ["dest"]
+`,
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("store", "dest"), Tag: pointToStrings("top")},
+				},
+			},
+		},
+		{
+			name: "append without a value inherits",
+			config: topLevel + `
+[datastores.stuff.destinations.foo.defaults]
+merge = { "restic.backup.exclude" = "append" }
+`,
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("top"), Tag: pointToStrings("top")},
+				},
+			},
+		},
+		{
+			name: "unset",
+			config: topLevel + `
+[datastores.stuff.defaults]
+merge = { "restic.backup.tag" = "unset", "restic.global.verbose" = "unset", "password-config.args" = "unset" }
+
+[datastores.stuff.destinations.foo]
+`,
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("top")},
+				},
+			},
+		},
+		{
+			name: "specify after unset",
+			config: topLevel + `
+[datastores.stuff.defaults]
+merge = { "restic.backup.tag" = "unset" }
+
+[datastores.stuff.destinations.foo.defaults]
+merge = { "restic.backup.tag" = "append" }
+
+[datastores.stuff.destinations.foo.defaults.restic.backup]
+tag = ["dest"]
+`,
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("top"), Tag: pointToStrings("dest")},
+				},
+			},
+		},
+		{
+			name: "profile appends",
+			config: topLevel + `
+[datastores.stuff.defaults.restic.backup]
+exclude = ["store"]
+
+[datastores.stuff.destinations.foo]
+
+[profiles.extra.datastores.stuff.defaults]
+merge = { "restic.backup.exclude" = "append", "restic.backup.tag" = "append" }
+
+[profiles.extra.datastores.stuff.defaults.restic.backup]
+exclude = ["profile"]
+tag = ["profile"]
+`,
+			profile: "extra",
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("store", "profile"), Tag: pointToStrings("top", "profile")},
+				},
+			},
+		},
+		{
+			name: "profile unsets",
+			config: topLevel + `
+[datastores.stuff.destinations.foo.defaults.restic.backup]
+tag = ["dest"]
+
+[profiles.untagged.datastores.stuff.destinations.foo.defaults]
+merge = { "restic.backup.tag" = "unset" }
+`,
+			profile: "untagged",
+			expected: config.Defaults{
+				PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/top"}},
+				Restic: &config.ResticDefaults{
+					Global: &config.ResticGlobal{Verbose: pointTo(1)},
+					Backup: &config.ResticBackup{Exclude: pointToStrings("top")},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := config.Parse(strings.NewReader(test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.profile != "" {
+				if params, err = params.WithProfile(test.profile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, "foo")
+
+			// Merge twice, to check that the input is not modified.
+			for i := 0; i < 2; i++ {
+				merged, err := dest.Merge()
+				if err != nil {
+					t.Fatal(err)
+				}
+				testDefaults(t, "", merged, test.expected)
+			}
+			testStrings(t, "top-level tag", *params.Defaults.Restic.Backup.Tag, []string{"top"})
+			testStrings(t, "top-level args", params.Defaults.PasswordConfig.Args, []string{"secrets/top"})
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			config   string
+			expected []string
+		}{
+			{
+				name:     "unknown key",
+				config:   `merge = { "restic.backup.tags" = "append" }`,
+				expected: []string{`unknown key "restic.backup.tags"`, `did you mean "tag"?`},
+			},
+			{
+				name:     "unknown strategy",
+				config:   `merge = { "restic.backup.tag" = "prepend" }`,
+				expected: []string{`"prepend"`, `"restic.backup.tag"`},
+			},
+			{
+				name:     "append to a value",
+				config:   `merge = { "restic.global.verbose" = "append" }`,
+				expected: []string{`"restic.global.verbose" is not a list`},
+			},
+			{
+				name:     "unset a table",
+				config:   `merge = { "restic.backup" = "unset" }`,
+				expected: []string{`"restic.backup" is a table`},
+			},
+			{
+				name:     "specified and unset",
+				config:   "merge = { \"restic.backup.tag\" = \"unset\" }\n[datastores.stuff.defaults.restic.backup]\ntag = [\"x\"]",
+				expected: []string{`"restic.backup.tag" is both specified and unset`},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				params, err := config.Parse(strings.NewReader("[datastores.stuff.defaults]\n" + test.config + "\n[datastores.stuff.destinations.foo]"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				dest := resolveDestination(t, []config.Params{params}, config.ResolveOptions{}, "foo")
+
+				_, err = dest.Merge()
+				if !errors.Is(err, config.ErrMergeStrategy) {
+					t.Fatalf("expected error %v to wrap %v", err, config.ErrMergeStrategy)
+				}
+				for _, substr := range append(test.expected, "datastores.stuff.defaults.merge") {
+					if !strings.Contains(err.Error(), substr) {
+						t.Errorf("expected error %q to contain %q", err, substr)
+					}
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package config
+
+import "reflect"
+
+// NotifyConfig describes how outcomes of running restic subcommands are
+// reported. Like other Defaults, it may be specified at any level and is
+// merged from the top down.
+type NotifyConfig struct {
+	// On decides which outcomes are sent. It's one of:
+	//	- "failure": only send failures. This is the default.
+	//	- "always": send every outcome.
+	//	- "recovery": send failures, and the first success after a failure.
+	On *string `toml:"on"`
+	// Scope is either "destination" or "batch". With "destination", each
+	// destination is reported separately. With "batch", one report summarizes
+	// every destination operated upon by one invocation. Only the top-level
+	// Defaults are consulted for batch-scoped notifications.
+	Scope        *string             `toml:"scope"`
+	Webhook      *NotifyWebhook      `toml:"webhook"`
+	Healthchecks *NotifyHealthchecks `toml:"healthchecks"`
+	SMTP         *NotifySMTP         `toml:"smtp"`
+}
+
+// These are the known values of NotifyConfig.On.
+const (
+	NotifyOnFailure  = "failure"
+	NotifyOnAlways   = "always"
+	NotifyOnRecovery = "recovery"
+)
+
+// These are the known values of NotifyConfig.Scope.
+const (
+	NotifyScopeDestination = "destination"
+	NotifyScopeBatch       = "batch"
+)
+
+func duplicateNotifyConfig(in *NotifyConfig) (out *NotifyConfig) {
+	out = &NotifyConfig{}
+	if in == nil {
+		return
+	}
+
+	*out = deepCopy(reflect.ValueOf(*in)).Interface().(NotifyConfig)
+	return
+}
+
+// NotifyWebhook sends an HTTP POST request to a URL.
+type NotifyWebhook struct {
+	URL *string `toml:"url"`
+	// Template is the request body. It's parsed by package text/template from
+	// the golang standard library. When empty, the body is the outcome encoded
+	// as JSON. The template function, json, encodes a value as JSON.
+	Template *string            `toml:"template"`
+	Headers  *map[string]string `toml:"headers"`
+}
+
+// NotifyHealthchecks pings a URL in the style of https://healthchecks.io.
+// A start signal goes to URL + "/start", a failure goes to URL + "/fail" and
+// a success goes to URL. Since the receiving end decides when to alert, every
+// outcome is sent regardless of NotifyConfig.On.
+type NotifyHealthchecks struct {
+	URL *string `toml:"url"`
+}
+
+// NotifySMTP sends mail through an SMTP server.
+type NotifySMTP struct {
+	// Addr is the host and port of the SMTP server, ie: "localhost:25".
+	Addr *string   `toml:"addr"`
+	From *string   `toml:"from"`
+	To   *[]string `toml:"to"`
+	// Username, when specified, enables PLAIN authentication.
+	Username *string `toml:"username"`
+	// PasswordEnv is the name of an environment variable holding the password
+	// to authenticate with. It's read when sending, not when parsing.
+	PasswordEnv *string `toml:"password-env"`
+}
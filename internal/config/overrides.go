@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// overrideKeyPattern is the syntax of the key of an override, a dotted key of
+// Defaults, such as "restic.backup.tag".
+var overrideKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// ParseOverrides parses settings of Defaults, each in the form key=value, such
+// as `restic.backup.tag=manual` or `password-config.args=["secrets/x"]`. The
+// key is a dotted path within Defaults, and the value is TOML. A value that's
+// not valid TOML is a string, and a string is a list of one string where a
+// list is expected. Each value is checked against the type of its field. When
+// a key is set more than once, the last one wins.
+func ParseOverrides(settings ...string) (out Defaults, err error) {
+	for _, setting := range settings {
+		var override Defaults
+		if override, err = parseOverride(setting); err != nil {
+			err = fmt.Errorf("%w: %q", err, setting)
+			return
+		}
+		out = overlayDefaults(override, out)
+	}
+	return
+}
+
+// ErrOverride is the error for a setting that cannot be parsed by
+// ParseOverrides.
+var ErrOverride = errors.New("invalid override")
+
+func parseOverride(setting string) (out Defaults, err error) {
+	key, val, ok := strings.Cut(setting, "=")
+	key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+	if !ok || !overrideKeyPattern.MatchString(key) {
+		err = fmt.Errorf("%w: should be key=value, where key is like restic.backup.tag", ErrOverride)
+		return
+	}
+
+	// Try the value as TOML, then as a string, then as a list of a string.
+	attempts := []string{val, strconv.Quote(val), "[" + strconv.Quote(val) + "]"}
+	errs := make([]error, len(attempts))
+	for i, attempt := range attempts {
+		var meta toml.MetaData
+		if meta, errs[i] = toml.Decode(key+" = "+attempt, &out); errs[i] != nil {
+			out = Defaults{}
+			continue
+		}
+
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			msg := fmt.Sprintf("unknown key %q", key)
+			if suggestion := suggestKey(append(toml.Key{"defaults"}, undecoded[0]...)); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			err = fmt.Errorf("%w: %s", ErrOverride, msg)
+		}
+		return
+	}
+
+	// When the value is not valid TOML, then it's probably meant to be a
+	// string, so the error about that is more useful.
+	reported := errs[0]
+	var parseErr toml.ParseError
+	if errors.As(reported, &parseErr) {
+		reported = errs[1]
+	}
+	msg := reported.Error()
+	if m := decodeErrorPattern.FindStringSubmatch(msg); m != nil {
+		msg = m[1] + ": " + m[2]
+	}
+	err = fmt.Errorf("%w: %s", ErrOverride, msg)
+	return
+}
+
+// WithOverrides overlays overrides upon the Defaults at each level: the top,
+// each Datastore and each Destination. So, the overrides take precedence over
+// any value in the config. The input is not modified.
+func (p Params) WithOverrides(overrides Defaults) (out Params) {
+	out = p
+	out.Defaults = overlayDefaults(overrides, p.Defaults)
+	out.Datastores = make(map[string]Datastore, len(p.Datastores))
+
+	for storeName, store := range p.Datastores {
+		store, _ = makeDatastore(store)
+		store.Defaults = overlayDefaults(overrides, store.Defaults)
+		for destName, dest := range store.Destinations {
+			dest.Defaults = overlayDefaults(overrides, dest.Defaults)
+			store.Destinations[destName] = dest
+		}
+		out.Datastores[storeName] = store
+	}
+
+	return
+}
@@ -0,0 +1,103 @@
+package config_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestParseOverrides(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		actual, err := config.ParseOverrides(
+			`restic.backup.tag=manual`,
+			`password-config.args=["secrets/x", "secrets/y"]`,
+			`restic.global.verbose = 2`,
+			`restic.global.verbose=1`,
+			`restic.check.read-data=true`,
+			`restic.backup.host=123`,
+			`restic-bin=/opt/restic`,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testDefaults(t, "", actual, config.Defaults{
+			PasswordConfig: &config.PasswordConfig{Args: []string{"secrets/x", "secrets/y"}},
+			Restic: &config.ResticDefaults{
+				Global: &config.ResticGlobal{Verbose: pointTo(1)},
+				Backup: &config.ResticBackup{Tag: pointToStrings("manual"), Host: pointTo("123")},
+				Check:  &config.ResticCheck{ReadData: pointTo(true)},
+			},
+		})
+		testStringPointer(t, "ResticBin", actual.ResticBin, pointTo("/opt/restic"))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			setting  string
+			expected []string
+		}{
+			{name: "no value", setting: "restic.backup.tag", expected: []string{"key=value"}},
+			{name: "bad key", setting: "restic backup=x", expected: []string{"key=value"}},
+			{name: "unknown key", setting: "restic.backup.tags=x", expected: []string{`unknown key "restic.backup.tags"`, `did you mean "tag"?`}},
+			{name: "wrong type", setting: "restic.global.verbose=loud", expected: []string{"restic.global.verbose", "string"}},
+			{name: "table", setting: "restic.backup=1", expected: []string{"restic.backup"}},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				_, err := config.ParseOverrides(test.setting)
+				if !errors.Is(err, config.ErrOverride) {
+					t.Fatalf("expected error %v to wrap %v", err, config.ErrOverride)
+				}
+				for _, substr := range append(test.expected, test.setting) {
+					if !strings.Contains(err.Error(), substr) {
+						t.Errorf("expected error %q to contain %q", err, substr)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestParamsWithOverrides(t *testing.T) {
+	const data = `
+[defaults.restic.backup]
+tag = ["top"]
+
+[datastores.photos.defaults.restic.backup]
+tag = ["store"]
+
+[datastores.photos.destinations.usb]
+path = "/mnt/usb/photos"
+
+[datastores.photos.destinations.usb.defaults.restic.backup]
+tag = ["dest"]
+exclude = ["*.tmp"]
+`
+	params, err := config.LoadReader(strings.NewReader(data), "wrestic.toml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := config.ParseOverrides("restic.backup.tag=manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := params.WithOverrides(overrides)
+
+	dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, "usb")
+	merged, err := dest.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStrings(t, "tag", *merged.Restic.Backup.Tag, []string{"manual"})
+	testStrings(t, "exclude", *merged.Restic.Backup.Exclude, []string{"*.tmp"})
+	testStrings(t, "top-level tag", *actual.Defaults.Restic.Backup.Tag, []string{"manual"})
+
+	// The input should not be modified.
+	testStrings(t, "input tag", *params.Datastores["photos"].Destinations["usb"].Defaults.Restic.Backup.Tag, []string{"dest"})
+}
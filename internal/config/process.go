@@ -0,0 +1,93 @@
+package config
+
+// ProcessConfig describes how the restic process is run. Like other Defaults,
+// it may be specified at any level and is merged from the top down. So a
+// datastore of archived photos may run at a low priority while another
+// datastore does not.
+type ProcessConfig struct {
+	// Nice is the scheduling priority, from -20 (most favorable) to 19 (least
+	// favorable). Lowering the value below the current one usually requires
+	// elevated privileges.
+	Nice *int `toml:"nice"`
+	// IONice is the I/O scheduling class and priority.
+	IONice *IONiceConfig `toml:"ionice"`
+	// GOMAXPROCS limits how many CPUs restic may use simultaneously. It's set
+	// as an environment variable for restic.
+	GOMAXPROCS *int `toml:"gomaxprocs"`
+	// Env are additional environment variables for restic, such as
+	// RESTIC_READ_CONCURRENCY. The keys from each level are merged together.
+	Env *map[string]string `toml:"env"`
+}
+
+// IONiceConfig is like the options of the ionice program.
+type IONiceConfig struct {
+	// Class is one of "realtime", "best-effort" or "idle".
+	Class *string `toml:"class"`
+	// Level is the priority within the class, from 0 (highest) to 7 (lowest).
+	// It's not applicable to the idle class.
+	Level *int `toml:"level"`
+}
+
+// These are the known values of IONiceConfig.Class.
+const (
+	IONiceClassRealtime   = "realtime"
+	IONiceClassBestEffort = "best-effort"
+	IONiceClassIdle       = "idle"
+)
+
+func duplicateProcessConfig(in *ProcessConfig) (out *ProcessConfig) {
+	out = &ProcessConfig{}
+	if in == nil {
+		return
+	}
+
+	mergeProcessConfig(out, in)
+	return
+}
+
+// mergeProcessConfig merges src into dst, like mergeConfig. Unlike the int
+// fields of other configs, a zero nice or ionice level is meaningful, so any
+// field that's specified in dst is kept. Nothing of src is shared with dst.
+func mergeProcessConfig(dst, src *ProcessConfig) {
+	if dst == nil || src == nil {
+		return
+	}
+
+	if dst.Nice == nil {
+		dst.Nice = duplicateInt(src.Nice)
+	}
+	if dst.GOMAXPROCS == nil {
+		dst.GOMAXPROCS = duplicateInt(src.GOMAXPROCS)
+	}
+	if src.IONice != nil {
+		if dst.IONice == nil {
+			dst.IONice = &IONiceConfig{}
+		}
+		if dst.IONice.Class == nil {
+			dst.IONice.Class = duplicateString(src.IONice.Class)
+		}
+		if dst.IONice.Level == nil {
+			dst.IONice.Level = duplicateInt(src.IONice.Level)
+		}
+	}
+	if src.Env != nil {
+		env := make(map[string]string, len(*src.Env))
+		for key, val := range *src.Env {
+			env[key] = val
+		}
+		if dst.Env != nil {
+			for key, val := range *dst.Env {
+				env[key] = val
+			}
+		}
+		dst.Env = &env
+	}
+}
+
+func duplicateInt(in *int) *int {
+	if in == nil {
+		return nil
+	}
+	out := *in
+	return &out
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Profile is an overlay of config, which applies when it's selected at
+// runtime. See Params.WithProfile.
+type Profile struct {
+	// Defaults overlay the top-level Defaults.
+	Defaults Defaults `toml:"defaults"`
+	// Datastores overlay the Defaults of the Datastores, and of their
+	// Destinations, by name.
+	Datastores map[string]ProfileDatastore `toml:"datastores"`
+	// Storenames, when non-empty, are the only Datastores that are active.
+	Storenames []string `toml:"storenames"`
+	// Destnames, when non-empty, are the only Destinations that are active.
+	Destnames []string `toml:"destnames"`
+	// DisableDestinations are names of Destinations to leave out.
+	DisableDestinations []string `toml:"disable-destinations"`
+	// File is the config file where the Profile is defined. It's only set by
+	// Load.
+	File string `toml:"-"`
+}
+
+// ProfileDatastore overlays the Defaults of a Datastore, and its Destinations.
+type ProfileDatastore struct {
+	// Defaults overlay the Defaults of the Datastore.
+	Defaults Defaults `toml:"defaults"`
+	// Destinations overlay the Defaults of the Destinations, by name.
+	Destinations map[string]ProfileDestination `toml:"destinations"`
+}
+
+// ProfileDestination overlays the Defaults of a Destination.
+type ProfileDestination struct {
+	// Defaults overlay the Defaults of the Destination.
+	Defaults Defaults `toml:"defaults"`
+}
+
+// WithProfile applies the Profile of the given name. At each level, a value
+// specified by the Profile takes precedence over one from the config, and
+// unspecified values are kept. Merging still happens from one level to the
+// next, so a value at the top level of the Profile does not replace one that's
+// specified by a Datastore or a Destination; overlay that level instead. Then
+// the Datastores and Destinations are restricted, like with SelectDatastores,
+// and any DisableDestinations are left out; a Datastore without any
+// Destinations left is dropped. It's an error if the
+// Profile refers to a Datastore or Destination that does not exist. The output
+// has no Profiles. The input is not modified.
+func (p Params) WithProfile(name string) (out Params, err error) {
+	profile, err := p.lookupProfile(name)
+	if err != nil {
+		return
+	}
+
+	out = p
+	out.Profiles = nil
+	out.Defaults = overlayDefaults(profile.Defaults, p.Defaults)
+	out.Datastores = make(map[string]Datastore, len(p.Datastores))
+	for storeName, store := range p.Datastores {
+		out.Datastores[storeName], _ = makeDatastore(store)
+	}
+
+	for storeName, profileStore := range profile.Datastores {
+		store, ok := out.Datastores[storeName]
+		if !ok {
+			err = fmt.Errorf("no datastore %q to overlay: profiles.%s", storeName, name)
+			return
+		}
+		store.Defaults = overlayDefaults(profileStore.Defaults, store.Defaults)
+
+		for destName, profileDest := range profileStore.Destinations {
+			dest, ok := store.Destinations[destName]
+			if !ok {
+				err = fmt.Errorf("no destination %q in datastore %q to overlay: profiles.%s", destName, storeName, name)
+				return
+			}
+			dest.Defaults = overlayDefaults(profileDest.Defaults, dest.Defaults)
+			store.Destinations[destName] = dest
+		}
+
+		out.Datastores[storeName] = store
+	}
+
+	if err = out.restrict(profile.Storenames, profile.Destnames); err != nil {
+		err = fmt.Errorf("%w: profiles.%s", err, name)
+		return
+	}
+	if err = out.disableDestinations(profile.DisableDestinations); err != nil {
+		err = fmt.Errorf("%w: profiles.%s", err, name)
+		return
+	}
+	for storeName, store := range out.Datastores {
+		if len(store.Destinations) < 1 && len(p.Datastores[storeName].Destinations) > 0 {
+			delete(out.Datastores, storeName)
+		}
+	}
+
+	return
+}
+
+func (p Params) lookupProfile(name string) (out Profile, err error) {
+	out, ok := p.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(p.Profiles))
+		for key := range p.Profiles {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		err = fmt.Errorf("unknown profile %q, should be one of %q", name, names)
+	}
+	return
+}
+
+// restrict keeps only the named Datastores and Destinations. An empty list of
+// names keeps everything.
+func (p *Params) restrict(storenames, destnames []string) error {
+	if len(storenames) > 0 {
+		keep := make(map[string]Datastore, len(storenames))
+		for _, name := range storenames {
+			store, ok := p.Datastores[name]
+			if !ok {
+				return fmt.Errorf("no datastore %q to select", name)
+			}
+			keep[name] = store
+		}
+		p.Datastores = keep
+	}
+
+	if len(destnames) > 0 {
+		found := make(map[string]bool, len(destnames))
+		for storeName, store := range p.Datastores {
+			if store, ok := makeDatastore(store, destnames...); ok {
+				for destName := range store.Destinations {
+					found[destName] = true
+				}
+				p.Datastores[storeName] = store
+			} else {
+				delete(p.Datastores, storeName)
+			}
+		}
+
+		for _, name := range destnames {
+			if !found[name] {
+				return fmt.Errorf("no destination %q to select", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package config_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestParamsWithProfile(t *testing.T) {
+	const data = `
+[defaults.restic.global]
+limit-upload = 10000
+
+[datastores.photos.destinations.usb]
+path = "/mnt/usb/photos"
+
+[datastores.photos.destinations.offsite]
+path = "sftp:backup:/photos"
+
+[datastores.photos.destinations.offsite.defaults.restic.check]
+read-data-subset = "5%"
+
+[datastores.music.destinations.nas]
+path = "/mnt/nas/music"
+
+[profiles.travel]
+disable-destinations = ["offsite"]
+
+[profiles.travel.defaults.restic.global]
+limit-upload = 500
+
+[profiles.full-check.datastores.photos.destinations.offsite.defaults.restic.check]
+read-data = true
+
+[profiles.photos-only]
+storenames = ["photos"]
+destnames = ["usb"]
+
+[profiles.no-music]
+disable-destinations = ["nas"]
+`
+	params, err := config.LoadReader(strings.NewReader(data), "wrestic.toml", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("travel", func(t *testing.T) {
+		actual, err := params.WithProfile("travel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.Profiles != nil {
+			t.Errorf("expected Profiles to be nil, got %v", actual.Profiles)
+		}
+
+		testStrings(t, "destinations", destinationKeys(actual), []string{"music.nas", "photos.usb"})
+
+		dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, "usb")
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := merged.Restic.Global.LimitUpload; got == nil || *got != 500 {
+			t.Errorf("wrong limit-upload; got %v, expected %d", got, 500)
+		}
+	})
+
+	t.Run("full-check", func(t *testing.T) {
+		actual, err := params.WithProfile("full-check")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testStrings(t, "destinations", destinationKeys(actual), []string{"music.nas", "photos.offsite", "photos.usb"})
+
+		dest := resolveDestination(t, []config.Params{actual}, config.ResolveOptions{}, "offsite")
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := merged.Restic.Check.ReadData; got == nil || !*got {
+			t.Errorf("wrong read-data; got %v, expected true", got)
+		}
+		testStringPointer(t, "read-data-subset", merged.Restic.Check.ReadDataSubset, pointTo("5%"))
+
+		// The input should not be modified.
+		if got := params.Datastores["photos"].Destinations["offsite"].Defaults.Restic.Check.ReadData; got != nil {
+			t.Errorf("input was modified; got read-data %v", *got)
+		}
+	})
+
+	t.Run("photos-only", func(t *testing.T) {
+		actual, err := params.WithProfile("photos-only")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testStrings(t, "destinations", destinationKeys(actual), []string{"photos.usb"})
+		if len(params.Datastores) != 2 || len(params.Datastores["photos"].Destinations) != 2 {
+			t.Error("input was modified")
+		}
+	})
+
+	t.Run("no-music", func(t *testing.T) {
+		actual, err := params.WithProfile("no-music")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Like restricting the destinations, disabling every destination of a
+		// datastore drops it.
+		testStrings(t, "destinations", destinationKeys(actual), []string{"photos.offsite", "photos.usb"})
+		if store, ok := actual.Datastores["music"]; ok {
+			t.Errorf("expected datastore without destinations to be dropped; got %v", store)
+		}
+		if len(params.Datastores["music"].Destinations) != 1 {
+			t.Error("input was modified")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			data     string
+			profile  string
+			expected []string
+		}{
+			{
+				name:     "unknown profile",
+				data:     "[profiles.a]\n[profiles.b]",
+				profile:  "c",
+				expected: []string{`unknown profile "c"`, `"a" "b"`},
+			},
+			{
+				name:     "unknown datastore",
+				data:     "[profiles.x.datastores.nope.defaults]",
+				profile:  "x",
+				expected: []string{`no datastore "nope"`, "profiles.x"},
+			},
+			{
+				name:     "unknown destination",
+				data:     "[datastores.a.destinations.b]\n[profiles.x.datastores.a.destinations.nope.defaults]",
+				profile:  "x",
+				expected: []string{`no destination "nope"`, "profiles.x"},
+			},
+			{
+				name:     "unknown storename",
+				data:     "[profiles.x]\nstorenames = [\"nope\"]",
+				profile:  "x",
+				expected: []string{`no datastore "nope"`, "profiles.x"},
+			},
+			{
+				name:     "unknown destname",
+				data:     "[datastores.a.destinations.b]\n[profiles.x]\ndestnames = [\"nope\"]",
+				profile:  "x",
+				expected: []string{`no destination "nope"`, "profiles.x"},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				params, err := config.LoadReader(strings.NewReader(test.data), "wrestic.toml", t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = params.WithProfile(test.profile)
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				for _, substr := range test.expected {
+					if !strings.Contains(err.Error(), substr) {
+						t.Errorf("expected error %q to contain %q", err, substr)
+					}
+				}
+			})
+		}
+	})
+}
+
+// destinationKeys outputs store.destination for each destination of params,
+// in sorted order.
+func destinationKeys(params config.Params) (out []string) {
+	for storeName, store := range params.Datastores {
+		for destName := range store.Destinations {
+			out = append(out, storeName+"."+destName)
+		}
+	}
+	sort.Strings(out)
+	return
+}
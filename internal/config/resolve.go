@@ -0,0 +1,330 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ResolveOptions are what Resolve applies to the config, besides merging it.
+type ResolveOptions struct {
+	// ConfigDir is for the password-command flag, see BuildFlags.
+	ConfigDir string
+	// Hostname, when non-empty, selects the Hosts to apply, see ForHost.
+	Hostname string
+	// Profile, when non-empty, is the name of a Profile to apply.
+	Profile string
+	// Overrides are applied last, see WithOverrides.
+	Overrides Defaults
+}
+
+// Resolved is config where the Defaults of each Destination are merged, once,
+// along with where each value comes from, and the flags for each restic
+// subcommand. It cannot be modified; its methods output copies. Use Resolve to
+// make one.
+type Resolved struct {
+	params     Params
+	datastores []ResolvedDatastore
+}
+
+// Resolve combines layers of config, like MergeLayers, and applies the Hosts
+// for the hostname of opts, like ForHost. Then it applies the profile and the
+// overrides of opts, like WithProfile and WithOverrides. The Defaults of each
+// Destination are merged, once, from every table of the config that they come
+// from, lowest precedence first. Each table is kept apart while merging, so
+// that a value from the system config file, the config file of a user, or a
+// section of hosts has its own Origin, see ResolvedDestination.Explain.
+// Then the flags are made for each restic subcommand with a section in
+// ResticDefaults.
+//
+// It's an error if the layers cannot be combined, or the hosts or the profile
+// cannot be applied. Any problem with a Destination, such as an invalid merge
+// strategy or password-config, is output by the method of its
+// ResolvedDestination that needs it, so that one Destination does not stop the
+// rest from working. The input is not modified.
+func Resolve(layers []Params, opts ResolveOptions) (out Resolved, err error) {
+	combined, err := MergeLayers(layers...)
+	if err != nil {
+		return
+	}
+	base := combined
+	var hosts []string
+	if opts.Hostname != "" {
+		hosts = combined.matchHosts(opts.Hostname)
+		if base, err = combined.ForHost(opts.Hostname); err != nil {
+			return
+		}
+	}
+
+	params := base
+	var profile Profile
+	if opts.Profile != "" {
+		if params, err = base.WithProfile(opts.Profile); err != nil {
+			return
+		}
+		profile = base.Profiles[opts.Profile]
+	}
+	if !reflect.ValueOf(opts.Overrides).IsZero() {
+		params = params.WithOverrides(opts.Overrides)
+	}
+
+	out.params = params
+	out.params.Datastores = make(map[string]Datastore, len(params.Datastores))
+	for name, store := range params.Datastores {
+		out.params.Datastores[name], _ = makeDatastore(store)
+	}
+	out.params.setNames()
+
+	// These are the levels above the Datastores, lowest precedence first.
+	var top []level
+	for _, layer := range layers {
+		top = append(top, level{origin: toml.Key{"defaults"}, file: layer.File, defaults: layer.Defaults})
+	}
+	for _, key := range hosts {
+		host := combined.Hosts[key]
+		top = append(top, level{origin: toml.Key{"hosts", key, "defaults"}, file: host.File, defaults: host.Defaults})
+	}
+	top = append(top, level{origin: toml.Key{"profiles", opts.Profile, "defaults"}, file: profile.File, defaults: profile.Defaults})
+
+	storeNames := make([]string, 0, len(out.params.Datastores))
+	for name := range out.params.Datastores {
+		storeNames = append(storeNames, name)
+	}
+	sort.Strings(storeNames)
+
+	for _, storeName := range storeNames {
+		// The Defaults are those of the config, before the profile and the
+		// overrides. The last Host to define a Datastore is where it's from.
+		store := base.Datastores[storeName]
+		storeKey := toml.Key{"datastores", storeName}
+		for i := len(hosts) - 1; i >= 0; i-- {
+			if _, ok := combined.Hosts[hosts[i]].Datastores[storeName]; ok {
+				storeKey = toml.Key{"hosts", hosts[i], "datastores", storeName}
+				break
+			}
+		}
+		resolvedStore := ResolvedDatastore{store: out.params.Datastores[storeName], key: storeKey}
+		profileStore := profile.Datastores[storeName]
+
+		destNames := make([]string, 0, len(resolvedStore.store.Destinations))
+		for name := range resolvedStore.store.Destinations {
+			destNames = append(destNames, name)
+		}
+		sort.Strings(destNames)
+
+		for _, destName := range destNames {
+			dest := store.Destinations[destName]
+			levels := append(top[:len(top):len(top)],
+				level{origin: append(storeKey[:len(storeKey):len(storeKey)], "defaults"), file: store.File, defaults: store.Defaults},
+				level{origin: toml.Key{"profiles", opts.Profile, "datastores", storeName, "defaults"}, file: profile.File, defaults: profileStore.Defaults},
+				level{origin: append(storeKey[:len(storeKey):len(storeKey)], "destinations", destName, "defaults"), file: store.File, defaults: dest.Defaults},
+				level{origin: toml.Key{"profiles", opts.Profile, "datastores", storeName, "destinations", destName, "defaults"}, file: profile.File, defaults: profileStore.Destinations[destName].Defaults},
+				level{origin: toml.Key{OverridesOrigin}, defaults: opts.Overrides},
+			)
+
+			resolved := &resolvedDestination{name: destName, path: dest.Path, configDir: opts.ConfigDir}
+			resolved.defaults, resolved.explanations, resolved.err = mergeLevels(levels)
+			resolved.resolveSubcommands()
+			resolvedStore.destinations = append(resolvedStore.destinations, ResolvedDestination{r: resolved})
+		}
+
+		out.datastores = append(out.datastores, resolvedStore)
+	}
+
+	return
+}
+
+// Params outputs a copy of the config, after applying the Hosts, the profile
+// and the overrides. The Defaults of its Destinations are as configured; see
+// ResolvedDestination.Merge for the merged ones.
+func (r Resolved) Params() (out Params) {
+	out = r.params
+	out.Datastores = make(map[string]Datastore, len(r.params.Datastores))
+	for name, store := range r.params.Datastores {
+		out.Datastores[name], _ = makeDatastore(store)
+	}
+	return
+}
+
+// Datastores outputs every ResolvedDatastore, ordered by name.
+func (r Resolved) Datastores() []ResolvedDatastore {
+	return r.Select(nil, nil)
+}
+
+// Select is like SelectDatastores, for a ResolvedDatastore.
+func (r Resolved) Select(names, destNames []string) (out []ResolvedDatastore) {
+	for _, selected := range SelectDatastores(r.params.Datastores, names, destNames) {
+		for _, store := range r.datastores {
+			if store.store.Name != selected.Name {
+				continue
+			}
+
+			dupe := ResolvedDatastore{store: selected, key: store.key}
+			for _, dest := range store.destinations {
+				if _, ok := selected.Destinations[dest.r.name]; ok {
+					dupe.destinations = append(dupe.destinations, dest)
+				}
+			}
+			out = append(out, dupe)
+		}
+	}
+	return
+}
+
+// ResolvedDatastore is a Datastore of Resolved.
+type ResolvedDatastore struct {
+	store Datastore
+	// key is the table of the config file where the Datastore is defined.
+	key          toml.Key
+	destinations []ResolvedDestination
+}
+
+// Name is the name of the Datastore.
+func (s ResolvedDatastore) Name() string { return s.store.Name }
+
+// File is the config file where the Datastore is defined, see Load.
+func (s ResolvedDatastore) File() string { return s.store.File }
+
+// Datastore outputs a copy of the Datastore, as configured. See
+// Resolved.Params for how its Destinations behave.
+func (s ResolvedDatastore) Datastore() (out Datastore) {
+	out, _ = makeDatastore(s.store)
+	return
+}
+
+// Sources outputs a copy of the Sources of the Datastore.
+func (s ResolvedDatastore) Sources() []Source {
+	out := make([]Source, len(s.store.Sources))
+	copy(out, s.store.Sources)
+	return out
+}
+
+// Destinations outputs each ResolvedDestination of the Datastore, ordered by
+// name.
+func (s ResolvedDatastore) Destinations() []ResolvedDestination {
+	out := make([]ResolvedDestination, len(s.destinations))
+	copy(out, s.destinations)
+	return out
+}
+
+// ResolvedDestination is a Destination of Resolved.
+type ResolvedDestination struct{ r *resolvedDestination }
+
+// Name is the name of the Destination.
+func (d ResolvedDestination) Name() string { return d.r.name }
+
+// Path is the restic repository path.
+func (d ResolvedDestination) Path() string { return d.r.path }
+
+// Merge outputs the Defaults of the Destination, with those of its Datastore
+// and the config above it merged in. A value that's specified for the
+// Destination is not overridden by the same value from a level beneath, unless
+// the merge strategy of the value says otherwise. It's an error if a merge
+// strategy at any level cannot be applied.
+func (d ResolvedDestination) Merge() (Defaults, error) { return d.r.merge() }
+
+// Explain outputs each value of the merged Defaults, ordered by Key. Each one
+// notes the table of the config where it's specified, and which values it
+// replaces or appends to. A value that's unset by a merge strategy is in the
+// output too, so that it's clear where it went. A map, such as process.env, is
+// merged one key at a time, so each of its keys is a separate value.
+func (d ResolvedDestination) Explain() ([]Explanation, error) {
+	if d.r.err != nil {
+		return nil, d.r.err
+	}
+	out := make([]Explanation, len(d.r.explanations))
+	for i, explanation := range d.r.explanations {
+		out[i] = explanation
+		out[i].Shadowed = append([]Sourced(nil), explanation.Shadowed...)
+	}
+	return out, nil
+}
+
+// BuildFlags outputs the restic flags for subcmd, made from the merged Defaults,
+// with the password-command relative to the config dir of ResolveOptions. The
+// first flag is the repository.
+func (d ResolvedDestination) BuildFlags(subcmd string) ([]Flag, error) {
+	return d.r.buildFlags(subcmd)
+}
+
+// Timeout outputs how long subcmd may run upon the Destination. If it's 0, then
+// there is no timeout.
+func (d ResolvedDestination) Timeout(subcmd string) (time.Duration, error) {
+	return d.r.timeout(subcmd)
+}
+
+type resolvedDestination struct {
+	name, path   string
+	configDir    string
+	defaults     Defaults
+	explanations []Explanation
+	subcommands  map[string]resolvedSubcommand
+	// err is the problem, if any, with merging the Defaults.
+	err error
+}
+
+// resolvedSubcommand is what's made for one restic subcommand. The key of the
+// empty string is for any subcommand without a section in ResticDefaults.
+type resolvedSubcommand struct {
+	flags      []Flag
+	flagsErr   error
+	timeout    time.Duration
+	timeoutErr error
+}
+
+func (r *resolvedDestination) resolveSubcommands() {
+	r.subcommands = make(map[string]resolvedSubcommand, len(resticSubcommands)+1)
+	if r.err != nil {
+		return
+	}
+
+	subcmds := append([]string{""}, resticSubcommands...)
+	if r.defaults.Timeout != nil {
+		for subcmd := range *r.defaults.Timeout {
+			subcmds = append(subcmds, subcmd)
+		}
+	}
+	for _, subcmd := range subcmds {
+		var resolved resolvedSubcommand
+		resolved.flags, resolved.flagsErr = buildFlags(r.defaults, r.path, r.configDir, subcmd)
+		resolved.timeout, resolved.timeoutErr = subcommandTimeout(r.defaults, subcmd)
+		r.subcommands[subcmd] = resolved
+	}
+}
+
+func (r *resolvedDestination) merge() (out Defaults, err error) {
+	if r.err != nil {
+		err = r.err
+		return
+	}
+	out = duplicateDefaults(r.defaults)
+	return
+}
+
+func (r *resolvedDestination) subcommand(subcmd string) resolvedSubcommand {
+	if out, ok := r.subcommands[subcmd]; ok {
+		return out
+	}
+	return r.subcommands[""]
+}
+
+func (r *resolvedDestination) buildFlags(subcmd string) ([]Flag, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	resolved := r.subcommand(subcmd)
+	if resolved.flagsErr != nil {
+		return nil, resolved.flagsErr
+	}
+	return append([]Flag(nil), resolved.flags...), nil
+}
+
+func (r *resolvedDestination) timeout(subcmd string) (time.Duration, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	resolved := r.subcommand(subcmd)
+	return resolved.timeout, resolved.timeoutErr
+}
@@ -0,0 +1,317 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestResolve(t *testing.T) {
+	const extra = `
+[defaults.restic.global]
+verbose = 1
+
+[defaults.restic.backup]
+exclude = ["top"]
+tag = ["top"]
+
+[defaults.timeout]
+backup = "1h"
+prune = "2h"
+
+[datastores.stuff.defaults]
+merge = { "restic.backup.exclude" = "append" }
+
+[datastores.stuff.defaults.restic.backup]
+exclude = ["store"]
+
+[datastores.stuff.destinations.alfa.defaults.timeout]
+check = "10m"
+
+[profiles.quiet.defaults.restic.global]
+verbose = 3
+
+[profiles.quiet.datastores.stuff.destinations.bravo.defaults]
+merge = { "restic.backup.tag" = "unset" }
+`
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "wrestic.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := config.ParseOverrides("restic.backup.host=manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const system = `
+[defaults]
+restic-bin = "/usr/local/bin/restic"
+
+[defaults.restic.global]
+verbose = 2
+
+[defaults.restic.backup]
+tag = ["system"]
+
+[defaults.timeout]
+check = "1h"
+`
+	const hosts = `
+[defaults.merge]
+"restic.backup.tag" = "append"
+
+[defaults.restic.backup]
+tag = ["user"]
+
+[hosts."web-*".defaults.restic.global]
+verbose = 1
+
+[hosts.web-1.datastores.more.destinations.delta]
+path = "/repos/delta"
+defaults.password-config.args = ["secrets/d"]
+`
+
+	// These are the flags of a destination, after the repo and the
+	// password-command, and its timeouts.
+	type expectedDestination struct {
+		path, password string
+		// backup are the flags for backup, and global are those for the other
+		// subcommands with a section in ResticDefaults.
+		backup, global []string
+		timeouts       map[string]time.Duration
+	}
+
+	testdataDests := func(backup, global []string, timeouts map[string]time.Duration) map[string]expectedDestination {
+		return map[string]expectedDestination{
+			"stuff.alfa":     {path: "/tmp/wrestic_test/testdata/repos/alfa", password: "secrets/a", backup: backup, global: global, timeouts: timeouts},
+			"stuff.bravo":    {path: "/tmp/wrestic_test/testdata/repos/bravo", password: "secrets/a", backup: backup, global: global, timeouts: timeouts},
+			"things.charlie": {path: "/tmp/wrestic_test/testdata/repos/charlie", password: "secrets/b", backup: backup, global: global, timeouts: timeouts},
+		}
+	}
+
+	profileDests := testdataDests(nil, []string{"verbose=3"}, map[string]time.Duration{"backup": time.Hour, "prune": 2 * time.Hour})
+	alfa, bravo, charlie := profileDests["stuff.alfa"], profileDests["stuff.bravo"], profileDests["things.charlie"]
+	alfa.backup = []string{"exclude=top", "exclude=store", "host=manual", "tag=top", "verbose=3"}
+	alfa.timeouts = map[string]time.Duration{"backup": time.Hour, "check": 10 * time.Minute, "prune": 2 * time.Hour}
+	bravo.backup = []string{"exclude=top", "exclude=store", "host=manual", "verbose=3"}
+	charlie.backup = []string{"exclude=top", "host=manual", "tag=top", "verbose=3"}
+	profileDests["stuff.alfa"], profileDests["stuff.bravo"], profileDests["things.charlie"] = alfa, bravo, charlie
+
+	hostDests := testdataDests([]string{"tag=system", "tag=user", "verbose=1"}, []string{"verbose=1"}, map[string]time.Duration{"check": time.Hour})
+	hostDests["more.delta"] = expectedDestination{
+		path: "/repos/delta", password: "secrets/d",
+		backup: []string{"tag=system", "tag=user", "verbose=1"}, global: []string{"verbose=1"},
+		timeouts: map[string]time.Duration{"check": time.Hour},
+	}
+
+	tests := []struct {
+		name     string
+		configs  []string
+		opts     config.ResolveOptions
+		expected map[string]expectedDestination
+	}{
+		{name: "testdata", configs: []string{string(raw)}, opts: config.ResolveOptions{ConfigDir: "/etc/wrestic"}, expected: testdataDests(nil, nil, nil)},
+		{
+			name:     "profile, overrides and merge strategies",
+			configs:  []string{string(raw) + extra},
+			opts:     config.ResolveOptions{ConfigDir: "/etc/wrestic", Profile: "quiet", Overrides: overrides},
+			expected: profileDests,
+		},
+		{
+			name:     "layers and hosts",
+			configs:  []string{system, string(raw) + hosts},
+			opts:     config.ResolveOptions{ConfigDir: "/etc/wrestic", Hostname: "web-1"},
+			expected: hostDests,
+		},
+	}
+
+	// An unknown subcommand is included, for the flags of any subcommand
+	// without a section in ResticDefaults.
+	subcmds := []string{"backup", "check", "ls", "snapshots", "stats", "unlock", "prune"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layers := make([]config.Params, len(test.configs))
+			for i, cfg := range test.configs {
+				if layers[i], err = config.Parse(strings.NewReader(cfg)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resolved, err := config.Resolve(layers, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var numDests int
+			for _, store := range resolved.Datastores() {
+				for _, dest := range store.Destinations() {
+					numDests++
+					errPrefix := store.Name() + "." + dest.Name()
+					expected, ok := test.expected[errPrefix]
+					if !ok {
+						t.Fatalf("unexpected destination %s", errPrefix)
+					}
+					if dest.Path() != expected.path {
+						t.Errorf("%s: wrong Path; got %q, expected %q", errPrefix, dest.Path(), expected.path)
+					}
+
+					// Every merge strategy is applied, so none are left.
+					merged, err := dest.Merge()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if merged.Merge != nil {
+						t.Errorf("%s: expected no merge strategies; got %v", errPrefix, merged.Merge)
+					}
+
+					for _, subcmd := range subcmds {
+						flags, err := dest.BuildFlags(subcmd)
+						if err != nil {
+							t.Fatal(err)
+						}
+						got := make([]string, len(flags))
+						for i, flag := range flags {
+							got[i] = flag.Key + "=" + flag.Val
+						}
+						expectedFlags := []string{"repo=" + expected.path, "password-command=cat /etc/wrestic/" + expected.password}
+						switch subcmd {
+						case "backup":
+							expectedFlags = append(expectedFlags, expected.backup...)
+						case "check", "ls", "snapshots", "stats":
+							expectedFlags = append(expectedFlags, expected.global...)
+						}
+						testStrings(t, errPrefix+" "+subcmd, got, expectedFlags)
+
+						timeout, err := dest.Timeout(subcmd)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if timeout != expected.timeouts[subcmd] {
+							t.Errorf("%s %s: wrong Timeout; got %v, expected %v", errPrefix, subcmd, timeout, expected.timeouts[subcmd])
+						}
+					}
+				}
+			}
+			if numDests != len(test.expected) {
+				t.Errorf("wrong number of destinations; got %d, expected %d", numDests, len(test.expected))
+			}
+		})
+	}
+
+	t.Run("immutable", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(string(raw) + extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := resolved.Select([]string{"stuff"}, []string{"alfa"})[0].Destinations()[0]
+
+		merged, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		(*merged.Restic.Backup.Exclude)[0] = "changed"
+		merged.PasswordConfig.Args[0] = "changed"
+		flags, err := dest.BuildFlags("backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags[0].Val = "changed"
+		explanations, err := dest.Explain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		explanations[0].Key = "changed"
+
+		again, err := dest.Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testStrings(t, "exclude", *again.Restic.Backup.Exclude, []string{"top", "store"})
+		testStrings(t, "args", again.PasswordConfig.Args, []string{"secrets/a"})
+		if againFlags, err := dest.BuildFlags("backup"); err != nil {
+			t.Fatal(err)
+		} else if againFlags[0].Val == "changed" {
+			t.Errorf("flags were modified; got %v", againFlags)
+		}
+		if againExplanations, err := dest.Explain(); err != nil {
+			t.Fatal(err)
+		} else if againExplanations[0].Key == "changed" {
+			t.Errorf("explanations were modified; got %v", againExplanations)
+		}
+		testStrings(t, "input", *params.Datastores["stuff"].Defaults.Restic.Backup.Exclude, []string{"store"})
+	})
+
+	t.Run("params", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(string(raw) + extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{ConfigDir: "/etc/wrestic", Profile: "quiet"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// It's config like any other, so it may be resolved again.
+		out := resolved.Params()
+		merged, err := resolveDestination(t, []config.Params{out}, config.ResolveOptions{}, "bravo").Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if merged.Restic.Backup.Tag != nil {
+			t.Errorf("expected tag to be unset; got %v", *merged.Restic.Backup.Tag)
+		}
+		testResticConfig(t, "global", merged.Restic.Global, &config.ResticGlobal{Verbose: pointTo(3)})
+
+		// More may be applied to it.
+		applied := out.WithOverrides(config.Defaults{Restic: &config.ResticDefaults{Global: &config.ResticGlobal{Verbose: pointTo(4)}}})
+		merged, err = resolveDestination(t, []config.Params{applied}, config.ResolveOptions{}, "bravo").Merge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testResticConfig(t, "global", merged.Restic.Global, &config.ResticGlobal{Verbose: pointTo(4)})
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(string(raw) + `
+[datastores.things.destinations.charlie.defaults.merge]
+"restic.backup.tags" = "append"
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = config.Resolve([]config.Params{params}, config.ResolveOptions{Profile: "nope"}); err == nil || !strings.Contains(err.Error(), `unknown profile "nope"`) {
+			t.Errorf("expected an unknown profile error; got %v", err)
+		}
+
+		resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, store := range resolved.Datastores() {
+			for _, dest := range store.Destinations() {
+				_, mergeErr := dest.Merge()
+				_, explainErr := dest.Explain()
+				_, flagsErr := dest.BuildFlags("backup")
+				_, timeoutErr := dest.Timeout("backup")
+				for _, err := range []error{mergeErr, explainErr, flagsErr, timeoutErr} {
+					if dest.Name() != "charlie" && err != nil {
+						t.Errorf("unexpected error for %s: %v", dest.Name(), err)
+					} else if dest.Name() == "charlie" && !errors.Is(err, config.ErrMergeStrategy) {
+						t.Errorf("expected error %v to wrap %v", err, config.ErrMergeStrategy)
+					}
+				}
+			}
+		}
+	})
+}
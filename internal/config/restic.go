@@ -1,8 +1,13 @@
 package config
 
+import "reflect"
+
 // ResticDefaults are any default configuration values for restic subcommands.
 // Asides from Global, which is configuration for shared flags, the struct
 // fields here correspond to flags for a restic subcommand.
+//
+// Some flags only exist in newer versions of restic. Their minimum versions are
+// in flagVersions, see FlagVersions.
 type ResticDefaults struct {
 	// Global refers to any restic flags that are made available for any restic
 	// subcommand. In restic's usage menus, they may appear as "global flags".
@@ -20,7 +25,9 @@ func duplicateResticDefaults(in *ResticDefaults) (out *ResticDefaults) {
 		return
 	}
 
-	mergeConfig(out, in)
+	// Copy each subcommand's values too, so that merging values into the
+	// output does not modify the input.
+	*out = deepCopy(reflect.ValueOf(*in)).Interface().(ResticDefaults)
 
 	return
 }
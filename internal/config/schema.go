@@ -0,0 +1,160 @@
+package config
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Schema outputs a JSON Schema (draft-07) for the config file. It's derived
+// from the types, starting at Params, and their toml tags. Editors may use it
+// to autocomplete and validate the config file.
+func Schema() map[string]any {
+	b := schemaBuilder{definitions: make(map[string]any)}
+
+	out := b.object(reflect.TypeOf(Params{}))
+	out["$schema"] = "http://json-schema.org/draft-07/schema#"
+	out["title"] = "wrestic.toml"
+	out["definitions"] = b.definitions
+	return out
+}
+
+// WriteSchema writes the output of Schema to w, as indented JSON.
+func WriteSchema(w io.Writer) error {
+	raw, err := json.MarshalIndent(Schema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(raw, '\n'))
+	return err
+}
+
+type schemaBuilder struct{ definitions map[string]any }
+
+func (b schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := b.definitions[name]; !ok {
+			b.definitions[name] = nil // Avoid infinite recursion.
+			b.definitions[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/definitions/" + name}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
+
+func (b schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := tomlKey(field)
+		if !field.IsExported() || key == "" || key == "-" {
+			continue
+		}
+
+		prop := b.schema(field.Type)
+		if choices, ok := schemaEnums[t.Name()+"."+field.Name]; ok {
+			if values, ok := prop["additionalProperties"].(map[string]any); ok {
+				// The choices are for the values of a map.
+				values["enum"] = choices
+			} else {
+				prop["enum"] = choices
+			}
+		}
+
+		desc := fieldDocs[t.Name()+"."+field.Name]
+		if desc == "" && strings.HasPrefix(t.Name(), "Restic") && t.Name() != "ResticDefaults" {
+			desc = "The restic flag, --" + key + "."
+			if since := flagSince(t, key); since != "" {
+				desc += " It needs restic " + since + " or newer."
+			}
+		}
+		if desc != "" {
+			if _, ok := prop["$ref"]; ok {
+				// Siblings of $ref are ignored in draft-07.
+				prop = map[string]any{"allOf": []any{prop}}
+			}
+			prop["description"] = desc
+		}
+
+		properties[key] = prop
+	}
+
+	return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+// schemaEnums are the accepted values of some fields, keyed by type name and
+// field name. For a map, they're the accepted values of its entries.
+var schemaEnums = map[string][]string{
+	"Defaults.Merge":            mergeStrategies,
+	"Defaults.UnsupportedFlags": {UnsupportedFlagsFail, UnsupportedFlagsDrop},
+	"IONiceConfig.Class":        {IONiceClassRealtime, IONiceClassBestEffort, IONiceClassIdle},
+	"NotifyConfig.On":           {NotifyOnFailure, NotifyOnAlways, NotifyOnRecovery},
+	"NotifyConfig.Scope":        {NotifyScopeDestination, NotifyScopeBatch},
+	"ResticGlobal.Compression":  compressionModes,
+	"ResticStats.Mode":          statsModes,
+}
+
+// fieldDocs are the descriptions of fields in the Schema, keyed by type name and
+// field name. They're for someone editing the config file, so they name keys
+// and values as they're written in TOML. A test checks that each field with a
+// doc comment has one.
+var fieldDocs = map[string]string{
+	"Params.Hosts":                  "Config that only applies upon matching hosts, keyed by a hostname or a glob pattern of one.",
+	"Host.Defaults":                 "Overrides the top-level defaults upon the host. Unspecified values are inherited from the top-level defaults.",
+	"Host.Datastores":               "Added to the top-level datastores upon the host. One with the same name as a top-level datastore must have override = true to replace it.",
+	"Host.RemoveDatastores":         "Names of datastores to leave out upon the host.",
+	"Host.DisableDestinations":      "Names of destinations to leave out upon the host.",
+	"Params.Profiles":               "Overlays of config, by name, which apply when selected with the -profile flag.",
+	"Profile.Defaults":              "Overlays the top-level defaults.",
+	"Profile.Datastores":            "Overlays the defaults of datastores, and of their destinations, by name.",
+	"Profile.Storenames":            "When non-empty, the only datastores that are active.",
+	"Profile.Destnames":             "When non-empty, the only destinations that are active.",
+	"Profile.DisableDestinations":   "Names of destinations to leave out.",
+	"ProfileDatastore.Defaults":     "Overlays the defaults of the datastore.",
+	"ProfileDatastore.Destinations": "Overlays the defaults of the destinations of the datastore, by name.",
+	"ProfileDestination.Defaults":   "Overlays the defaults of the destination.",
+	"Params.Include":                "More config files to read datastores from. Each one is relative to the directory of the file that includes it, and may be a glob pattern.",
+	"Datastore.Defaults":            "Values that only apply to the destinations of the datastore. Unspecified values are inherited from the top-level defaults.",
+	"Datastore.Schedule":            "Maps the name of a restic subcommand to a schedule for running it upon the datastore, such as \"daily 02:00\", \"weekly mon 03:30\" or \"@hourly\".",
+	"Datastore.Override":            "Replaces the datastore of the same name from the system-wide config file.",
+	"Defaults.Merge":                "Maps the dotted key of a value, such as \"restic.backup.exclude\", to how it's combined with the value inherited from the level beneath: \"replace\", \"append\" or \"unset\".",
+	"Defaults.ResticBin":            "The path to the restic executable. When empty, the environment variable, RESTIC_BIN, is consulted. Otherwise, the first restic executable found in PATH is used.",
+	"Defaults.ResticVersion":        "A constraint, such as \">= 0.16, < 0.18\", that the version of the restic executable must satisfy.",
+	"Defaults.Timeout":              "Maps the name of a restic subcommand, such as \"backup\", to how long it may run upon a destination, such as \"30m\" or \"4h\". The keys from each level are merged together.",
+	"Defaults.UnsupportedFlags":     "What to do with a flag that's not supported by the version of the restic executable. With \"fail\", the batch stops before restic runs upon any destination. With \"drop\", the flag is left out, with a warning. When empty, it's \"fail\".",
+	"Destination.Defaults":          "Values that only apply to the destination. Unspecified values are inherited from the datastore.",
+	"Destination.Path":              "The restic repository path.",
+	"IONiceConfig.Class":            "One of \"realtime\", \"best-effort\" or \"idle\".",
+	"IONiceConfig.Level":            "The priority within the class, from 0 (highest) to 7 (lowest). It's not applicable to the idle class.",
+	"NotifyConfig.On":               "Which outcomes are sent. With \"failure\", the default, only failures are sent. With \"always\", every outcome is sent. With \"recovery\", failures are sent, and so is the first success after a failure.",
+	"NotifyConfig.Scope":            "Either \"destination\" or \"batch\". With \"destination\", each destination is reported separately. With \"batch\", one report summarizes every destination operated upon by one invocation. Only the top-level defaults are consulted for batch-scoped notifications.",
+	"NotifySMTP.Addr":               "The host and port of the SMTP server, such as \"localhost:25\".",
+	"NotifySMTP.PasswordEnv":        "The name of an environment variable holding the password to authenticate with. It's read when sending, not when parsing.",
+	"NotifySMTP.Username":           "When specified, enables PLAIN authentication.",
+	"NotifyWebhook.Template":        "The request body, as a Go text/template. When empty, the body is the outcome encoded as JSON. The template function, json, encodes a value as JSON.",
+	"PasswordConfig.Args":           "Positional arguments that may be referenced by placeholders in the template.",
+	"PasswordConfig.Template":       "The password-command to pass to restic, as a Go text/template. The args may be interjected into placeholders delimited by \"{{\" and \"}}\".",
+	"ProcessConfig.Env":             "Additional environment variables for restic, such as RESTIC_READ_CONCURRENCY. The keys from each level are merged together.",
+	"ProcessConfig.GOMAXPROCS":      "Limits how many CPUs restic may use simultaneously. It's set as an environment variable for restic.",
+	"ProcessConfig.IONice":          "The I/O scheduling class and priority.",
+	"ProcessConfig.Nice":            "The scheduling priority, from -20 (most favorable) to 19 (least favorable). Lowering the value below the current one usually requires elevated privileges.",
+	"ResticDefaults.Global":         "Restic flags that are made available for any restic subcommand. In restic's usage menus, they may appear as \"global flags\".",
+	"Source.Path":                   "An absolute path to either a file or directory.",
+}
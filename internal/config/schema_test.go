@@ -0,0 +1,143 @@
+package config_test
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestSchema(t *testing.T) {
+	t.Run("matches file", func(t *testing.T) {
+		var got bytes.Buffer
+		if err := config.WriteSchema(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		const filename = "../../wrestic.schema.json"
+		expected, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), expected) {
+			t.Errorf("%s is outdated; regenerate it with: go run . config schema > wrestic.schema.json", filename)
+		}
+	})
+
+	t.Run("enum of map values", func(t *testing.T) {
+		defaults := config.Schema()["definitions"].(map[string]any)["Defaults"].(map[string]any)
+		merge := defaults["properties"].(map[string]any)["merge"].(map[string]any)
+		if _, ok := merge["enum"]; ok {
+			t.Errorf("unexpected enum for the merge table; got %v", merge["enum"])
+		}
+		values := merge["additionalProperties"].(map[string]any)
+		expected := []string{config.MergeReplace, config.MergeAppend, config.MergeUnset}
+		if got, ok := values["enum"].([]string); !ok || strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("wrong enum for merge values; got %v, expected %v", values["enum"], expected)
+		}
+	})
+
+	t.Run("descriptions of documented fields", func(t *testing.T) {
+		fset := token.NewFileSet()
+		pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool { return !strings.HasSuffix(info.Name(), "_test.go") }, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The exported names of the package, such as Defaults or Load, are Go
+		// identifiers, which shouldn't leak into descriptions for users.
+		structs := make(map[string]*ast.StructType)
+		var idents []string
+		for _, file := range pkgs["config"].Files {
+			for _, decl := range file.Decls {
+				switch decl := decl.(type) {
+				case *ast.FuncDecl:
+					idents = append(idents, decl.Name.Name)
+				case *ast.GenDecl:
+					for _, spec := range decl.Specs {
+						switch spec := spec.(type) {
+						case *ast.TypeSpec:
+							idents = append(idents, spec.Name.Name)
+						case *ast.ValueSpec:
+							for _, name := range spec.Names {
+								idents = append(idents, name.Name)
+							}
+						}
+					}
+				}
+			}
+			ast.Inspect(file, func(n ast.Node) bool {
+				if spec, ok := n.(*ast.TypeSpec); ok {
+					if st, ok := spec.Type.(*ast.StructType); ok {
+						structs[spec.Name.Name] = st
+					}
+				}
+				return true
+			})
+		}
+
+		exported := idents[:0]
+		for _, ident := range idents {
+			if ast.IsExported(ident) {
+				exported = append(exported, ident)
+			}
+		}
+		leak := regexp.MustCompile(`\b(` + strings.Join(exported, "|") + `)\b`)
+
+		schema := config.Schema()
+		objects := map[string]map[string]any{"Params": schema}
+		for name, def := range schema["definitions"].(map[string]any) {
+			objects[name] = def.(map[string]any)
+		}
+
+		for typeName, object := range objects {
+			st, ok := structs[typeName]
+			if !ok {
+				t.Errorf("type %s is not in the source", typeName)
+				continue
+			}
+			properties := object["properties"].(map[string]any)
+
+			for _, field := range st.Fields.List {
+				if field.Tag == nil || len(field.Names) < 1 {
+					continue
+				}
+				tag, err := strconv.Unquote(field.Tag.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key, _, _ := strings.Cut(reflect.StructTag(tag).Get("toml"), ",")
+				if key == "" || key == "-" {
+					continue
+				}
+
+				prop, ok := properties[key].(map[string]any)
+				if !ok {
+					t.Errorf("%s.%s is not in the schema", typeName, key)
+					continue
+				}
+				got, _ := prop["description"].(string)
+
+				switch {
+				case field.Doc != nil && got == "":
+					t.Errorf("no description for %s.%s, add one to the docs for the schema", typeName, key)
+				case field.Doc == nil && strings.HasPrefix(typeName, "Restic") && typeName != "ResticDefaults":
+					if !strings.HasPrefix(got, "The restic flag, --"+key+".") {
+						t.Errorf("wrong description for %s.%s; got %q", typeName, key, got)
+					}
+				}
+				if m := leak.FindString(got); m != "" {
+					t.Errorf("description for %s.%s mentions the Go identifier %s; got %q", typeName, key, m, got)
+				}
+			}
+		}
+	})
+}
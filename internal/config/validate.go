@@ -0,0 +1,401 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// These are values for the Severity of a Problem.
+const (
+	// SeverityError is for a value that restic would reject, or a combination
+	// of values where the intent is ambiguous.
+	SeverityError = "error"
+	// SeverityWarning is for a combination of values where one of them
+	// silently wins.
+	SeverityWarning = "warning"
+)
+
+// Problem is a configured value that restic would reject, or that conflicts
+// with another value.
+type Problem struct {
+	// Severity is SeverityError or SeverityWarning.
+	Severity string
+	// Store and Destination name where the value applies.
+	Store, Destination string
+	// Key is the path to the value within Defaults, such as
+	// "restic.backup.time". A part of it is quoted, as in TOML, if needed.
+	Key string
+	// Value is what was configured.
+	Value any
+	// Level is the table that set the value, such as "defaults" or
+	// "datastores.photos.defaults". It's a toml.Key, since a name within it
+	// may contain a dot.
+	Level toml.Key
+	// File is the config file of the Level, when it's in one.
+	File string
+	// Message says what's wrong with Value.
+	Message string
+}
+
+func (p Problem) String() string {
+	val := fmt.Sprintf("%v", p.Value)
+	if s, ok := p.Value.(string); ok {
+		val = strconv.Quote(s)
+	}
+	dest := toml.Key{"datastores", p.Store, "destinations", p.Destination}
+	return fmt.Sprintf("%s: %s = %s %s; set in [%s]", dest, p.Key, val, p.Message, p.Level)
+}
+
+// Problems is a list of Problem. It's also an error.
+type Problems []Problem
+
+// Errors outputs the members of p with SeverityError.
+func (p Problems) Errors() Problems { return p.filter(SeverityError) }
+
+// Warnings outputs the members of p with SeverityWarning.
+func (p Problems) Warnings() Problems { return p.filter(SeverityWarning) }
+
+// ForSubcommand outputs the members of p that matter when running subcmd: the
+// ones in its timeout, and in its section of ResticDefaults along with the
+// global one. A subcommand without a section, such as "unlock", gets no
+// restic flags from the config, so none of those matter.
+func (p Problems) ForSubcommand(subcmd string) (out Problems) {
+	// A subcommand with a section is selected even when the section is not
+	// configured, since the field is a typed nil pointer.
+	hasSection := selectResticSubcommand(&ResticDefaults{}, subcmd) != nil
+
+	for _, problem := range p {
+		key := splitKey(problem.Key)
+		if len(key) < 2 {
+			continue
+		}
+		switch {
+		case key[0] == "timeout" && key[1] == subcmd,
+			key[0] == "restic" && hasSection && (key[1] == subcmd || key[1] == "global"):
+			out = append(out, problem)
+		}
+	}
+	return
+}
+
+func (p Problems) filter(severity string) (out Problems) {
+	for _, problem := range p {
+		if problem.Severity == severity {
+			out = append(out, problem)
+		}
+	}
+	return
+}
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+	return fmt.Sprintf("invalid config values (%d): %s", len(p), strings.Join(lines, "; "))
+}
+
+// ValidateResolved checks the merged Defaults of each ResolvedDestination in
+// datastores for values that restic would reject, such as an unknown enum
+// value, malformed size or time, or a number out of range. It also checks for
+// combinations of values that conflict with each other, or with the flags
+// generated for the Destination. The Level and File of a Problem are the
+// Origin and File of its value, see ResolvedDestination.Explain. The output is
+// ordered by datastore, as they appear in the input, and then by destination
+// name.
+func ValidateResolved(datastores []ResolvedDatastore) (out Problems) {
+	for _, store := range datastores {
+		for _, dest := range store.Destinations() {
+			merged, err := dest.Merge()
+			if err != nil {
+				continue
+			}
+			explanations, err := dest.Explain()
+			if err != nil {
+				continue
+			}
+
+			sources := make(map[string]Sourced, len(explanations))
+			for _, explanation := range explanations {
+				sources[explanation.Key] = explanation.Sourced
+			}
+			levelOf := func(key string) (out toml.Key) {
+				if sourced, ok := sources[key]; ok {
+					out = splitKey(sourced.Origin)
+				}
+				return
+			}
+
+			for _, problem := range validateMerged(store.Name(), dest.Name(), store.store.Sources, merged, levelOf) {
+				problem.File = sources[problem.Key].File
+				out = append(out, problem)
+			}
+		}
+	}
+
+	return
+}
+
+// validateMerged checks the merged Defaults of one Destination, for
+// ValidateResolved.
+// The func, levelOf, outputs the table that sets the value of a dotted key.
+func validateMerged(storeName, destName string, sources []Source, merged Defaults, levelOf func(key string) toml.Key) (out Problems) {
+	if merged.Restic == nil {
+		return
+	}
+	report := func(severity, key string, val any, msg string) {
+		out = append(out, Problem{Severity: severity, Store: storeName, Destination: destName, Key: key, Value: val, Level: levelOf(key), Message: msg})
+	}
+
+	walkRestic(merged.Restic, func(section, key string, val any) {
+		validate, ok := resticValidators[section+"."+key]
+		if !ok {
+			return
+		}
+
+		if msg := validate(val); msg != "" {
+			report(SeverityError, "restic."+section+"."+key, val, msg)
+		}
+	})
+
+	if merged.Timeout != nil {
+		subcmds := make([]string, 0, len(*merged.Timeout))
+		for subcmd := range *merged.Timeout {
+			subcmds = append(subcmds, subcmd)
+		}
+		sort.Strings(subcmds)
+
+		for _, subcmd := range subcmds {
+			val := (*merged.Timeout)[subcmd]
+			if msg := validateDuration(val); msg != "" {
+				report(SeverityError, toml.Key{"timeout", subcmd}.String(), val, msg)
+			}
+		}
+	}
+
+	checkConflicts(sources, merged, func(severity, section, key string, val any, msg string) {
+		report(severity, "restic."+section+"."+key, val, msg)
+	})
+	return
+}
+
+// checkConflicts reports combinations of values in the merged Defaults, which
+// conflict with each other, or with the flags generated for a Destination.
+func checkConflicts(sources []Source, merged Defaults, report func(severity, section, key string, val any, msg string)) {
+	r := merged.Restic
+	generatesPassword := merged.PasswordConfig != nil && merged.PasswordConfig.Template != nil
+
+	if g := r.Global; g != nil {
+		if g.NoCache != nil && *g.NoCache && g.CacheDir != nil {
+			report(SeverityWarning, "global", "cache-dir", *g.CacheDir, "is ignored because of restic.global.no-cache")
+		}
+		if g.Repo != nil {
+			report(SeverityWarning, "global", "repo", *g.Repo, "overrides the path of the destination")
+		}
+		if g.RepositoryFile != nil {
+			report(SeverityError, "global", "repository-file", *g.RepositoryFile, "conflicts with the path of the destination")
+		}
+		if g.PasswordCommand != nil && generatesPassword {
+			report(SeverityWarning, "global", "password-command", *g.PasswordCommand, "overrides the password-command generated from password-config")
+		}
+		if g.PasswordFile != nil && (generatesPassword || g.PasswordCommand != nil) {
+			report(SeverityError, "global", "password-file", *g.PasswordFile, "conflicts with password-command")
+		}
+	}
+
+	if c := r.Check; c != nil && c.ReadData != nil && *c.ReadData && c.ReadDataSubset != nil {
+		report(SeverityError, "check", "read-data-subset", *c.ReadDataSubset, "conflicts with restic.check.read-data")
+	}
+
+	if b := r.Backup; b != nil {
+		filesFrom := []struct {
+			key string
+			val *[]string
+		}{
+			{"files-from", b.FilesFrom},
+			{"files-from-raw", b.FilesFromRaw},
+			{"files-from-verbatim", b.FilesFromVerbatim},
+		}
+
+		stdin := b.Stdin != nil && *b.Stdin
+		if stdin && len(sources) > 0 {
+			report(SeverityError, "backup", "stdin", *b.Stdin, "conflicts with the sources of the datastore")
+		}
+		for _, ff := range filesFrom {
+			if ff.val == nil || len(*ff.val) < 1 {
+				continue
+			}
+			if stdin {
+				report(SeverityError, "backup", ff.key, *ff.val, "conflicts with restic.backup.stdin")
+			} else if len(sources) > 0 {
+				report(SeverityError, "backup", ff.key, *ff.val, "conflicts with the sources of the datastore")
+			}
+		}
+	}
+}
+
+// walkRestic calls fn with each specified value of in, in order of the fields
+// of ResticDefaults and then of each subcommand struct type.
+func walkRestic(in *ResticDefaults, fn func(section, key string, val any)) {
+	sections := reflect.ValueOf(in).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		sectionValue := sections.Field(i)
+		if sectionValue.IsNil() {
+			continue
+		}
+		section := tomlKey(sections.Type().Field(i))
+
+		fields := sectionValue.Elem()
+		for j := 0; j < fields.NumField(); j++ {
+			field := fields.Field(j)
+			if field.Kind() != reflect.Pointer || field.IsNil() {
+				continue
+			}
+			fn(section, tomlKey(fields.Type().Field(j)), field.Elem().Interface())
+		}
+	}
+}
+
+func tomlKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	return key
+}
+
+// resticValidators maps section.key of ResticDefaults to a func that outputs
+// what's wrong with a value. An empty output means the value is OK.
+var resticValidators = map[string]func(val any) string{
+	"global.compression":         validateOneOf(compressionModes...),
+	"global.limit-download":      validateRange(0, -1),
+	"global.limit-upload":        validateRange(0, -1),
+	"global.pack-size":           validateRange(4, 128),
+	"global.verbose":             validateRange(0, 2),
+	"backup.exclude-larger-than": validateSize,
+	"backup.time":                validateBackupTime,
+	"check.read-data-subset":     validateDataSubset,
+	"snapshots.group-by":         validateGroupBy,
+	"snapshots.latest":           validateRange(1, -1),
+	"stats.mode":                 validateOneOf(statsModes...),
+}
+
+var (
+	compressionModes = []string{"auto", "off", "max", "fastest", "better"}
+	statsModes       = []string{"restore-size", "files-by-contents", "blobs-per-file", "raw-data"}
+)
+
+func validateOneOf(choices ...string) func(val any) string {
+	return func(val any) string {
+		for _, choice := range choices {
+			if val == choice {
+				return ""
+			}
+		}
+		return fmt.Sprintf("should be one of %q", choices)
+	}
+}
+
+// validateRange checks that a number is within lo and hi, inclusive. If hi is
+// negative, then there's no upper bound.
+func validateRange(lo, hi int) func(val any) string {
+	return func(val any) string {
+		var n int
+		switch v := val.(type) {
+		case int:
+			n = v
+		case uint:
+			n = int(v)
+		default:
+			return fmt.Sprintf("should be a number, not %T", val)
+		}
+
+		if n < lo {
+			return fmt.Sprintf("should be at least %d", lo)
+		} else if hi >= 0 && n > hi {
+			return fmt.Sprintf("should be at most %d", hi)
+		}
+		return ""
+	}
+}
+
+// sizePattern is the syntax of a size for restic, such as "500", "10K" or
+// "2G".
+var sizePattern = regexp.MustCompile(`^[0-9]+[bBkKmMgGtT]?$`)
+
+func validateSize(val any) string {
+	if s, _ := val.(string); !sizePattern.MatchString(s) {
+		return `should be a size, such as "500K", "10M" or "2G"`
+	}
+	return ""
+}
+
+// backupTimeLayout is how restic parses the time flag of backup.
+const backupTimeLayout = "2006-01-02 15:04:05"
+
+func validateBackupTime(val any) string {
+	s, _ := val.(string)
+	if s == "now" {
+		return ""
+	}
+	if _, err := time.Parse(backupTimeLayout, s); err != nil {
+		return fmt.Sprintf("should be %q or a time like %q", "now", backupTimeLayout)
+	}
+	return ""
+}
+
+// validateDataSubset checks the read-data-subset flag of check, which is one
+// of "n/t", a percentage such as "15%", or a size such as "10G".
+func validateDataSubset(val any) string {
+	const msg = `should be "n/t" with 1 <= n <= t, a percentage such as "15%", or a size such as "10G"`
+	s, _ := val.(string)
+
+	if num, denom, ok := strings.Cut(s, "/"); ok {
+		n, nerr := strconv.Atoi(num)
+		t, terr := strconv.Atoi(denom)
+		if nerr != nil || terr != nil || n < 1 || n > t {
+			return msg
+		}
+		return ""
+	}
+
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return msg
+		}
+		return ""
+	}
+
+	if !sizePattern.MatchString(s) {
+		return msg
+	}
+	return ""
+}
+
+func validateGroupBy(val any) string {
+	vals, _ := val.([]string)
+	for _, v := range vals {
+		if v == "" { // restic does not group snapshots then.
+			continue
+		}
+		for _, part := range strings.Split(v, ",") {
+			if msg := validateOneOf("host", "paths", "tags")(part); msg != "" {
+				return fmt.Sprintf("should be a combination of %q", []string{"host", "paths", "tags"})
+			}
+		}
+	}
+	return ""
+}
+
+func validateDuration(val any) string {
+	s, _ := val.(string)
+	if d, err := time.ParseDuration(s); err != nil || d < 0 {
+		return `should be a non-negative duration, such as "30m" or "4h"`
+	}
+	return ""
+}
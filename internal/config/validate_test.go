@@ -0,0 +1,297 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected config.Problems
+	}{
+		{
+			name: "ok",
+			input: `
+[defaults.restic]
+global = { compression = 'max', pack-size = 64, verbose = 2 }
+backup = { exclude-larger-than = '10G', time = '2024-01-02 03:04:05' }
+check = { read-data-subset = '2/5' }
+snapshots = { group-by = ['host,paths'], latest = 1 }
+stats = { mode = 'raw-data' }
+
+[defaults.timeout]
+backup = '4h'
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.stuff.destinations.bar]
+path = 'bar'
+
+[datastores.stuff.destinations.bar.defaults.restic]
+backup = { time = 'now' }
+check = { read-data-subset = '15%' }
+snapshots = { group-by = [''] }
+`,
+		},
+		{
+			name: "reports levels",
+			input: `
+[defaults.restic]
+global = { compression = 'maximum' }
+stats = { mode = 'rawdata' }
+
+[datastores.stuff.defaults.restic]
+backup = { exclude-larger-than = '10 gigs' }
+stats = { mode = 'restore-size' }
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.stuff.destinations.foo.defaults.restic]
+check = { read-data-subset = '5/3' }
+
+[datastores.things.destinations.bar]
+path = 'bar'
+`,
+			expected: config.Problems{
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "restic.global.compression", Value: "maximum", Level: toml.Key{"defaults"},
+					Message: `should be one of ["auto" "off" "max" "fastest" "better"]`,
+				},
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "restic.backup.exclude-larger-than", Value: "10 gigs", Level: toml.Key{"datastores", "stuff", "defaults"},
+					Message: `should be a size, such as "500K", "10M" or "2G"`,
+				},
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "restic.check.read-data-subset", Value: "5/3", Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"},
+					Message: `should be "n/t" with 1 <= n <= t, a percentage such as "15%", or a size such as "10G"`,
+				},
+				{
+					Severity: config.SeverityError,
+					Store:    "things", Destination: "bar", Key: "restic.global.compression", Value: "maximum", Level: toml.Key{"defaults"},
+					Message: `should be one of ["auto" "off" "max" "fastest" "better"]`,
+				},
+				{
+					Severity: config.SeverityError,
+					Store:    "things", Destination: "bar", Key: "restic.stats.mode", Value: "rawdata", Level: toml.Key{"defaults"},
+					Message: `should be one of ["restore-size" "files-by-contents" "blobs-per-file" "raw-data"]`,
+				},
+			},
+		},
+		{
+			name: "ranges and formats",
+			input: `
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.stuff.destinations.foo.defaults.restic]
+global = { pack-size = 2, verbose = 3, limit-upload = -1 }
+backup = { time = '02/01/2024' }
+check = { read-data-subset = '0%' }
+snapshots = { group-by = ['host,day'], latest = 0 }
+
+[datastores.stuff.destinations.foo.defaults.timeout]
+backup = '-1h'
+`,
+			expected: config.Problems{
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.global.limit-upload", Value: -1, Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"}, Message: "should be at least 0"},
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.global.pack-size", Value: uint(2), Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"}, Message: "should be at least 4"},
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.global.verbose", Value: 3, Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"}, Message: "should be at most 2"},
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "restic.backup.time", Value: "02/01/2024", Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"},
+					Message: `should be "now" or a time like "2006-01-02 15:04:05"`,
+				},
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "restic.check.read-data-subset", Value: "0%", Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"},
+					Message: `should be "n/t" with 1 <= n <= t, a percentage such as "15%", or a size such as "10G"`,
+				},
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "restic.snapshots.group-by", Value: []string{"host,day"}, Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"},
+					Message: `should be a combination of ["host" "paths" "tags"]`,
+				},
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.snapshots.latest", Value: 0, Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"}, Message: "should be at least 1"},
+				{
+					Severity: config.SeverityError,
+					Store:    "stuff", Destination: "foo", Key: "timeout.backup", Value: "-1h", Level: toml.Key{"datastores", "stuff", "destinations", "foo", "defaults"},
+					Message: `should be a non-negative duration, such as "30m" or "4h"`,
+				},
+			},
+		},
+		{
+			name: "conflicts",
+			input: `
+[defaults.password-config]
+template = 'cat secret'
+
+[defaults.restic]
+global = { no-cache = true, cache-dir = '/tmp/cache', password-command = 'pass show', repo = 'elsewhere' }
+check = { read-data = true, read-data-subset = '1/5' }
+
+[datastores.stuff]
+sources = [{ path = '/home' }]
+
+[datastores.stuff.defaults.restic]
+backup = { stdin = true, files-from = ['list.txt'] }
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.things.destinations.bar]
+path = 'bar'
+
+[datastores.things.destinations.bar.defaults.restic]
+global = { password-file = 'secret.txt', repository-file = 'repo.txt' }
+# Like a zero int, false does not replace a value of lower precedence.
+check = { read-data = false }
+`,
+			expected: config.Problems{
+				{Severity: config.SeverityWarning, Store: "stuff", Destination: "foo", Key: "restic.global.cache-dir", Value: "/tmp/cache", Level: toml.Key{"defaults"}, Message: "is ignored because of restic.global.no-cache"},
+				{Severity: config.SeverityWarning, Store: "stuff", Destination: "foo", Key: "restic.global.repo", Value: "elsewhere", Level: toml.Key{"defaults"}, Message: "overrides the path of the destination"},
+				{Severity: config.SeverityWarning, Store: "stuff", Destination: "foo", Key: "restic.global.password-command", Value: "pass show", Level: toml.Key{"defaults"}, Message: "overrides the password-command generated from password-config"},
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.check.read-data-subset", Value: "1/5", Level: toml.Key{"defaults"}, Message: "conflicts with restic.check.read-data"},
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.backup.stdin", Value: true, Level: toml.Key{"datastores", "stuff", "defaults"}, Message: "conflicts with the sources of the datastore"},
+				{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.backup.files-from", Value: []string{"list.txt"}, Level: toml.Key{"datastores", "stuff", "defaults"}, Message: "conflicts with restic.backup.stdin"},
+				{Severity: config.SeverityWarning, Store: "things", Destination: "bar", Key: "restic.global.cache-dir", Value: "/tmp/cache", Level: toml.Key{"defaults"}, Message: "is ignored because of restic.global.no-cache"},
+				{Severity: config.SeverityWarning, Store: "things", Destination: "bar", Key: "restic.global.repo", Value: "elsewhere", Level: toml.Key{"defaults"}, Message: "overrides the path of the destination"},
+				{Severity: config.SeverityError, Store: "things", Destination: "bar", Key: "restic.global.repository-file", Value: "repo.txt", Level: toml.Key{"datastores", "things", "destinations", "bar", "defaults"}, Message: "conflicts with the path of the destination"},
+				{Severity: config.SeverityWarning, Store: "things", Destination: "bar", Key: "restic.global.password-command", Value: "pass show", Level: toml.Key{"defaults"}, Message: "overrides the password-command generated from password-config"},
+				{Severity: config.SeverityError, Store: "things", Destination: "bar", Key: "restic.global.password-file", Value: "secret.txt", Level: toml.Key{"datastores", "things", "destinations", "bar", "defaults"}, Message: "conflicts with password-command"},
+				{Severity: config.SeverityError, Store: "things", Destination: "bar", Key: "restic.check.read-data-subset", Value: "1/5", Level: toml.Key{"defaults"}, Message: "conflicts with restic.check.read-data"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := config.Parse(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := config.ValidateResolved(resolved.Datastores())
+			if diff := cmp.Diff(got, test.expected); diff != "" {
+				t.Errorf("wrong Problems (- means something in actual) (+ means something in expected)\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("resolved levels", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(`
+[defaults.restic.global]
+compression = 'max'
+
+[hosts.web.defaults.restic.global]
+verbose = 3
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[profiles.fast.datastores.stuff.destinations.foo.defaults.restic.global]
+compression = 'quickest'
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{Hostname: "web", Profile: "fast"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := config.ValidateResolved(resolved.Datastores())
+		expected := config.Problems{
+			{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.global.compression", Value: "quickest", Level: toml.Key{"profiles", "fast", "datastores", "stuff", "destinations", "foo", "defaults"}, Message: `should be one of ["auto" "off" "max" "fastest" "better"]`},
+			{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.global.verbose", Value: 3, Level: toml.Key{"hosts", "web", "defaults"}, Message: "should be at most 2"},
+		}
+		if diff := cmp.Diff(got, expected); diff != "" {
+			t.Errorf("wrong Problems (- means something in actual) (+ means something in expected)\n%s", diff)
+		}
+	})
+
+	t.Run("no side effects", func(t *testing.T) {
+		params, err := config.Parse(strings.NewReader(`
+[defaults.restic.global]
+compression = 'maximum'
+
+[datastores.stuff.defaults.restic.global]
+verbose = 1
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.stuff.destinations.foo.defaults.restic.global]
+cache-dir = '/tmp/cache'
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Merging a destination to validate it should not fill in the values
+		// of its Datastore or of itself. Otherwise, validating again would
+		// report a value at the wrong level.
+		expected := config.Problems{
+			{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.global.compression", Value: "maximum", Level: toml.Key{"defaults"}, Message: `should be one of ["auto" "off" "max" "fastest" "better"]`},
+		}
+		for i := 0; i < 2; i++ {
+			if diff := cmp.Diff(config.ValidateResolved(resolved.Datastores()), expected); diff != "" {
+				t.Errorf("wrong Problems at %d (- means something in actual) (+ means something in expected)\n%s", i, diff)
+			}
+		}
+		testResticConfig(t, "store", params.Datastores["stuff"].Defaults.Restic.Global, &config.ResticGlobal{Verbose: pointTo(1)})
+		testResticConfig(t, "destination", params.Datastores["stuff"].Destinations["foo"].Defaults.Restic.Global, &config.ResticGlobal{CacheDir: pointTo("/tmp/cache")})
+	})
+
+	t.Run("for subcommand", func(t *testing.T) {
+		problems := config.Problems{
+			{Severity: config.SeverityError, Key: "restic.global.compression", Message: "global"},
+			{Severity: config.SeverityError, Key: "restic.backup.time", Message: "backup"},
+			{Severity: config.SeverityError, Key: "restic.check.read-data-subset", Message: "check"},
+			{Severity: config.SeverityError, Key: "timeout.backup", Message: "backup timeout"},
+			{Severity: config.SeverityError, Key: "timeout.unlock", Message: "unlock timeout"},
+		}
+		tests := []struct {
+			subcmd   string
+			expected []string
+		}{
+			{subcmd: "backup", expected: []string{"global", "backup", "backup timeout"}},
+			{subcmd: "check", expected: []string{"global", "check"}},
+			{subcmd: "unlock", expected: []string{"unlock timeout"}},
+			{subcmd: "prune", expected: nil},
+		}
+		for _, test := range tests {
+			var got []string
+			for _, problem := range problems.ForSubcommand(test.subcmd) {
+				got = append(got, problem.Message)
+			}
+			testStrings(t, test.subcmd, got, test.expected)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		problems := config.Problems{{Severity: config.SeverityError, Store: "stuff", Destination: "foo", Key: "restic.stats.mode", Value: "rawdata", Level: toml.Key{"defaults"}, Message: "should be one of [...]"}}
+		const expected = `invalid config values (1): datastores.stuff.destinations.foo: restic.stats.mode = "rawdata" should be one of [...]; set in [defaults]`
+		if got := problems.Error(); got != expected {
+			t.Errorf("wrong message\ngot %s\nexp %s", got, expected)
+		}
+	})
+}
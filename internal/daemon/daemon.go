@@ -0,0 +1,429 @@
+// Package daemon runs restic subcommands per the schedules in the
+// configuration file, in a long-running process.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+	"github.com/rafaelespinoza/wrestic/internal/schedule"
+)
+
+// Daemon runs scheduled restic subcommands upon datastores. A destination is
+// never operated upon by more than one subcommand at a time; if a destination
+// is still busy when another subcommand is due, then that destination is
+// skipped until the next time the subcommand is due.
+type Daemon struct {
+	// Load reads the configuration. It's called upon start and upon reload.
+	Load func() (config.Resolved, error)
+	// NewBatch prepares a ResticBatch to run subcmd, for the config of
+	// Resolved.Params.
+	NewBatch func(params config.Params, subcmd string) exec.ResticBatch
+	// Subcommands are the names of subcommands that may be scheduled.
+	Subcommands []string
+	// Watch is optional. It's the names of files to check for changes every
+	// PollInterval, such as a config file that may appear later. The Files and
+	// Dirs of the loaded config are checked too, see config.Params. A change to
+	// any of them triggers a reload, and so does one of them appearing or
+	// disappearing.
+	Watch        []string
+	PollInterval time.Duration
+	// History is how many finished runs to remember. If 0, then a default is
+	// used.
+	History int
+	// Log is optional. It captures messages about the Daemon's progress.
+	Log io.Writer
+	// Now is optional, it's mostly useful for testing.
+	Now func() time.Time
+
+	mtx      sync.Mutex
+	ctx      context.Context // ctx is the one passed to Run. It's used for triggered runs.
+	wg       sync.WaitGroup
+	resolved config.Resolved
+	running  map[string]bool
+	runs     []*Run
+	prevRuns int
+}
+
+// ErrNotRunning is returned when a Daemon isn't running.
+var ErrNotRunning = errors.New("daemon is not running")
+
+// ErrBusy is returned when every requested destination is already busy.
+var ErrBusy = errors.New("every destination is busy")
+
+// Run loops until ctx is done, starting subcommands when they're due. The
+// configuration is reloaded whenever something is received from reload. Upon
+// return, the Daemon waits for any running subcommands to finish. Since ctx is
+// passed along to each running subcommand, they should also be stopping.
+func (d *Daemon) Run(ctx context.Context, reload <-chan struct{}) (err error) {
+	defer d.wg.Wait()
+
+	resolved, jobs, err := d.load()
+	if err != nil {
+		return
+	}
+	next := d.nextTimes(jobs)
+
+	d.mtx.Lock()
+	d.ctx, d.resolved = ctx, resolved
+	d.mtx.Unlock()
+
+	var pollC <-chan time.Time
+	watch := d.watched(resolved)
+	lastMod := modTimes(watch)
+	if len(watch) > 0 {
+		interval := d.PollInterval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pollC = ticker.C
+	}
+
+	for {
+		var (
+			timer  *time.Timer
+			timerC <-chan time.Time
+		)
+		if wake, ok := earliest(next); ok {
+			timer = time.NewTimer(wake.Sub(d.now()))
+			timerC = timer.C
+		}
+
+		reloadNow := false
+		select {
+		case <-ctx.Done():
+			d.logf("stopping, waiting for running subcommands to finish")
+		case <-reload:
+			reloadNow = true
+		case <-pollC:
+			// A file may have been added to one of the Dirs, even since a
+			// reload that failed, so look again.
+			watch = d.watched(resolved)
+			if mod := modTimes(watch); !equalTimes(mod, lastMod) {
+				lastMod, reloadNow = mod, true
+			}
+		case <-timerC:
+			now := d.now()
+			for i, job := range jobs {
+				if next[i].IsZero() || next[i].After(now) {
+					continue
+				}
+				_, err := d.start(TriggerSchedule, job.Subcommand, []string{job.Store}, nil, nil)
+				if err != nil {
+					d.logf("skipping %s for store %q: %v", job.Subcommand, job.Store, err)
+				}
+				next[i] = job.Spec.Next(now)
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if reloadNow {
+			if newResolved, newJobs, err := d.load(); err != nil {
+				d.logf("reload failed, keeping previous configuration: %v", err)
+			} else {
+				d.logf("reloaded configuration")
+				resolved, jobs, next = newResolved, newJobs, d.nextTimes(newJobs)
+				// The config may now be in other files, such as a new include.
+				watch = d.watched(resolved)
+				lastMod = modTimes(watch)
+				d.mtx.Lock()
+				d.resolved = newResolved
+				d.mtx.Unlock()
+			}
+		}
+	}
+}
+
+// Datastores selects from the current configuration, like
+// config.Resolved.Select.
+func (d *Daemon) Datastores(storenames, destnames []string) []config.ResolvedDatastore {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return d.resolved.Select(storenames, destnames)
+}
+
+// Preview outputs what restic would be invoked with, if subcmd were triggered.
+func (d *Daemon) Preview(subcmd string, storenames, destnames, args []string) ([]exec.Invocation, error) {
+	if err := d.checkSubcommand(subcmd); err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	resolved := d.resolved
+	d.mtx.Unlock()
+
+	batch := d.NewBatch(resolved.Params(), subcmd)
+	batch.Args = args
+	return batch.Preview(resolved.Select(storenames, destnames))
+}
+
+// Trigger starts subcmd right away, in the background, upon the selected
+// destinations that aren't already busy. If every selected destination is
+// busy, then the error is ErrBusy.
+func (d *Daemon) Trigger(subcmd string, storenames, destnames, args []string) (out Run, err error) {
+	if err = d.checkSubcommand(subcmd); err != nil {
+		return
+	}
+
+	return d.start(TriggerRequest, subcmd, storenames, destnames, args)
+}
+
+// Runs outputs the running and recently-finished runs, oldest first.
+func (d *Daemon) Runs() []Run {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	out := make([]Run, len(d.runs))
+	for i, run := range d.runs {
+		out[i] = run.copy()
+	}
+	return out
+}
+
+func (d *Daemon) checkSubcommand(subcmd string) error {
+	for _, known := range d.Subcommands {
+		if subcmd == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown subcommand %q, should be one of %q", subcmd, d.Subcommands)
+}
+
+func (d *Daemon) load() (resolved config.Resolved, jobs []schedule.Job, err error) {
+	if resolved, err = d.Load(); err != nil {
+		return
+	}
+
+	var datastores []config.Datastore
+	for _, store := range resolved.Datastores() {
+		datastores = append(datastores, store.Datastore())
+	}
+	jobs, err = schedule.Jobs(datastores, d.Subcommands, "", "")
+	if err != nil {
+		return
+	}
+
+	for _, job := range jobs {
+		d.logf("scheduled %s for store %q, %q", job.Subcommand, job.Store, job.Spec)
+	}
+	if len(jobs) < 1 {
+		d.logf("nothing is scheduled")
+	}
+	return
+}
+
+func (d *Daemon) nextTimes(jobs []schedule.Job) []time.Time {
+	now := d.now()
+	out := make([]time.Time, len(jobs))
+	for i, job := range jobs {
+		out[i] = job.Spec.Next(now)
+	}
+	return out
+}
+
+// start runs subcmd in the background, upon every selected destination that
+// isn't already busy.
+func (d *Daemon) start(trigger, subcmd string, storenames, destnames, args []string) (out Run, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.ctx == nil || d.ctx.Err() != nil {
+		err = ErrNotRunning
+		return
+	}
+	if d.running == nil {
+		d.running = make(map[string]bool)
+	}
+
+	selected := d.resolved.Select(storenames, destnames)
+	run := &Run{ID: d.prevRuns + 1, Subcommand: subcmd, Trigger: trigger, Status: StatusRunning, Started: d.now()}
+
+	var datastores []config.ResolvedDatastore
+	for _, store := range selected {
+		var free []string
+		for _, dest := range store.Destinations() {
+			if d.running[runningKey(store.Name(), dest.Name())] {
+				d.logf("skipping %s for store %q, destination %q; it's still busy", subcmd, store.Name(), dest.Name())
+				continue
+			}
+			free = append(free, dest.Name())
+			run.Destinations = append(run.Destinations, DestinationRun{Store: store.Name(), Destination: dest.Name(), Status: StatusPending})
+		}
+
+		if len(free) > 0 {
+			datastores = append(datastores, d.resolved.Select([]string{store.Name()}, free)...)
+		}
+	}
+
+	if len(run.Destinations) < 1 {
+		err = ErrBusy
+		return
+	}
+
+	for _, dest := range run.Destinations {
+		d.running[runningKey(dest.Store, dest.Destination)] = true
+	}
+	d.prevRuns++
+	d.runs = append(d.runs, run)
+	d.trimRuns()
+
+	batch := d.NewBatch(d.resolved.Params(), subcmd)
+	batch.Args = args
+	batch.Observer = exec.MultiObserver(batch.Observer, &runObserver{d: d, run: run})
+	ctx := d.ctx
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		d.logf("starting %s (run %d)", subcmd, run.ID)
+		_, err := batch.Do(ctx, datastores)
+
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+
+		for i, dest := range run.Destinations {
+			delete(d.running, runningKey(dest.Store, dest.Destination))
+			if dest.Status == StatusPending {
+				run.Destinations[i].Status = StatusSkipped
+			}
+		}
+		run.Finished = d.now()
+		if err != nil {
+			run.Status, run.Err = StatusFailed, err.Error()
+			d.logf("%s (run %d) failed: %v", subcmd, run.ID, err)
+		} else {
+			run.Status = StatusSucceeded
+			d.logf("finished %s (run %d)", subcmd, run.ID)
+		}
+	}()
+
+	out = run.copy()
+	return
+}
+
+// trimRuns forgets the oldest finished runs beyond the History limit. Running
+// runs are always kept.
+func (d *Daemon) trimRuns() {
+	limit := d.History
+	if limit <= 0 {
+		limit = 50
+	}
+
+	var finished int
+	for _, run := range d.runs {
+		if run.Status != StatusRunning {
+			finished++
+		}
+	}
+
+	kept := d.runs[:0]
+	for _, run := range d.runs {
+		if run.Status != StatusRunning && finished > limit {
+			finished--
+			continue
+		}
+		kept = append(kept, run)
+	}
+	d.runs = kept
+}
+
+func runningKey(store, dest string) string { return store + "/" + dest }
+
+func (d *Daemon) now() time.Time {
+	if d.Now != nil {
+		return d.Now()
+	}
+	return time.Now()
+}
+
+func (d *Daemon) logf(format string, args ...any) {
+	if d.Log != nil {
+		fmt.Fprintf(d.Log, "daemon: "+format+"\n", args...)
+	}
+}
+
+func earliest(times []time.Time) (out time.Time, ok bool) {
+	for _, t := range times {
+		if t.IsZero() {
+			continue
+		}
+		if !ok || t.Before(out) {
+			out, ok = t, true
+		}
+	}
+	return
+}
+
+// modTimes outputs the modification time of each file. It's the zero value for
+// a file that doesn't exist.
+// watched outputs the names in Watch, and then the Files and Dirs of resolved,
+// along with the files in each of the Dirs, without repeats.
+func (d *Daemon) watched(resolved config.Resolved) (out []string) {
+	params := resolved.Params()
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name = filepath.Clean(name); !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+
+	for _, names := range [][]string{d.Watch, params.Files, params.Dirs} {
+		for _, name := range names {
+			add(name)
+		}
+	}
+	for _, dir := range params.Dirs {
+		// A directory that can't be read right now is still watched itself.
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				add(filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return
+}
+
+func modTimes(filenames []string) (out []time.Time) {
+	out = make([]time.Time, len(filenames))
+	for i, filename := range filenames {
+		// If the file can't be read right now, then let the next reload report
+		// it.
+		if info, err := os.Stat(filename); err == nil {
+			out[i] = info.ModTime()
+		}
+	}
+	return
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,313 @@
+package daemon_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/daemon"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+)
+
+func TestDaemon(t *testing.T) {
+	const input = `
+[datastores.stuff.schedule]
+backup = '* * * * *'
+check = '* * * * *'
+
+[datastores.stuff.destinations.alfa]
+path = 'alfa'
+
+[datastores.stuff.destinations.bravo]
+path = 'bravo'
+`
+
+	var (
+		mtx      sync.Mutex
+		loads    int
+		received []string
+		started  = make(chan struct{}, 10)
+	)
+
+	// Pretend that it's nearly the start of the next minute, so that things
+	// scheduled for every minute are due very soon.
+	realNow := time.Now()
+	offset := realNow.Truncate(time.Minute).Add(time.Minute - 100*time.Millisecond).Sub(realNow)
+
+	d := daemon.Daemon{
+		Load: func() (config.Resolved, error) {
+			mtx.Lock()
+			loads++
+			mtx.Unlock()
+			return resolve(config.Parse(strings.NewReader(input)))
+		},
+		NewBatch: func(params config.Params, subcmd string) exec.ResticBatch {
+			return exec.ResticBatch{
+				Subcommand: subcmd,
+				Run:        true,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						mtx.Lock()
+						received = append(received, args[0]+" "+args[1])
+						mtx.Unlock()
+						started <- struct{}{}
+
+						// Stay busy until the daemon is stopped.
+						<-ctx.Done()
+						return ctx.Err()
+					}}
+				},
+			}
+		},
+		Subcommands: []string{"backup", "check"},
+		Now:         func() time.Time { return time.Now().Add(offset) },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, reload) }()
+
+	reload <- struct{}{}
+
+	// The backup subcommand runs upon each destination, one after another. So
+	// only 1 destination is busy at this point.
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for subcommand to start")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Both destinations were claimed by the backup subcommand, so the check
+	// subcommand should have been skipped. Once the context was canceled, the
+	// backup subcommand should not have continued onto the next destination.
+	if len(received) != 1 {
+		t.Fatalf("wrong number of received args; got %d, expected %d\n%q", len(received), 1, received)
+	}
+	if got := received[0]; got != "backup --repo=alfa" && got != "backup --repo=bravo" {
+		t.Errorf("wrong received args %q", got)
+	}
+
+	if loads != 2 {
+		t.Errorf("wrong number of loads; got %d, expected %d", loads, 2)
+	}
+}
+
+type Command struct {
+	RunResp func(ctx context.Context, args ...string) error
+}
+
+func (c *Command) Run(ctx context.Context, args ...string) error { return c.RunResp(ctx, args...) }
+
+func TestDaemonTrigger(t *testing.T) {
+	const input = `
+[datastores.stuff.destinations.alfa]
+path = 'alfa'
+
+[datastores.things.destinations.bravo]
+path = 'bravo'
+`
+
+	release := make(chan struct{})
+	d := daemon.Daemon{
+		Load: func() (config.Resolved, error) { return resolve(config.Parse(strings.NewReader(input))) },
+		NewBatch: func(params config.Params, subcmd string) exec.ResticBatch {
+			return exec.ResticBatch{
+				Subcommand: subcmd,
+				Run:        true,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						<-release
+						if args[1] == "--repo=bravo" {
+							return errors.New("oops")
+						}
+						return nil
+					}}
+				},
+			}
+		},
+		Subcommands: []string{"backup", "check"},
+	}
+
+	if _, err := d.Trigger("backup", nil, nil, nil); !errors.Is(err, daemon.ErrNotRunning) {
+		t.Fatalf("expected error %v, got %v", daemon.ErrNotRunning, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, nil) }()
+
+	var (
+		run daemon.Run
+		err error
+	)
+	for i := 0; i < 100; i++ {
+		if run, err = d.Trigger("backup", nil, nil, []string{"--tag=manual"}); !errors.Is(err, daemon.ErrNotRunning) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.ID != 1 || run.Trigger != daemon.TriggerRequest || run.Status != daemon.StatusRunning || len(run.Destinations) != 2 {
+		t.Errorf("unexpected run %#v", run)
+	}
+
+	if _, err = d.Trigger("check", []string{"stuff"}, nil, nil); !errors.Is(err, daemon.ErrBusy) {
+		t.Errorf("expected error %v, got %v", daemon.ErrBusy, err)
+	}
+	if _, err = d.Trigger("prune", nil, nil, nil); err == nil {
+		t.Error("expected an error for an unknown subcommand")
+	}
+
+	preview, err := d.Preview("check", []string{"things"}, nil, []string{"--read-data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview) != 1 || strings.Join(preview[0].Args, " ") != "check --repo=bravo --read-data" {
+		t.Errorf("unexpected preview %#v", preview)
+	}
+
+	close(release)
+
+	var runs []daemon.Run
+	for i := 0; i < 100; i++ {
+		if runs = d.Runs(); len(runs) == 1 && runs[0].Status != daemon.StatusRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(runs) != 1 {
+		t.Fatalf("wrong number of runs; got %d, expected %d", len(runs), 1)
+	}
+	if runs[0].Status != daemon.StatusFailed {
+		t.Errorf("wrong Status; got %q, expected %q", runs[0].Status, daemon.StatusFailed)
+	}
+
+	expected := map[string]string{
+		"stuff/alfa":   daemon.StatusSucceeded,
+		"things/bravo": daemon.StatusFailed,
+	}
+	for _, dest := range runs[0].Destinations {
+		if got, exp := dest.Status, expected[dest.Store+"/"+dest.Destination]; got != exp {
+			t.Errorf("wrong Status for %s/%s; got %q, expected %q", dest.Store, dest.Destination, got, exp)
+		}
+	}
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemonWatch(t *testing.T) {
+	dir := t.TempDir()
+	user, system := filepath.Join(dir, "user.toml"), filepath.Join(dir, "system.toml")
+	if err := os.WriteFile(user, []byte("[datastores.stuff.destinations.alfa]\npath = 'alfa'\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loads := make(chan struct{}, 10)
+	d := daemon.Daemon{
+		Load: func() (config.Resolved, error) {
+			// Only the first few loads are waited for.
+			select {
+			case loads <- struct{}{}:
+			default:
+			}
+			return resolve(config.Load(user))
+		},
+		NewBatch: func(params config.Params, subcmd string) exec.ResticBatch {
+			return exec.ResticBatch{Subcommand: subcmd}
+		},
+		Subcommands:  []string{"backup"},
+		Watch:        []string{user, system},
+		PollInterval: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, nil) }()
+
+	waitForLoad := func(what string) {
+		t.Helper()
+		select {
+		case <-loads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a load %s", what)
+		}
+	}
+	waitForLoad("upon start")
+
+	// The system-wide config file doesn't exist at first, so creating it is a
+	// change.
+	if err := os.WriteFile(system, []byte("[defaults]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForLoad("after creating the system-wide config file")
+
+	// So are the files that the config is loaded from, and the directory of
+	// more config files beside it, though they aren't in Watch.
+	confDir := filepath.Join(dir, config.ConfDir)
+	if err := os.Mkdir(confDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	waitForLoad("after creating the conf dir")
+
+	// A reload may happen while a file is partly written, and fail. The file
+	// is still watched, so the next change to it is seen.
+	waitForDestinations := func(what string, expected int) {
+		t.Helper()
+		for i := 0; i < 500; i++ {
+			if stores := d.Datastores([]string{"more"}, nil); len(stores) == 1 && len(stores[0].Destinations()) == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d destinations %s", expected, what)
+	}
+	more := filepath.Join(confDir, "more.toml")
+	if err := os.WriteFile(more, []byte("[datastores.more.destinations.bravo]\npath = 'bravo'\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForDestinations("after adding a file to the conf dir", 1)
+
+	if err := os.WriteFile(more, []byte("[datastores.more.destinations.bravo]\npath = 'bravo'\n[datastores.more.destinations.charlie]\npath = 'charlie'\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is seen, even if the file system's times are
+	// coarse.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(more, later, later); err != nil {
+		t.Fatal(err)
+	}
+	waitForDestinations("after changing a file in the conf dir", 2)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resolve passes along the output of config.Parse or config.Load to
+// config.Resolve.
+func resolve(params config.Params, err error) (config.Resolved, error) {
+	if err != nil {
+		return config.Resolved{}, err
+	}
+	return config.Resolve([]config.Params{params}, config.ResolveOptions{})
+}
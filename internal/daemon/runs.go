@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+)
+
+// Run is a restic subcommand started by the Daemon, upon one or more
+// destinations.
+type Run struct {
+	ID         int    `json:"id"`
+	Subcommand string `json:"subcommand"`
+	// Trigger says why the Run started, it's one of TriggerSchedule or
+	// TriggerRequest.
+	Trigger      string           `json:"trigger"`
+	Status       string           `json:"status"`
+	Started      time.Time        `json:"started"`
+	Finished     time.Time        `json:"finished"`
+	Err          string           `json:"error,omitempty"`
+	Destinations []DestinationRun `json:"destinations"`
+}
+
+// DestinationRun is the progress of a Run upon one destination.
+type DestinationRun struct {
+	Store       string    `json:"store"`
+	Destination string    `json:"destination"`
+	Status      string    `json:"status"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Err         string    `json:"error,omitempty"`
+}
+
+// These are values for Run.Trigger.
+const (
+	TriggerSchedule = "schedule"
+	TriggerRequest  = "request"
+)
+
+// These are values for the Status of a Run or DestinationRun.
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+	// StatusWarning is only for a DestinationRun. It means that restic
+	// finished, but not everything went well. See exec.OutcomeWarning.
+	StatusWarning = "warning"
+)
+
+func (r *Run) copy() (out Run) {
+	out = *r
+	out.Destinations = make([]DestinationRun, len(r.Destinations))
+	copy(out.Destinations, r.Destinations)
+	return
+}
+
+// runObserver updates the progress of a Run.
+type runObserver struct {
+	d   *Daemon
+	run *Run
+}
+
+func (o *runObserver) Observe(_ context.Context, event exec.Event) {
+	if event.Destination == nil {
+		return
+	}
+
+	o.d.mtx.Lock()
+	defer o.d.mtx.Unlock()
+
+	for i, dest := range o.run.Destinations {
+		if dest.Store != event.Store.Name() || dest.Destination != event.Destination.Name() {
+			continue
+		}
+
+		switch event.Kind {
+		case exec.EventStart:
+			o.run.Destinations[i].Status, o.run.Destinations[i].Started = StatusRunning, event.Time
+		case exec.EventFinish:
+			o.run.Destinations[i].Finished = event.Time
+			if event.Outcome == exec.OutcomeWarning {
+				o.run.Destinations[i].Status, o.run.Destinations[i].Err = StatusWarning, event.Err.Error()
+			} else if event.Err != nil {
+				o.run.Destinations[i].Status, o.run.Destinations[i].Err = StatusFailed, event.Err.Error()
+			} else {
+				o.run.Destinations[i].Status = StatusSucceeded
+			}
+		case exec.EventSkip:
+			o.run.Destinations[i].Status, o.run.Destinations[i].Err = StatusSkipped, event.Err.Error()
+		}
+		return
+	}
+}
@@ -3,17 +3,108 @@ package exec
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/rafaelespinoza/wrestic/internal/config"
 )
 
-func (b ResticBatch) buildArgs(dest config.Destination, srcPaths ...config.Source) ([]string, error) {
-	tuples, err := dest.BuildFlags(b.ConfigDir, b.Subcommand)
+func (b ResticBatch) buildArgs(dest config.ResolvedDestination, srcPaths ...config.Source) ([]string, error) {
+	tuples, err := dest.BuildFlags(b.Subcommand)
 	if err != nil {
 		return nil, err
 	}
 
+	tuples, _ = b.overrideFlags(tuples)
+	return b.formatArgs(tuples, srcPaths...), nil
+}
+
+// overrideFlags leaves out the members of flags that are also in the Args, if
+// restic would only use one of them. A flag that may be repeated is kept, so
+// that the values in Args are in addition to it. The names of the flags that
+// were left out are also output.
+func (b ResticBatch) overrideFlags(flags []config.Flag) (out []config.Flag, overridden []string) {
+	inArgs := argFlags(b.Args, config.FlagKinds(b.Subcommand))
+	if len(inArgs) < 1 {
+		out = flags
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, flag := range flags {
+		kind, ok := inArgs[flag.Key]
+		if !ok || kind == config.FlagRepeatable {
+			out = append(out, flag)
+			continue
+		}
+
+		if !seen[flag.Key] {
+			seen[flag.Key] = true
+			overridden = append(overridden, flag.Key)
+		}
+	}
+	return
+}
+
+// warnOverridden writes a warning for each flag that identifies the restic
+// repository, or how to open it, which is overridden by the Args.
+func (b ResticBatch) warnOverridden(store config.ResolvedDatastore, dest config.ResolvedDestination, overridden []string) {
+	for _, key := range overridden {
+		switch key {
+		case "repo", "password-command":
+			b.printf("# warning: --%s from args overrides the one for store=%q, destination=%q\n", key, store.Name(), dest.Name())
+		}
+	}
+}
+
+// shortFlags maps the short names of global restic flags to long names.
+var shortFlags = map[string]string{
+	"o": "option",
+	"p": "password-file",
+	"q": "quiet",
+	"r": "repo",
+	"v": "verbose",
+}
+
+// argFlags finds the known restic flags in args, and outputs their kinds. A
+// flag is known if it's in kinds, or it's one of the shortFlags. Arguments
+// after "--" are not flags.
+func argFlags(args []string, kinds map[string]config.FlagKind) (out map[string]config.FlagKind) {
+	out = make(map[string]config.FlagKind)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "--") {
+			long, ok := shortFlags[name]
+			if !ok {
+				continue
+			}
+			name = long
+		}
+
+		kind, ok := kinds[name]
+		if !ok {
+			continue
+		}
+		out[name] = kind
+
+		if !hasValue && kind != config.FlagSwitch {
+			i++ // The next argument is the value.
+		}
+	}
+
+	return
+}
+
+func (b ResticBatch) formatArgs(tuples []config.Flag, srcPaths ...config.Source) []string {
 	out := []string{b.Subcommand}
 	for _, tuple := range tuples {
 		out = append(out, fmt.Sprintf("--%s=%s", tuple.Key, tuple.Val))
@@ -31,7 +122,60 @@ func (b ResticBatch) buildArgs(dest config.Destination, srcPaths ...config.Sourc
 		}
 	}
 
-	return out, nil
+	return out
+}
+
+// Invocation is what restic would be invoked with for one destination.
+type Invocation struct {
+	Store       string `json:"store"`
+	Destination string `json:"destination"`
+	// Bin is the restic executable, see ResticBin.
+	Bin  string   `json:"bin"`
+	Args []string `json:"args"`
+	// Warnings are the problems with the config of the destination, see
+	// config.Problems.ForSubcommand.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Preview generates the arguments for invoking restic upon each destination,
+// without running anything. The output is sorted by store name and then by
+// destination name. Like Do, the configuration is validated first, but each
+// problem, even an error, is only a warning of the Invocation it applies to.
+func (b ResticBatch) Preview(datastores []config.ResolvedDatastore) (out []Invocation, err error) {
+	warnings := make(map[[2]string][]string)
+	for _, problem := range config.ValidateResolved(datastores).ForSubcommand(b.Subcommand) {
+		b.printf("# warning: %s\n", problem)
+		key := [2]string{problem.Store, problem.Destination}
+		warnings[key] = append(warnings[key], problem.String())
+	}
+
+	for _, store := range datastores {
+		for _, dest := range store.Destinations() {
+			args, err := b.buildArgs(dest, store.Sources()...)
+			if err != nil {
+				return nil, fmt.Errorf("%w: store=%q, destination=%q", err, store.Name(), dest.Name())
+			}
+			defaults, err := dest.Merge()
+			if err != nil {
+				return nil, fmt.Errorf("%w: store=%q, destination=%q", err, store.Name(), dest.Name())
+			}
+			out = append(out, Invocation{
+				Store:       store.Name(),
+				Destination: dest.Name(),
+				Bin:         ResticBin(defaults),
+				Args:        args,
+				Warnings:    warnings[[2]string{store.Name(), dest.Name()}],
+			})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Store != out[j].Store {
+			return out[i].Store < out[j].Store
+		}
+		return out[i].Destination < out[j].Destination
+	})
+	return
 }
 
 func printArgs(w io.Writer, args ...string) {
@@ -0,0 +1,92 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/version"
+)
+
+// A BinSetter is a Command whose executable may be chosen per destination,
+// before it runs.
+type BinSetter interface {
+	SetBin(bin string)
+}
+
+// ResticBin outputs the restic executable to run, given a destination's merged
+// defaults. It's the restic-bin value when specified. Otherwise, it's the
+// value of the environment variable, RESTIC_BIN, or just "restic", which is
+// looked up in PATH.
+func ResticBin(defaults config.Defaults) string {
+	if defaults.ResticBin != nil && *defaults.ResticBin != "" {
+		return *defaults.ResticBin
+	}
+	return defaultResticBin()
+}
+
+func defaultResticBin() string {
+	// Optionally, check for alternate restic binaries. The main use case is for
+	// running a different version of restic. But tests could also use this env
+	// var for sanity checking application behavior in a controlled manner.
+	if val := os.Getenv("RESTIC_BIN"); val != "" {
+		return val
+	}
+	return "restic"
+}
+
+// ProbeResticVersion runs "restic version" with the executable, bin, and reads
+// the version from the output.
+func ProbeResticVersion(ctx context.Context, bin string) (out version.Version, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, "version")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err = cmd.Run(); err != nil {
+		err = fmt.Errorf("%w: could not probe version of %q; %s", err, bin, bytes.TrimSpace(stderr.Bytes()))
+		return
+	}
+
+	return version.ParseResticOutput(stdout.String())
+}
+
+// probedVersion is the outcome of probing the version of a restic executable.
+type probedVersion struct {
+	version version.Version
+	err     error
+}
+
+// resticVersion probes the version of bin, once per batch.
+func (b ResticBatch) resticVersion(ctx context.Context, bin string) (version.Version, error) {
+	if probed, ok := b.versions[bin]; ok {
+		return probed.version, probed.err
+	}
+
+	probe := b.ProbeVersion
+	if probe == nil {
+		probe = ProbeResticVersion
+	}
+
+	var probed probedVersion
+	probed.version, probed.err = probe(ctx, bin)
+	if b.versions != nil && ctx.Err() == nil {
+		b.versions[bin] = probed
+	}
+	return probed.version, probed.err
+}
+
+// checkVersion ensures that the version of bin satisfies the constraint.
+func (b ResticBatch) checkVersion(ctx context.Context, bin string, constraint version.Constraint) error {
+	got, err := b.resticVersion(ctx, bin)
+	if err != nil {
+		return err
+	}
+
+	if !constraint.Check(got) {
+		return fmt.Errorf("version %s of %q does not satisfy restic-version %q", got, bin, constraint)
+	}
+	return nil
+}
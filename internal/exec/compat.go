@@ -0,0 +1,145 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/version"
+)
+
+// ErrUnsupportedFlags means that a configured flag is not supported by the
+// version of the restic executable that would run.
+var ErrUnsupportedFlags = errors.New("unsupported flags")
+
+// unsupportedFlagsMode reads the unsupported-flags config value.
+func unsupportedFlagsMode(defaults config.Defaults) (out string, err error) {
+	out = config.UnsupportedFlagsFail
+	if defaults.UnsupportedFlags == nil {
+		return
+	}
+
+	switch *defaults.UnsupportedFlags {
+	case config.UnsupportedFlagsFail, config.UnsupportedFlagsDrop:
+		out = *defaults.UnsupportedFlags
+	default:
+		err = fmt.Errorf("invalid unsupported-flags %q, should be one of %q", *defaults.UnsupportedFlags, []string{config.UnsupportedFlagsFail, config.UnsupportedFlagsDrop})
+	}
+	return
+}
+
+// unsupportedFlags outputs the names of the flags, sorted, that the restic
+// executable, bin, does not support. The version of bin is only probed when
+// some member of flags has a minimum version.
+func (b ResticBatch) unsupportedFlags(ctx context.Context, bin string, flags []config.Flag) (out []string, got version.Version, err error) {
+	minimums := config.FlagVersions(b.Subcommand)
+
+	var needsProbe bool
+	for _, flag := range flags {
+		if _, ok := minimums[flag.Key]; ok {
+			needsProbe = true
+			break
+		}
+	}
+	if !needsProbe {
+		return
+	}
+
+	if got, err = b.resticVersion(ctx, bin); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, flag := range flags {
+		minimum, ok := minimums[flag.Key]
+		if !ok || seen[flag.Key] || got.Compare(minimum) >= 0 {
+			continue
+		}
+		seen[flag.Key] = true
+		out = append(out, flag.Key)
+	}
+	sort.Strings(out)
+	return
+}
+
+// compatibleFlags handles any members of flags that aren't supported by the
+// restic executable, bin. Depending on the unsupported-flags config value,
+// either it's an error or the unsupported flags are left out of the output.
+func (b ResticBatch) compatibleFlags(ctx context.Context, store config.ResolvedDatastore, dest config.ResolvedDestination, bin string, defaults config.Defaults, flags []config.Flag) (out []config.Flag, err error) {
+	mode, err := unsupportedFlagsMode(defaults)
+	if err != nil {
+		return
+	}
+
+	unsupported, got, err := b.unsupportedFlags(ctx, bin, flags)
+	if err != nil || len(unsupported) < 1 {
+		out = flags
+		return
+	}
+
+	if mode == config.UnsupportedFlagsFail {
+		err = unsupportedFlagsError(b.Subcommand, bin, got, unsupported)
+		return
+	}
+
+	b.printf("# dropping flags unsupported by restic %s, store=%q, destination=%q: %s\n", got, store.Name(), dest.Name(), formatFlagVersions(b.Subcommand, unsupported))
+	drop := make(map[string]bool, len(unsupported))
+	for _, key := range unsupported {
+		drop[key] = true
+	}
+	for _, flag := range flags {
+		if !drop[flag.Key] {
+			out = append(out, flag)
+		}
+	}
+	return
+}
+
+// checkFlags is for failing a batch early, before running restic upon any
+// destination, when a configured flag is not supported. Destinations that drop
+// unsupported flags are skipped, as are any other problems, which are reported
+// when restic would run upon the destination.
+func (b ResticBatch) checkFlags(ctx context.Context, datastores []config.ResolvedDatastore) error {
+	for _, store := range datastores {
+		for _, dest := range store.Destinations() {
+			defaults, err := dest.Merge()
+			if err != nil {
+				continue
+			}
+			if mode, err := unsupportedFlagsMode(defaults); err != nil || mode != config.UnsupportedFlagsFail {
+				continue
+			}
+
+			flags, err := dest.BuildFlags(b.Subcommand)
+			if err != nil {
+				continue
+			}
+			flags, _ = b.overrideFlags(flags)
+
+			bin := ResticBin(defaults)
+			unsupported, got, err := b.unsupportedFlags(ctx, bin, flags)
+			if err == nil && len(unsupported) > 0 {
+				return fmt.Errorf("%w: store=%q, destination=%q", unsupportedFlagsError(b.Subcommand, bin, got, unsupported), store.Name(), dest.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+func unsupportedFlagsError(subcmd, bin string, got version.Version, unsupported []string) error {
+	return fmt.Errorf("%w for version %s of %q: %s", ErrUnsupportedFlags, got, bin, formatFlagVersions(subcmd, unsupported))
+}
+
+func formatFlagVersions(subcmd string, keys []string) string {
+	minimums := config.FlagVersions(subcmd)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("--%s needs %s", key, minimums[key])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,159 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Outcome classifies the result of running restic upon a destination.
+type Outcome string
+
+// These Outcome values are derived from the exit code of restic.
+const (
+	// OutcomeSuccess means restic exited with 0.
+	OutcomeSuccess Outcome = "success"
+	// OutcomeWarning means that restic created a snapshot, but some source
+	// files could not be read. The exit code is 3.
+	OutcomeWarning Outcome = "warning"
+	// OutcomeRepoMissing means that the repository does not exist. The exit
+	// code is 10.
+	OutcomeRepoMissing Outcome = "repo-missing"
+	// OutcomeLockFailure means that restic could not lock the repository. The
+	// exit code is 11.
+	OutcomeLockFailure Outcome = "lock-failure"
+	// OutcomeTimeout means that restic was stopped because it reached the
+	// timeout configured for the subcommand.
+	OutcomeTimeout Outcome = "timeout"
+	// OutcomeFatal is any other failure.
+	OutcomeFatal Outcome = "fatal"
+)
+
+// These Outcome values describe destinations that restic did not run upon.
+const (
+	// OutcomeSkipped means that the destination was locked by another process
+	// and the lock mode was to skip it.
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeInterrupted means that the batch was interrupted before restic
+	// could run upon the destination.
+	OutcomeInterrupted Outcome = "interrupted"
+	// OutcomeBudgetExceeded means that the batch ran out of time before restic
+	// could run upon the destination.
+	OutcomeBudgetExceeded Outcome = "budget-exceeded"
+)
+
+// outcomeOrder is every Outcome, in the order of Result.Summary.
+var outcomeOrder = []Outcome{
+	OutcomeSuccess, OutcomeWarning, OutcomeRepoMissing, OutcomeLockFailure, OutcomeTimeout, OutcomeFatal,
+	OutcomeSkipped, OutcomeInterrupted, OutcomeBudgetExceeded,
+}
+
+// FailureOutcomes are the values of Outcome that may be used for
+// ResticBatch.FailOn.
+var FailureOutcomes = []Outcome{OutcomeWarning, OutcomeRepoMissing, OutcomeLockFailure, OutcomeTimeout, OutcomeFatal}
+
+// DefaultFailOn is used when ResticBatch.FailOn is empty.
+var DefaultFailOn = []Outcome{OutcomeRepoMissing, OutcomeLockFailure, OutcomeFatal}
+
+// ParseOutcomes converts each member of in to an Outcome. Each one must be a
+// member of FailureOutcomes.
+func ParseOutcomes(in []string) (out []Outcome, err error) {
+	for _, val := range in {
+		val = strings.TrimSpace(val)
+
+		var found bool
+		for _, outcome := range FailureOutcomes {
+			if Outcome(val) == outcome {
+				out, found = append(out, outcome), true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid outcome %q, should be one of %q", val, FailureOutcomes)
+		}
+	}
+
+	return
+}
+
+// Classify derives an Outcome from the error returned by running restic. A
+// context.DeadlineExceeded error is a timeout.
+func Classify(err error) Outcome {
+	if err == nil {
+		return OutcomeSuccess
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return OutcomeTimeout
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return OutcomeFatal
+	}
+
+	switch exitErr.ExitCode() {
+	case 3:
+		return OutcomeWarning
+	case 10:
+		return OutcomeRepoMissing
+	case 11:
+		return OutcomeLockFailure
+	default:
+		return OutcomeFatal
+	}
+}
+
+// Result is the outcome of running restic upon a batch of destinations.
+type Result struct {
+	// Destinations has an entry for each destination that restic ran upon, or
+	// that was skipped, in the order they were attempted.
+	Destinations []DestinationResult
+}
+
+// DestinationResult is the outcome of running restic upon one destination.
+type DestinationResult struct {
+	Store       string
+	Destination string
+	Outcome     Outcome
+	Err         error
+}
+
+// Count outputs how many destinations had outcome.
+func (r Result) Count(outcome Outcome) (n int) {
+	for _, dest := range r.Destinations {
+		if dest.Outcome == outcome {
+			n++
+		}
+	}
+	return
+}
+
+// Summary outputs how many destinations had each Outcome, such as
+// "2 success, 1 warning", ordered like the Outcome constants. An Outcome without
+// any destinations is omitted, so it's empty if there are no destinations.
+func (r Result) Summary() string {
+	var parts []string
+	for _, outcome := range outcomeOrder {
+		if n := r.Count(outcome); n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, outcome))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (b ResticBatch) failsOn(outcome Outcome) bool {
+	failOn := b.FailOn
+	if len(failOn) < 1 {
+		failOn = DefaultFailOn
+	}
+
+	for _, val := range failOn {
+		if outcome == val {
+			return true
+		}
+	}
+	return false
+}
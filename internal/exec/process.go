@@ -0,0 +1,108 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+// A ProcessSetter is a Command whose process may be configured per
+// destination, before it runs.
+type ProcessSetter interface {
+	SetProcess(conf config.ProcessConfig) error
+}
+
+// process is the parsed form of a config.ProcessConfig.
+type process struct {
+	nice   *int
+	ioprio int // ioprio is the value for the ioprio_set syscall. If 0, then it's not set.
+	env    []string
+}
+
+// I/O scheduling classes, per the ioprio_set syscall.
+const (
+	ioprioClassRealtime   = 1
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+
+	ioprioClassShift = 13
+)
+
+func parseProcess(conf config.ProcessConfig) (out process, err error) {
+	if conf.Nice != nil {
+		if *conf.Nice < -20 || *conf.Nice > 19 {
+			err = fmt.Errorf("process.nice %d is out of range, should be from -20 to 19", *conf.Nice)
+			return
+		}
+		out.nice = conf.Nice
+	}
+
+	if conf.IONice != nil && conf.IONice.Class != nil {
+		var class int
+		switch *conf.IONice.Class {
+		case config.IONiceClassRealtime:
+			class = ioprioClassRealtime
+		case config.IONiceClassBestEffort:
+			class = ioprioClassBestEffort
+		case config.IONiceClassIdle:
+			class = ioprioClassIdle
+		default:
+			err = fmt.Errorf(
+				"invalid process.ionice.class %q, should be one of %q",
+				*conf.IONice.Class, []string{config.IONiceClassRealtime, config.IONiceClassBestEffort, config.IONiceClassIdle},
+			)
+			return
+		}
+
+		level := 4
+		if conf.IONice.Level != nil {
+			level = *conf.IONice.Level
+		}
+		if level < 0 || level > 7 {
+			err = fmt.Errorf("process.ionice.level %d is out of range, should be from 0 to 7", level)
+			return
+		}
+		if class == ioprioClassIdle {
+			level = 0
+		}
+
+		out.ioprio = class<<ioprioClassShift | level
+	}
+
+	var env []string
+	if conf.Env != nil {
+		for key, val := range *conf.Env {
+			env = append(env, key+"="+val)
+		}
+		sort.Strings(env)
+	}
+	if conf.GOMAXPROCS != nil {
+		if *conf.GOMAXPROCS < 1 {
+			err = fmt.Errorf("process.gomaxprocs %d should be positive", *conf.GOMAXPROCS)
+			return
+		}
+		env = append(env, "GOMAXPROCS="+strconv.Itoa(*conf.GOMAXPROCS))
+	}
+	if len(env) > 0 {
+		out.env = append(os.Environ(), env...)
+	}
+
+	return
+}
+
+// start starts cmd with the process settings.
+func (p process) start(cmd *exec.Cmd) error {
+	if p.env != nil {
+		cmd.Env = p.env
+	}
+
+	if p.nice == nil && p.ioprio == 0 {
+		return cmd.Start()
+	}
+
+	return startWithPriority(cmd, p)
+}
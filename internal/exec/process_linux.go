@@ -0,0 +1,41 @@
+package exec
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+const ioprioWhoProcess = 1
+
+// startWithPriority starts cmd from a dedicated OS thread whose scheduling and
+// I/O priorities are changed beforehand. The child process inherits them from
+// that thread. Since raising a priority again usually requires privileges, the
+// thread is discarded afterwards, by exiting the goroutine while still locked
+// to it.
+func startWithPriority(cmd *exec.Cmd, p process) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		tid := syscall.Gettid()
+		if p.nice != nil {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, *p.nice); err != nil {
+				errs <- fmt.Errorf("%w: could not set process.nice to %d", err, *p.nice)
+				return
+			}
+		}
+		if p.ioprio != 0 {
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(p.ioprio)); errno != 0 {
+				errs <- fmt.Errorf("%w: could not set process.ionice", errno)
+				return
+			}
+		}
+
+		errs <- cmd.Start()
+	}()
+
+	return <-errs
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package exec
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func startWithPriority(cmd *exec.Cmd, p process) error {
+	return errors.New("process.nice and process.ionice are only supported on linux")
+}
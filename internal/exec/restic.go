@@ -2,23 +2,40 @@ package exec
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/lock"
+	"github.com/rafaelespinoza/wrestic/internal/version"
 )
 
 // ResticBatch is a set of named parameters for operating a restic subcommand
 // upon multiple destinations.
 type ResticBatch struct {
-	ConfigDir  string         // ConfigDir is the parent directory for the age-formatted keypair and encrypted secrets.
 	Sink       io.Writer      // Sink may capture the arguments and flags generated for the restic subcommand.
 	Subcommand string         // Subcommand is the restic subcommand to run.
 	Args       []string       // Args are the flags and positional arguments to pass to Subcommand.
 	Run        bool           // Run toggles whether the subcommand is actually invoked or not.
 	NewCommand func() Command // NewCommand allows some inversion of control, mostly useful for testing.
+	Observer   Observer       // Observer is optional, it's told when running restic upon the batch, or any destination, starts and finishes.
+	LockDir    string         // LockDir is optional. When non-empty, a lock upon each destination is taken in this directory before running restic.
+	LockMode   lock.Mode      // LockMode says what to do when a destination is locked by another process. The default is to wait.
+	FailOn     []Outcome      // FailOn are the outcomes upon a destination that stop the batch with an error. If empty, then DefaultFailOn is used.
+	Budget     time.Duration  // Budget is optional. When positive, no more destinations are started once the batch has been running this long.
+
+	// ProbeVersion is optional, it outputs the version of a restic executable.
+	// If empty, then ProbeResticVersion is used. The version is only probed
+	// when a destination has a restic-version constraint, or a flag that
+	// needs a minimum restic version, and at most once per executable for
+	// each call to Do.
+	ProbeVersion func(ctx context.Context, bin string) (version.Version, error)
+
+	versions map[string]probedVersion
 }
 
 // Do may invoke a restic subcommand (named by Subcommand), with any positional
@@ -28,32 +45,357 @@ type ResticBatch struct {
 // comment. To actually run restic, set Run to true. If Sink is non-empty then
 // generated command line args (prefixed with a # for roll-safe purposes) are
 // written to Sink.
-func (b ResticBatch) Do(ctx context.Context, datastores []config.Datastore) error {
+//
+// When Run is true and Observer is non-empty, then the Observer is notified
+// before and after restic runs upon each destination, and upon the batch.
+//
+// When Run is true, the output Result has the Outcome of running restic upon
+// each destination. If an Outcome is a member of FailOn, then the batch stops
+// and the output error is the one from restic. Otherwise, the batch continues.
+//
+// When Run is true and ctx is done, then restic is not run upon any remaining
+// destinations. Each of them is reported to the Observer as skipped, and the
+// output error is ErrInterrupted.
+//
+// When Run is true and a destination has a timeout for Subcommand, then restic
+// is stopped upon that destination once the timeout elapses. When Budget is
+// positive and used up, then the remaining destinations are skipped and the
+// output error is ErrBudgetExceeded.
+//
+// When Run is true and LockDir is non-empty, then restic only runs upon a
+// destination while holding its lock. A destination that's skipped per the
+// LockMode is not an error, and the Observer is not told about it.
+//
+// Before anything else, the configuration of every destination is checked with
+// config.ValidateResolved, for the sections that Subcommand uses, see
+// config.Problems.ForSubcommand. Warnings are written to Sink. When Run is
+// true and there are any errors, then the output error is a config.Problems,
+// and restic is not run upon any destination. Otherwise, the errors are
+// written to Sink as warnings too.
+//
+// When Run is true and a configured flag is not supported by the version of
+// restic that would run upon a destination, then the output error is
+// ErrUnsupportedFlags, before restic runs upon any destination. Unless the
+// destination's unsupported-flags config value is "drop", in which case the
+// flag is left out, with a warning written to Sink.
+func (b ResticBatch) Do(ctx context.Context, datastores []config.ResolvedDatastore) (out Result, err error) {
+	b.versions = make(map[string]probedVersion)
+
+	if b.Run && b.Observer != nil {
+		b.Observer.Observe(ctx, Event{Kind: EventStart, Subcommand: b.Subcommand, Time: time.Now()})
+		defer func() {
+			b.Observer.Observe(ctx, Event{Kind: EventFinish, Subcommand: b.Subcommand, Time: time.Now(), Err: err})
+		}()
+	}
+
+	problems := config.ValidateResolved(datastores).ForSubcommand(b.Subcommand)
+	if !b.Run {
+		// Nothing will run, so show every problem, and preview anyway.
+		for _, problem := range problems {
+			b.printf("# warning: %s\n", problem)
+		}
+	} else {
+		for _, warning := range problems.Warnings() {
+			b.printf("# warning: %s\n", warning)
+		}
+		if problems = problems.Errors(); len(problems) > 0 {
+			err = problems
+			return
+		}
+	}
+	if b.Run {
+		if err = b.checkFlags(ctx, datastores); err != nil {
+			return
+		}
+	}
+
+	var (
+		cause      error // cause is what stopped restic upon a destination, when interrupted.
+		skipped    int
+		overBudget int
+		started    = time.Now()
+	)
 	for _, store := range datastores {
-		for _, dest := range store.Destinations {
-			args, err := b.buildArgs(dest, store.Sources...)
-			if err != nil {
-				return fmt.Errorf("%w: store=%q, destination=%q", err, store.Name, dest.Name)
+		for _, dest := range store.Destinations() {
+			if b.Run && ctx.Err() != nil {
+				b.skip(ctx, store, dest, ErrInterrupted)
+				out.Destinations = append(out.Destinations, DestinationResult{Store: store.Name(), Destination: dest.Name(), Outcome: OutcomeInterrupted, Err: ErrInterrupted})
+				skipped++
+				continue
+			}
+			if b.Run && b.Budget > 0 && time.Since(started) >= b.Budget {
+				b.skip(ctx, store, dest, ErrBudgetExceeded)
+				out.Destinations = append(out.Destinations, DestinationResult{Store: store.Name(), Destination: dest.Name(), Outcome: OutcomeBudgetExceeded, Err: ErrBudgetExceeded})
+				overBudget++
+				continue
 			}
 
-			if b.Sink != nil {
-				printArgs(b.Sink, args...)
+			outcome, destErr := b.do(ctx, store, dest)
+			if destErr != nil {
+				destErr = fmt.Errorf("%w: store=%q, destination=%q", destErr, store.Name(), dest.Name())
+			}
+			if outcome == "" { // restic was not attempted.
+				if destErr != nil {
+					err = destErr
+					return
+				}
+				continue
 			}
 
-			if !b.Run { // is this a preview of commands to run?
+			out.Destinations = append(out.Destinations, DestinationResult{Store: store.Name(), Destination: dest.Name(), Outcome: outcome, Err: destErr})
+			if destErr == nil {
 				continue
+			} else if ctx.Err() != nil {
+				cause = destErr
+			} else if b.failsOn(outcome) {
+				err = destErr
+				return
+			} else {
+				b.printf("# %s, continuing: %v\n", outcome, destErr)
 			}
+		}
+	}
+
+	if ctxErr := ctx.Err(); b.Run && ctxErr != nil && (cause != nil || skipped > 0) {
+		if cause == nil {
+			cause = ctxErr
+		}
+		err = interruptedError{cause: cause, skipped: skipped}
+	} else if overBudget > 0 {
+		err = fmt.Errorf("%w after %s; skipped %d remaining destination(s)", ErrBudgetExceeded, b.Budget, overBudget)
+	}
+
+	return
+}
 
-			runner := b.NewCommand()
-			if err = runner.Run(ctx, args...); err != nil {
-				return fmt.Errorf("%w: store=%q, destination=%q", err, store.Name, dest.Name)
+// ErrBudgetExceeded means that the ResticBatch.Budget was used up before
+// restic ran upon every destination.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// ErrInterrupted means that the context passed to ResticBatch.Do was done
+// before restic ran upon every destination.
+var ErrInterrupted = errors.New("interrupted")
+
+// interruptedError is an ErrInterrupted, which also wraps what was happening
+// upon the interruption.
+type interruptedError struct {
+	cause   error
+	skipped int
+}
+
+func (e interruptedError) Error() string {
+	return fmt.Sprintf("%v: %v; skipped %d remaining destination(s)", ErrInterrupted, e.cause, e.skipped)
+}
+
+func (e interruptedError) Unwrap() error { return e.cause }
+
+func (e interruptedError) Is(target error) bool { return target == ErrInterrupted }
+
+// skip reports that restic won't run upon dest, for the reason.
+func (b ResticBatch) skip(ctx context.Context, store config.ResolvedDatastore, dest config.ResolvedDestination, reason error) {
+	b.printf("# %v, skipping store=%q, destination=%q\n", reason, store.Name(), dest.Name())
+
+	if b.Observer != nil {
+		b.Observer.Observe(ctx, Event{
+			Kind:        EventSkip,
+			Subcommand:  b.Subcommand,
+			Store:       &store,
+			Destination: &dest,
+			Time:        time.Now(),
+			Err:         reason,
+		})
+	}
+}
+
+// do runs restic upon dest. The output outcome is empty if restic was not
+// attempted, which is the case for a preview.
+func (b ResticBatch) do(ctx context.Context, store config.ResolvedDatastore, dest config.ResolvedDestination) (outcome Outcome, err error) {
+	flags, err := dest.BuildFlags(b.Subcommand)
+	if err != nil {
+		return
+	}
+
+	timeout, err := dest.Timeout(b.Subcommand)
+	if err != nil {
+		return
+	}
+
+	defaults, err := dest.Merge()
+	if err != nil {
+		return
+	}
+
+	flags, overridden := b.overrideFlags(flags)
+	b.warnOverridden(store, dest, overridden)
+
+	bin := ResticBin(defaults)
+	var constraint *version.Constraint
+	if defaults.ResticVersion != nil {
+		var parsed version.Constraint
+		if parsed, err = version.ParseConstraint(*defaults.ResticVersion); err != nil {
+			err = fmt.Errorf("%w: restic-version is invalid", err)
+			return
+		}
+		constraint = &parsed
+	}
+	if _, err = unsupportedFlagsMode(defaults); err != nil {
+		return
+	}
+
+	if !b.Run { // is this a preview of commands to run?
+		b.printInvocation(bin, b.formatArgs(flags, store.Sources()...))
+		return
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Unsupported flags are found before printing the args, in case some of
+	// them are dropped.
+	if flags, err = b.compatibleFlags(ctx, store, dest, bin, defaults, flags); err != nil {
+		outcome = OutcomeFatal
+		return
+	}
+	args := b.formatArgs(flags, store.Sources()...)
+	b.printInvocation(bin, args)
+
+	if b.LockDir != "" {
+		var held *lock.Lock
+		if held, err = b.lock(ctx, store, dest); errors.Is(err, lock.ErrLocked) && b.LockMode == lock.ModeSkip {
+			b.printf("# skipping store=%q, destination=%q: %v\n", store.Name(), dest.Name(), err)
+			return OutcomeSkipped, nil
+		} else if errors.Is(err, lock.ErrLocked) {
+			return OutcomeLockFailure, err
+		} else if err != nil {
+			// The timeout may be reached while waiting for the lock.
+			return Classify(err), err
+		}
+		defer func() {
+			if releaseErr := held.Release(); err == nil && releaseErr != nil {
+				outcome, err = OutcomeFatal, releaseErr
 			}
+		}()
+	}
+
+	if b.Observer != nil {
+		event := Event{Subcommand: b.Subcommand, Store: &store, Destination: &dest}
+		event.Kind, event.Time = EventStart, time.Now()
+		b.Observer.Observe(ctx, event)
+		defer func() {
+			event.Kind, event.Time, event.Err, event.Outcome = EventFinish, time.Now(), err, outcome
+			b.Observer.Observe(ctx, event)
+		}()
+	}
+
+	if constraint != nil {
+		if err = b.checkVersion(ctx, bin, *constraint); err != nil {
+			outcome = OutcomeFatal
+			return
+		}
+	}
+
+	runner := b.NewCommand()
+	if setter, ok := runner.(BinSetter); ok {
+		setter.SetBin(bin)
+	}
+	if setter, ok := runner.(ProcessSetter); ok && defaults.Process != nil {
+		if err = setter.SetProcess(*defaults.Process); err != nil {
+			outcome = OutcomeFatal
+			return
 		}
 	}
+	err = runner.Run(ctx, args...)
+	outcome = Classify(err)
+	return
+}
+
+func (b ResticBatch) lock(ctx context.Context, store config.ResolvedDatastore, dest config.ResolvedDestination) (out *lock.Lock, err error) {
+	holder := lock.Holder{
+		Repo:        dest.Path(),
+		Store:       store.Name(),
+		Destination: dest.Name(),
+		Subcommand:  b.Subcommand,
+		Command:     os.Args,
+	}
+
+	out, err = lock.Acquire(ctx, b.LockDir, holder, false)
+	if !errors.Is(err, lock.ErrLocked) || (b.LockMode != "" && b.LockMode != lock.ModeWait) {
+		return
+	}
 
-	return nil
+	b.printf("# waiting for store=%q, destination=%q: %v\n", store.Name(), dest.Name(), err)
+	return lock.Acquire(ctx, b.LockDir, holder, true)
 }
 
+// printInvocation writes the restic executable, bin, and args to the Sink.
+func (b ResticBatch) printInvocation(bin string, args []string) {
+	if b.Sink != nil {
+		printArgs(b.Sink, append([]string{bin}, args...)...)
+	}
+}
+
+func (b ResticBatch) printf(format string, args ...any) {
+	if b.Sink != nil {
+		fmt.Fprintf(b.Sink, format, args...)
+	}
+}
+
+// An Observer is told about the progress of a ResticBatch.
+type Observer interface {
+	Observe(ctx context.Context, event Event)
+}
+
+// MultiObserver outputs an Observer that tells each of observers about every
+// Event, in order. Empty members of observers are skipped.
+func MultiObserver(observers ...Observer) Observer {
+	out := make(multiObserver, 0, len(observers))
+	for _, observer := range observers {
+		if observer != nil {
+			out = append(out, observer)
+		}
+	}
+	return out
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) Observe(ctx context.Context, event Event) {
+	for _, observer := range m {
+		observer.Observe(ctx, event)
+	}
+}
+
+// Event describes progress of a restic subcommand upon a destination, or upon
+// the whole batch.
+type Event struct {
+	Kind       EventKind
+	Subcommand string
+	// Store and Destination are empty when the Event is about the whole batch.
+	Store       *config.ResolvedDatastore
+	Destination *config.ResolvedDestination
+	// Time is when the Event happened.
+	Time time.Time
+	// Err is set when Kind is EventFinish or EventSkip. If empty, then it's a
+	// success.
+	Err error
+	// Outcome is only set when Kind is EventFinish and Destination is
+	// non-empty.
+	Outcome Outcome
+}
+
+// EventKind says what happened.
+type EventKind uint8
+
+const (
+	EventStart EventKind = iota + 1
+	EventFinish
+	// EventSkip means that restic was not run upon the destination at all.
+	EventSkip
+)
+
 // A Command is an external command to execute with args.
 type Command interface {
 	Run(ctx context.Context, args ...string) error
@@ -61,26 +403,86 @@ type Command interface {
 
 // NewRestic constructs a Command capable of running restic. By default, it will
 // pick the first restic executable found in PATH. The path to the restic
-// binary may be overridden with the environment variable, RESTIC_BIN.
+// binary may be overridden with the environment variable, RESTIC_BIN, or per
+// destination via SetBin.
 func NewRestic(outSink, errSink io.Writer) Command {
-	return restic{outSink, errSink}
+	return &restic{outSink: outSink, errSink: errSink}
 }
 
-type restic struct{ outSink, errSink io.Writer }
+// NewResticGraceful is like NewRestic, but when the context passed to Run is
+// done, restic is sent an interrupt signal rather than being killed right away.
+// This gives restic a chance to finish up and remove its repository lock. If
+// restic has not exited after the grace period, then it's killed.
+func NewResticGraceful(outSink, errSink io.Writer, grace time.Duration) Command {
+	return &restic{outSink: outSink, errSink: errSink, grace: grace}
+}
+
+type restic struct {
+	outSink, errSink io.Writer
+	grace            time.Duration
+	process          process
+	bin              string
+}
+
+// SetBin implements BinSetter.
+func (r *restic) SetBin(bin string) { r.bin = bin }
+
+// SetProcess implements ProcessSetter.
+func (r *restic) SetProcess(conf config.ProcessConfig) (err error) {
+	r.process, err = parseProcess(conf)
+	return
+}
 
-func (r restic) Run(ctx context.Context, args ...string) (err error) {
-	bin := "restic"
-	// Optionally, check for alternate restic binaries. The main use case is for
-	// running a different version of restic. But tests could also use this env
-	// var for sanity checking application behavior in a controlled manner.
-	if val := os.Getenv("RESTIC_BIN"); val != "" {
-		bin = val
+func (r *restic) Run(ctx context.Context, args ...string) (err error) {
+	bin := r.bin
+	if bin == "" {
+		bin = defaultResticBin()
 	}
 
-	cmd := exec.CommandContext(ctx, bin, args...)
+	if r.grace <= 0 {
+		cmd := exec.CommandContext(ctx, bin, args...)
+		cmd.Stdout = r.outSink
+		cmd.Stderr = r.errSink
+
+		if err = r.process.start(cmd); err != nil {
+			return
+		}
+		if err = cmd.Wait(); err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+		return
+	}
+
+	cmd := exec.Command(bin, args...)
 	cmd.Stdout = r.outSink
 	cmd.Stderr = r.errSink
 
-	err = cmd.Run()
+	if err = r.process.start(cmd); err != nil {
+		return
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(os.Interrupt)
+
+			timer := time.NewTimer(r.grace)
+			defer timer.Stop()
+			select {
+			case <-exited:
+			case <-timer.C:
+				_ = cmd.Process.Kill()
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		err = fmt.Errorf("%w: %v", ctxErr, err)
+	}
 	return
 }
@@ -2,15 +2,28 @@ package exec_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rafaelespinoza/wrestic/internal/config"
 	"github.com/rafaelespinoza/wrestic/internal/exec"
+	"github.com/rafaelespinoza/wrestic/internal/lock"
+	"github.com/rafaelespinoza/wrestic/internal/version"
 )
 
 func TestResticBatch(t *testing.T) {
+	// Previews show the restic executable, which would otherwise depend upon
+	// the environment.
+	t.Setenv("RESTIC_BIN", "")
+
 	tests := []struct {
 		name                 string
 		datastores           []config.Datastore
@@ -55,9 +68,9 @@ func TestResticBatch(t *testing.T) {
 			configDir:  "/tmp",
 			subcommand: "test",
 			expectedSinkData: []string{
-				`# test --repo=foo --password-command='cat /tmp/secrets/foo' --foo=123 deadbeef --bar
+				`# restic test --repo=foo --password-command='cat /tmp/secrets/foo' --foo=123 deadbeef --bar
 `,
-				`# test --repo=bar --password-command='cat /tmp/secrets/bar' --foo=123 deadbeef --bar
+				`# restic test --repo=bar --password-command='cat /tmp/secrets/bar' --foo=123 deadbeef --bar
 `,
 			},
 			expectedReceivedArgs: [][]string{},
@@ -96,9 +109,9 @@ func TestResticBatch(t *testing.T) {
 			subcommand: "test",
 			run:        true,
 			expectedSinkData: []string{
-				`# test --repo=foo --password-command='cat /tmp/secrets/foo' --foo=123 deadbeef --bar
+				`# restic test --repo=foo --password-command='cat /tmp/secrets/foo' --foo=123 deadbeef --bar
 `,
-				`# test --repo=bar --password-command='cat /tmp/secrets/bar' --foo=123 deadbeef --bar
+				`# restic test --repo=bar --password-command='cat /tmp/secrets/bar' --foo=123 deadbeef --bar
 `,
 			},
 			expectedReceivedArgs: [][]string{
@@ -140,9 +153,9 @@ func TestResticBatch(t *testing.T) {
 			subcommand: "test",
 			run:        true,
 			expectedSinkData: []string{
-				`# test --repo=foo --password-command='age -d -i /elsewhere/no_spaces/secrets/id /elsewhere/no_spaces/secrets/foo' --foo=123 deadbeef --bar
+				`# restic test --repo=foo --password-command='age -d -i /elsewhere/no_spaces/secrets/id /elsewhere/no_spaces/secrets/foo' --foo=123 deadbeef --bar
 `,
-				`# test --repo=bar --password-command='age -d -i "/elsewhere/has spaces/secrets/id" "/elsewhere/has spaces/secrets/bar"' --foo=123 deadbeef --bar
+				`# restic test --repo=bar --password-command='age -d -i "/elsewhere/has spaces/secrets/id" "/elsewhere/has spaces/secrets/bar"' --foo=123 deadbeef --bar
 `,
 			},
 			expectedReceivedArgs: [][]string{
@@ -184,9 +197,9 @@ func TestResticBatch(t *testing.T) {
 			subcommand: "test",
 			run:        true,
 			expectedSinkData: []string{
-				`# test --repo=foo --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/foo' --foo=123 deadbeef --bar
+				`# restic test --repo=foo --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/foo' --foo=123 deadbeef --bar
 `,
-				`# test --repo=bar --password-command='age -d -i "/tmp/config_place/secret id" "/tmp/config_place/secret bar"' --foo=123 deadbeef --bar
+				`# restic test --repo=bar --password-command='age -d -i "/tmp/config_place/secret id" "/tmp/config_place/secret bar"' --foo=123 deadbeef --bar
 `,
 			},
 			expectedReceivedArgs: [][]string{
@@ -279,9 +292,9 @@ func TestResticBatch(t *testing.T) {
 			configDir:  "/tmp/config_place",
 			subcommand: "backup",
 			expectedSinkData: []string{
-				`# backup --repo=foo --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/foo' --foo=123 deadbeef --bar /usr/foo
+				`# restic backup --repo=foo --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/foo' --foo=123 deadbeef --bar /usr/foo
 `,
-				`# backup --repo=bar --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/bar' --foo=123 deadbeef --bar /etc/bar
+				`# restic backup --repo=bar --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/bar' --foo=123 deadbeef --bar /etc/bar
 `,
 			},
 			expectedReceivedArgs: [][]string{},
@@ -312,7 +325,7 @@ func TestResticBatch(t *testing.T) {
 			subcommand: "snapshots",
 			run:        true,
 			expectedSinkData: []string{
-				`# snapshots --repo=foo --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/foo' --compact=true --json=true --foo=123 deadbeef --bar
+				`# restic snapshots --repo=foo --password-command='age -d -i /tmp/config_place/secrets/id /tmp/config_place/secrets/foo' --compact=true --json=true --foo=123 deadbeef --bar
 `,
 			},
 			expectedReceivedArgs: [][]string{
@@ -335,14 +348,13 @@ func TestResticBatch(t *testing.T) {
 
 			batch := exec.ResticBatch{
 				Sink:       &sink,
-				ConfigDir:  test.configDir,
 				Subcommand: test.subcommand,
 				Args:       []string{"--foo=123", "deadbeef", "--bar"},
 				Run:        test.run,
 				NewCommand: newCommand,
 			}
 
-			err := batch.Do(context.Background(), test.datastores)
+			_, err := batch.Do(context.Background(), resolve(t, test.configDir, test.datastores))
 			if err != nil && !test.expectErr {
 				t.Fatal(err)
 			} else if err == nil && test.expectErr {
@@ -412,7 +424,7 @@ func TestResticBatchNewRestic(t *testing.T) {
 					},
 				},
 			}
-			err := batch.Do(context.Background(), []config.Datastore{{Destinations: destinations}})
+			_, err := batch.Do(context.Background(), resolve(t, "", []config.Datastore{{Destinations: destinations}}))
 
 			if !test.expError && err != nil {
 				t.Fatal(err)
@@ -423,6 +435,1137 @@ func TestResticBatchNewRestic(t *testing.T) {
 	}
 }
 
+func TestResticBatchObserver(t *testing.T) {
+	datastores := []config.Datastore{
+		{
+			Name: "stuff",
+			Destinations: map[string]config.Destination{
+				"foo": {Name: "foo", Path: "foo"},
+			},
+		},
+		{
+			Name: "things",
+			Destinations: map[string]config.Destination{
+				"bar": {Name: "bar", Path: "bar"},
+			},
+		},
+	}
+
+	for _, run := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Run=%t", run), func(t *testing.T) {
+			observer := Observer{}
+			batch := exec.ResticBatch{
+				Subcommand: "test",
+				Run:        run,
+				Observer:   &observer,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						if args[1] == "--repo=bar" {
+							return errors.New("oops")
+						}
+						return nil
+					}}
+				},
+			}
+
+			_, err := batch.Do(context.Background(), resolve(t, "", datastores))
+			if err == nil && run {
+				t.Fatal("expected an error")
+			} else if err != nil && !run {
+				t.Fatal(err)
+			}
+
+			var expected []string
+			if run {
+				expected = []string{
+					"start test",
+					"start test stuff foo",
+					"finish test stuff foo <nil>",
+					"start test things bar",
+					`finish test things bar oops`,
+					`finish test oops: store="things", destination="bar"`,
+				}
+			}
+
+			if len(observer.events) != len(expected) {
+				t.Fatalf("wrong number of events; got %d, expected %d\n%q", len(observer.events), len(expected), observer.events)
+			}
+			for i, got := range observer.events {
+				if got != expected[i] {
+					t.Errorf("item %d; wrong event\ngot %q\nexp %q", i, got, expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResticBatchInterrupted(t *testing.T) {
+	datastores := []config.Datastore{
+		{
+			Name: "stuff",
+			Destinations: map[string]config.Destination{
+				"foo": {Name: "foo", Path: "foo"},
+			},
+		},
+		{
+			Name: "things",
+			Destinations: map[string]config.Destination{
+				"bar": {Name: "bar", Path: "bar"},
+			},
+		},
+		{
+			Name: "widgets",
+			Destinations: map[string]config.Destination{
+				"qux": {Name: "qux", Path: "qux"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		runErr    error // runErr is what restic exits with, after being interrupted.
+		expEvents []string
+	}{
+		{
+			name:   "while running",
+			runErr: errors.New("signal: interrupt"),
+			expEvents: []string{
+				"start test",
+				"start test stuff foo",
+				"finish test stuff foo <nil>",
+				"start test things bar",
+				"finish test things bar signal: interrupt",
+				"skip test widgets qux interrupted",
+				`finish test interrupted: signal: interrupt: store="things", destination="bar"; skipped 1 remaining destination(s)`,
+			},
+		},
+		{
+			name: "between destinations",
+			expEvents: []string{
+				"start test",
+				"start test stuff foo",
+				"finish test stuff foo <nil>",
+				"start test things bar",
+				"finish test things bar <nil>",
+				"skip test widgets qux interrupted",
+				`finish test interrupted: context canceled; skipped 1 remaining destination(s)`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			observer := Observer{}
+			sink := Sink{}
+			batch := exec.ResticBatch{
+				Subcommand: "test",
+				Run:        true,
+				Sink:       &sink,
+				Observer:   &observer,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						if args[1] != "--repo=bar" {
+							return nil
+						}
+						cancel()
+						return test.runErr
+					}}
+				},
+			}
+
+			_, err := batch.Do(ctx, resolve(t, "", datastores))
+			if !errors.Is(err, exec.ErrInterrupted) {
+				t.Fatalf("expected error %v, got %v", exec.ErrInterrupted, err)
+			}
+
+			if len(observer.events) != len(test.expEvents) {
+				t.Fatalf("wrong number of events; got %d, expected %d\n%q", len(observer.events), len(test.expEvents), observer.events)
+			}
+			for i, got := range observer.events {
+				if got != test.expEvents[i] {
+					t.Errorf("item %d; wrong event\ngot %q\nexp %q", i, got, test.expEvents[i])
+				}
+			}
+
+			if last := sink.data[len(sink.data)-1]; last != "# interrupted, skipping store=\"widgets\", destination=\"qux\"\n" {
+				t.Errorf("wrong sink data %q", last)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		exp  exec.Outcome
+	}{
+		{name: "nil", err: nil, exp: exec.OutcomeSuccess},
+		{name: "not an exit error", err: errors.New("oops"), exp: exec.OutcomeFatal},
+		{name: "1", err: exitError(t, 1), exp: exec.OutcomeFatal},
+		{name: "3", err: exitError(t, 3), exp: exec.OutcomeWarning},
+		{name: "3 wrapped", err: fmt.Errorf("%w: store=%q", exitError(t, 3), "stuff"), exp: exec.OutcomeWarning},
+		{name: "10", err: exitError(t, 10), exp: exec.OutcomeRepoMissing},
+		{name: "11", err: exitError(t, 11), exp: exec.OutcomeLockFailure},
+		{name: "12", err: exitError(t, 12), exp: exec.OutcomeFatal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := exec.Classify(test.err); got != test.exp {
+				t.Errorf("wrong Outcome; got %q, expected %q", got, test.exp)
+			}
+		})
+	}
+}
+
+func TestResticBatchOutcomes(t *testing.T) {
+	datastores := []config.Datastore{
+		{Name: "a", Destinations: map[string]config.Destination{"foo": {Name: "foo", Path: "foo"}}},
+		{Name: "b", Destinations: map[string]config.Destination{"bar": {Name: "bar", Path: "bar"}}},
+		{Name: "c", Destinations: map[string]config.Destination{"qux": {Name: "qux", Path: "qux"}}},
+	}
+
+	codes := map[string]int{"--repo=foo": 3, "--repo=bar": 10}
+
+	tests := []struct {
+		name        string
+		failOn      []exec.Outcome
+		expErr      bool
+		expOutcomes []exec.Outcome
+		expSummary  string
+	}{
+		{
+			name:        "default",
+			expErr:      true,
+			expOutcomes: []exec.Outcome{exec.OutcomeWarning, exec.OutcomeRepoMissing},
+			expSummary:  "1 warning, 1 repo-missing",
+		},
+		{
+			name:        "fail on warning",
+			failOn:      []exec.Outcome{exec.OutcomeWarning},
+			expErr:      true,
+			expOutcomes: []exec.Outcome{exec.OutcomeWarning},
+			expSummary:  "1 warning",
+		},
+		{
+			name:        "fail on fatal only",
+			failOn:      []exec.Outcome{exec.OutcomeFatal},
+			expOutcomes: []exec.Outcome{exec.OutcomeWarning, exec.OutcomeRepoMissing, exec.OutcomeSuccess},
+			expSummary:  "1 success, 1 warning, 1 repo-missing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			observer := Observer{}
+			batch := exec.ResticBatch{
+				Subcommand: "test",
+				Run:        true,
+				Sink:       &Sink{},
+				Observer:   &observer,
+				FailOn:     test.failOn,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						if code, ok := codes[args[1]]; ok {
+							return exitError(t, code)
+						}
+						return nil
+					}}
+				},
+			}
+
+			result, err := batch.Do(context.Background(), resolve(t, "", datastores))
+			if err != nil && !test.expErr {
+				t.Fatal(err)
+			} else if err == nil && test.expErr {
+				t.Fatal("expected an error")
+			}
+
+			if len(result.Destinations) != len(test.expOutcomes) {
+				t.Fatalf("wrong number of results; got %d, expected %d\n%#v", len(result.Destinations), len(test.expOutcomes), result.Destinations)
+			}
+			for i, got := range result.Destinations {
+				if got.Outcome != test.expOutcomes[i] {
+					t.Errorf("item %d; wrong Outcome; got %q, expected %q", i, got.Outcome, test.expOutcomes[i])
+				}
+				if got.Outcome == exec.OutcomeSuccess && got.Err != nil {
+					t.Errorf("item %d; unexpected error %v", i, got.Err)
+				} else if got.Outcome != exec.OutcomeSuccess && got.Err == nil {
+					t.Errorf("item %d; expected an error", i)
+				}
+			}
+
+			if got := result.Count(exec.OutcomeWarning); got != 1 {
+				t.Errorf("wrong count of warnings; got %d, expected %d", got, 1)
+			}
+			if got := result.Summary(); got != test.expSummary {
+				t.Errorf("wrong Summary; got %q, expected %q", got, test.expSummary)
+			}
+		})
+	}
+}
+
+func TestParseOutcomes(t *testing.T) {
+	got, err := exec.ParseOutcomes([]string{"warning", " fatal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != exec.OutcomeWarning || got[1] != exec.OutcomeFatal {
+		t.Errorf("wrong output %q", got)
+	}
+
+	if _, err = exec.ParseOutcomes([]string{"success"}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// exitError outputs the error from a process that exits with code.
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+
+	err := osexec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	if err == nil {
+		t.Fatalf("expected an error for exit code %d", code)
+	}
+	return err
+}
+
+func TestResticBatchTimeout(t *testing.T) {
+	params, err := config.Parse(strings.NewReader(`
+[datastores.a.destinations.foo]
+path = 'foo'
+defaults.timeout.backup = '50ms'
+
+[datastores.b.destinations.bar]
+path = 'bar'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	datastores := config.SelectDatastores(params.Datastores, nil, nil)
+
+	var received []string
+	batch := exec.ResticBatch{
+		Subcommand: "backup",
+		Run:        true,
+		NewCommand: func() exec.Command {
+			return &Command{RunResp: func(ctx context.Context, args ...string) error {
+				received = append(received, args[1])
+				if args[1] != "--repo=foo" {
+					return nil
+				}
+
+				// Pretend to be wedged.
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(5 * time.Second):
+					return errors.New("timeout was not applied")
+				}
+			}}
+		},
+	}
+
+	result, err := batch.Do(context.Background(), resolve(t, "", datastores))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch moves onto the next destination.
+	if strings.Join(received, " ") != "--repo=foo --repo=bar" {
+		t.Errorf("wrong received args %q", received)
+	}
+	if len(result.Destinations) != 2 {
+		t.Fatalf("wrong number of results; got %d, expected %d", len(result.Destinations), 2)
+	}
+	if got := result.Destinations[0].Outcome; got != exec.OutcomeTimeout {
+		t.Errorf("wrong Outcome; got %q, expected %q", got, exec.OutcomeTimeout)
+	}
+	if got := result.Destinations[1].Outcome; got != exec.OutcomeSuccess {
+		t.Errorf("wrong Outcome; got %q, expected %q", got, exec.OutcomeSuccess)
+	}
+
+	t.Run("fail on timeout", func(t *testing.T) {
+		received = nil
+		batch.FailOn = []exec.Outcome{exec.OutcomeTimeout}
+
+		_, err := batch.Do(context.Background(), resolve(t, "", datastores))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+		if strings.Join(received, " ") != "--repo=foo" {
+			t.Errorf("wrong received args %q", received)
+		}
+	})
+}
+
+func TestResticBatchBudget(t *testing.T) {
+	datastores := []config.Datastore{
+		{Name: "a", Destinations: map[string]config.Destination{"foo": {Name: "foo", Path: "foo"}}},
+		{Name: "b", Destinations: map[string]config.Destination{"bar": {Name: "bar", Path: "bar"}}},
+		{Name: "c", Destinations: map[string]config.Destination{"qux": {Name: "qux", Path: "qux"}}},
+	}
+
+	var received []string
+	observer := Observer{}
+	batch := exec.ResticBatch{
+		Subcommand: "test",
+		Run:        true,
+		Observer:   &observer,
+		Budget:     20 * time.Millisecond,
+		NewCommand: func() exec.Command {
+			return &Command{RunResp: func(ctx context.Context, args ...string) error {
+				received = append(received, args[1])
+				time.Sleep(30 * time.Millisecond)
+				return nil
+			}}
+		},
+	}
+
+	result, err := batch.Do(context.Background(), resolve(t, "", datastores))
+	if !errors.Is(err, exec.ErrBudgetExceeded) {
+		t.Fatalf("expected error %v, got %v", exec.ErrBudgetExceeded, err)
+	}
+
+	// A destination that's already running is not stopped by the budget.
+	if strings.Join(received, " ") != "--repo=foo" {
+		t.Errorf("wrong received args %q", received)
+	}
+	if got := result.Count(exec.OutcomeBudgetExceeded); got != 2 {
+		t.Errorf("wrong count of %q; got %d, expected %d", exec.OutcomeBudgetExceeded, got, 2)
+	}
+
+	expectedEvents := []string{
+		"start test",
+		"start test a foo",
+		"finish test a foo <nil>",
+		"skip test b bar budget exceeded",
+		"skip test c qux budget exceeded",
+		"finish test budget exceeded after 20ms; skipped 2 remaining destination(s)",
+	}
+	if strings.Join(observer.events, "\n") != strings.Join(expectedEvents, "\n") {
+		t.Errorf("wrong events\ngot %q\nexp %q", observer.events, expectedEvents)
+	}
+}
+
+func TestResticProcess(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process priorities are only supported on linux")
+	}
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "restic")
+	script := `#!/bin/sh
+echo "$GOMAXPROCS $FOO $(cut -d ' ' -f 19 /proc/$$/stat)"
+ionice -p $$
+`
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RESTIC_BIN", bin)
+
+	tests := []struct {
+		name      string
+		conf      config.ProcessConfig
+		expOutput string
+		expError  bool
+	}{
+		{
+			name: "idle",
+			conf: config.ProcessConfig{
+				Nice:       pointTo(19),
+				IONice:     &config.IONiceConfig{Class: pointToString(config.IONiceClassIdle)},
+				GOMAXPROCS: pointTo(2),
+				Env:        &map[string]string{"FOO": "bar"},
+			},
+			expOutput: "2 bar 19\nidle\n",
+		},
+		{
+			name: "best-effort",
+			conf: config.ProcessConfig{
+				Nice:   pointTo(19),
+				IONice: &config.IONiceConfig{Class: pointToString(config.IONiceClassBestEffort), Level: pointTo(6)},
+			},
+			expOutput: "  19\nbest-effort: prio 6\n",
+		},
+		{
+			name:     "invalid class",
+			conf:     config.ProcessConfig{IONice: &config.IONiceConfig{Class: pointToString("lazy")}},
+			expError: true,
+		},
+		{
+			name:     "invalid nice",
+			conf:     config.ProcessConfig{Nice: pointTo(20)},
+			expError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outSink, err := os.Create(filepath.Join(t.TempDir(), "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = outSink.Close() }()
+
+			cmd := exec.NewRestic(outSink, os.Stderr)
+			err = cmd.(exec.ProcessSetter).SetProcess(test.conf)
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatal("expected an error")
+			} else if err != nil {
+				return
+			}
+
+			if err = cmd.Run(context.Background(), "backup"); err != nil {
+				t.Fatal(err)
+			}
+
+			output, err := os.ReadFile(outSink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != test.expOutput {
+				t.Errorf("wrong output; got %q, expected %q", output, test.expOutput)
+			}
+		})
+	}
+}
+
+func TestResticBatchBin(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "restic-0.16")
+	script := `#!/bin/sh
+if [ "$1" = version ]; then
+	echo "restic 0.16.4 compiled with go1.21.6 on linux/amd64"
+	exit 0
+fi
+echo "$@"
+`
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RESTIC_BIN", "false")
+
+	tests := []struct {
+		name          string
+		run           bool
+		resticVersion *string
+		expSink       []string
+		expOutput     string
+		expOutcome    exec.Outcome
+		expError      bool
+	}{
+		{
+			name:       "preview shows bin",
+			expSink:    []string{"# " + bin + " snapshots --repo=foo --password-command='cat secret'\n"},
+			expOutcome: "",
+		},
+		{
+			name:          "version satisfied",
+			run:           true,
+			resticVersion: pointToString(">= 0.16, < 0.17"),
+			expOutput:     "snapshots --repo=foo --password-command=cat secret\n",
+			expOutcome:    exec.OutcomeSuccess,
+		},
+		{
+			name:          "version not satisfied",
+			run:           true,
+			resticVersion: pointToString(">= 0.17"),
+			expOutcome:    exec.OutcomeFatal,
+			expError:      true,
+		},
+		{
+			name:          "invalid constraint",
+			resticVersion: pointToString(">= zero"),
+			expError:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outSink, err := os.Create(filepath.Join(t.TempDir(), "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = outSink.Close() }()
+
+			var sink Sink
+			batch := exec.ResticBatch{
+				Sink:       &sink,
+				Subcommand: "snapshots",
+				Run:        test.run,
+				NewCommand: func() exec.Command { return exec.NewRestic(outSink, os.Stderr) },
+			}
+			if test.run {
+				batch.Sink = nil
+			}
+
+			destinations := map[string]config.Destination{
+				"foo": {
+					Path: "foo",
+					Defaults: config.Defaults{
+						PasswordConfig: &config.PasswordConfig{Template: pointToString("cat secret")},
+						ResticBin:      pointToString(bin),
+						ResticVersion:  test.resticVersion,
+					},
+				},
+			}
+			result, err := batch.Do(context.Background(), resolve(t, "", []config.Datastore{{Name: "stuff", Destinations: destinations}}))
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatal("expected an error")
+			}
+
+			if test.expSink != nil {
+				if fmt.Sprint(sink.data) != fmt.Sprint(test.expSink) {
+					t.Errorf("wrong sink data\ngot %q\nexp %q", sink.data, test.expSink)
+				}
+			}
+
+			var outcome exec.Outcome
+			if len(result.Destinations) > 0 {
+				outcome = result.Destinations[0].Outcome
+			}
+			if outcome != test.expOutcome {
+				t.Errorf("wrong outcome; got %q, expected %q", outcome, test.expOutcome)
+			}
+
+			output, err := os.ReadFile(outSink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != test.expOutput {
+				t.Errorf("wrong output; got %q, expected %q", output, test.expOutput)
+			}
+		})
+	}
+
+	t.Run("preview shows bin from env", func(t *testing.T) {
+		var sink Sink
+		batch := exec.ResticBatch{Sink: &sink, Subcommand: "snapshots"}
+		destinations := map[string]config.Destination{"foo": {Path: "foo"}}
+		if _, err := batch.Do(context.Background(), resolve(t, "", []config.Datastore{{Name: "stuff", Destinations: destinations}})); err != nil {
+			t.Fatal(err)
+		}
+
+		expSink := []string{"# false snapshots --repo=foo\n"}
+		if fmt.Sprint(sink.data) != fmt.Sprint(expSink) {
+			t.Errorf("wrong sink data\ngot %q\nexp %q", sink.data, expSink)
+		}
+	})
+
+	t.Run("probes once per bin", func(t *testing.T) {
+		var probes int
+		batch := exec.ResticBatch{
+			Subcommand: "snapshots",
+			Run:        true,
+			NewCommand: func() exec.Command {
+				return &Command{RunResp: func(ctx context.Context, args ...string) error { return nil }}
+			},
+			ProbeVersion: func(ctx context.Context, bin string) (version.Version, error) {
+				probes++
+				return version.MustParse("0.16.4"), nil
+			},
+		}
+
+		defaults := config.Defaults{
+			PasswordConfig: &config.PasswordConfig{Template: pointToString("cat secret")},
+			ResticVersion:  pointToString(">= 0.16"),
+		}
+		destinations := map[string]config.Destination{
+			"foo": {Path: "foo", Defaults: defaults},
+			"bar": {Path: "bar", Defaults: defaults},
+		}
+		if _, err := batch.Do(context.Background(), resolve(t, "", []config.Datastore{{Name: "stuff", Destinations: destinations}})); err != nil {
+			t.Fatal(err)
+		}
+		if probes != 1 {
+			t.Errorf("wrong number of probes; got %d, expected %d", probes, 1)
+		}
+	})
+}
+
+func TestResticBatchUnsupportedFlags(t *testing.T) {
+	tests := []struct {
+		name             string
+		unsupportedFlags *string
+		expArgs          [][]string
+		expSinkContains  string
+		expError         error
+		expErrorContains string
+	}{
+		{
+			name:             "fail",
+			expError:         exec.ErrUnsupportedFlags,
+			expErrorContains: "--compression needs 0.14.0, --pack-size needs 0.14.0",
+		},
+		{
+			name:             "drop",
+			unsupportedFlags: pointToString(config.UnsupportedFlagsDrop),
+			expArgs:          [][]string{{"backup", "--repo=bar", "--host=box", "src"}},
+			expSinkContains:  "# dropping flags unsupported by restic 0.13.1, store=\"foo\", destination=\"bar\": --compression needs 0.14.0, --pack-size needs 0.14.0\n",
+		},
+		{
+			name:             "invalid",
+			unsupportedFlags: pointToString("ignore"),
+			expErrorContains: `invalid unsupported-flags "ignore"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				sink   Sink
+				probes int
+				args   [][]string
+			)
+			batch := exec.ResticBatch{
+				Sink:       &sink,
+				Subcommand: "backup",
+				Run:        true,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, a ...string) error {
+						args = append(args, a)
+						return nil
+					}}
+				},
+				ProbeVersion: func(ctx context.Context, bin string) (version.Version, error) {
+					probes++
+					return version.MustParse("0.13.1"), nil
+				},
+			}
+
+			destinations := map[string]config.Destination{
+				"bar": {
+					Name: "bar",
+					Path: "bar",
+					Defaults: config.Defaults{
+						Restic: &config.ResticDefaults{
+							Global: &config.ResticGlobal{Compression: pointToString("max"), PackSize: pointTo(uint(64))},
+							Backup: &config.ResticBackup{Host: pointToString("box")},
+						},
+						UnsupportedFlags: test.unsupportedFlags,
+					},
+				},
+			}
+			datastores := []config.Datastore{{Name: "foo", Sources: []config.Source{{Path: "src"}}, Destinations: destinations}}
+
+			_, err := batch.Do(context.Background(), resolve(t, "", datastores))
+			if test.expError == nil && test.expErrorContains == "" && err != nil {
+				t.Fatal(err)
+			} else if test.expError != nil && !errors.Is(err, test.expError) {
+				t.Fatalf("wrong error; got %v, expected %v", err, test.expError)
+			} else if test.expErrorContains != "" && (err == nil || !strings.Contains(err.Error(), test.expErrorContains)) {
+				t.Fatalf("wrong error; got %v, expected it to contain %q", err, test.expErrorContains)
+			}
+
+			if fmt.Sprint(args) != fmt.Sprint(test.expArgs) {
+				t.Errorf("wrong args\ngot %q\nexp %q", args, test.expArgs)
+			}
+			if test.expSinkContains != "" && !strings.Contains(strings.Join(sink.data, ""), test.expSinkContains) {
+				t.Errorf("wrong sink data\ngot %q\nexpected to contain %q", sink.data, test.expSinkContains)
+			}
+			if test.expErrorContains == "" && probes != 1 {
+				t.Errorf("wrong number of probes; got %d, expected %d", probes, 1)
+			}
+		})
+	}
+}
+
+func TestResticBatchInvalidConfig(t *testing.T) {
+	var ran bool
+	batch := exec.ResticBatch{
+		Subcommand: "stats",
+		Run:        true,
+		NewCommand: func() exec.Command {
+			return &Command{RunResp: func(ctx context.Context, args ...string) error {
+				ran = true
+				return nil
+			}}
+		},
+	}
+
+	destinations := map[string]config.Destination{
+		"bar": {Name: "bar", Path: "bar"},
+		"baz": {
+			Name: "baz",
+			Path: "baz",
+			Defaults: config.Defaults{
+				Restic: &config.ResticDefaults{
+					Stats: &config.ResticStats{Mode: pointToString("rawdata")},
+					// The check section is not used by stats, so it's left out.
+					Check: &config.ResticCheck{ReadDataSubset: pointToString("all")},
+				},
+			},
+		},
+	}
+	datastores := resolve(t, "", []config.Datastore{{Name: "foo", Destinations: destinations}})
+	_, err := batch.Do(context.Background(), datastores)
+
+	var problems config.Problems
+	if !errors.As(err, &problems) {
+		t.Fatalf("wrong error; got %v, expected config.Problems", err)
+	}
+	if len(problems) != 1 || problems[0].Key != "restic.stats.mode" || problems[0].Destination != "baz" {
+		t.Errorf("wrong problems %v", problems)
+	}
+	if ran {
+		t.Error("restic should not run upon any destination")
+	}
+
+	t.Run("preview", func(t *testing.T) {
+		var sink Sink
+		batch.Sink = &sink
+		batch.Run = false
+		if _, err := batch.Do(context.Background(), datastores); err != nil {
+			t.Fatal(err)
+		}
+		const expWarning = `# warning: datastores.foo.destinations.baz: restic.stats.mode = "rawdata"`
+		if got := strings.Join(sink.data, ""); !strings.Contains(got, expWarning) || strings.Contains(got, "read-data-subset") {
+			t.Errorf("wrong sink data\ngot %q\nexpected to contain %q", got, expWarning)
+		}
+
+		invocations, err := batch.Preview(datastores)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(invocations) != 2 {
+			t.Fatalf("wrong number of invocations; got %d, expected %d", len(invocations), 2)
+		}
+		if len(invocations[0].Warnings) != 0 {
+			t.Errorf("unexpected warnings for %q: %q", invocations[0].Destination, invocations[0].Warnings)
+		}
+		if len(invocations[1].Warnings) != 1 || !strings.Contains(invocations[1].Warnings[0], "restic.stats.mode") {
+			t.Errorf("wrong warnings for %q: %q", invocations[1].Destination, invocations[1].Warnings)
+		}
+	})
+}
+
+func TestResticBatchConfigWarnings(t *testing.T) {
+	var (
+		sink Sink
+		ran  bool
+	)
+	batch := exec.ResticBatch{
+		Sink:       &sink,
+		Subcommand: "snapshots",
+		Run:        true,
+		NewCommand: func() exec.Command {
+			return &Command{RunResp: func(ctx context.Context, args ...string) error {
+				ran = true
+				return nil
+			}}
+		},
+	}
+
+	destinations := map[string]config.Destination{
+		"bar": {
+			Name: "bar",
+			Path: "bar",
+			Defaults: config.Defaults{
+				Restic: &config.ResticDefaults{Global: &config.ResticGlobal{Repo: pointToString("elsewhere")}},
+			},
+		},
+	}
+	if _, err := batch.Do(context.Background(), resolve(t, "", []config.Datastore{{Name: "foo", Destinations: destinations}})); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "# warning: datastores.foo.destinations.bar: restic.global.repo = \"elsewhere\" overrides the path of the destination; set in [datastores.foo.destinations.bar.defaults]\n"
+	if len(sink.data) < 1 || sink.data[0] != expected {
+		t.Errorf("wrong sink data\ngot %q\nexp %q", sink.data, expected)
+	}
+	if !ran {
+		t.Error("a warning should not stop restic")
+	}
+}
+
+func TestResticBatchPassthroughArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expArgs     []string
+		expWarnings []string
+	}{
+		{
+			name:    "no args",
+			expArgs: []string{"backup", "--repo=foo", "--host=h", "--tag=cfg", "--verbose=1"},
+		},
+		{
+			name:    "single-valued flags are overridden, repeatable ones appended",
+			args:    []string{"--tag=manual", "--host", "other", "-v"},
+			expArgs: []string{"backup", "--repo=foo", "--tag=cfg", "--tag=manual", "--host", "other", "-v"},
+		},
+		{
+			name:        "repo is overridden with a warning",
+			args:        []string{"-r", "elsewhere"},
+			expArgs:     []string{"backup", "--host=h", "--tag=cfg", "--verbose=1", "-r", "elsewhere"},
+			expWarnings: []string{`# warning: --repo from args overrides the one for store="stuff", destination="foo"` + "\n"},
+		},
+		{
+			name:    "value of a flag is not a flag",
+			args:    []string{"--exclude", "--host=x"},
+			expArgs: []string{"backup", "--repo=foo", "--host=h", "--tag=cfg", "--verbose=1", "--exclude", "--host=x"},
+		},
+		{
+			name:    "unknown flags and args after double dash",
+			args:    []string{"--nope=1", "--", "--host=x"},
+			expArgs: []string{"backup", "--repo=foo", "--host=h", "--tag=cfg", "--verbose=1", "--nope=1", "--", "--host=x"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				sink    Sink
+				gotArgs []string
+			)
+			batch := exec.ResticBatch{
+				Sink:       &sink,
+				Subcommand: "backup",
+				Args:       test.args,
+				Run:        true,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						gotArgs = args
+						return nil
+					}}
+				},
+			}
+
+			destinations := map[string]config.Destination{
+				"foo": {
+					Name: "foo",
+					Path: "foo",
+					Defaults: config.Defaults{
+						Restic: &config.ResticDefaults{
+							Global: &config.ResticGlobal{Verbose: pointTo(1)},
+							Backup: &config.ResticBackup{Host: pointToString("h"), Tag: &[]string{"cfg"}},
+						},
+					},
+				},
+			}
+			if _, err := batch.Do(context.Background(), resolve(t, "", []config.Datastore{{Name: "stuff", Destinations: destinations}})); err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(gotArgs) != fmt.Sprint(test.expArgs) {
+				t.Errorf("wrong args\ngot %q\nexp %q", gotArgs, test.expArgs)
+			}
+
+			var gotWarnings []string
+			for _, line := range sink.data {
+				if strings.HasPrefix(line, "# warning: ") {
+					gotWarnings = append(gotWarnings, line)
+				}
+			}
+			if fmt.Sprint(gotWarnings) != fmt.Sprint(test.expWarnings) {
+				t.Errorf("wrong warnings\ngot %q\nexp %q", gotWarnings, test.expWarnings)
+			}
+		})
+	}
+}
+
+func TestNewResticGraceful(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		expOutput string
+	}{
+		{
+			name:      "exits upon interrupt",
+			script:    "trap 'kill $!; echo interrupted; exit 130' INT\nsleep 10 &\nwait\n",
+			expOutput: "interrupted\n",
+		},
+		{
+			name:   "killed after grace period",
+			script: "trap '' INT\nexec sleep 10\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			bin := filepath.Join(dir, "restic")
+			if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+test.script), 0700); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("RESTIC_BIN", bin)
+
+			outSink, err := os.Create(filepath.Join(dir, "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = outSink.Close() }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			started := time.Now()
+			err = exec.NewResticGraceful(outSink, os.Stderr, 300*time.Millisecond).Run(ctx, "backup")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected error %v to wrap %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("took too long to stop, %s", elapsed)
+			}
+
+			output, err := os.ReadFile(filepath.Join(dir, "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != test.expOutput {
+				t.Errorf("wrong output; got %q, expected %q", output, test.expOutput)
+			}
+		})
+	}
+}
+
+func TestResticBatchLock(t *testing.T) {
+	datastores := []config.Datastore{
+		{
+			Name: "stuff",
+			Destinations: map[string]config.Destination{
+				"foo": {Name: "foo", Path: "foo"},
+			},
+		},
+		{
+			Name: "things",
+			Destinations: map[string]config.Destination{
+				"bar": {Name: "bar", Path: "bar"},
+			},
+		},
+	}
+
+	tests := []struct {
+		mode        lock.Mode
+		expErr      error
+		expReceived []string
+	}{
+		{mode: lock.ModeSkip, expReceived: []string{"--repo=foo"}},
+		{mode: lock.ModeFail, expErr: lock.ErrLocked, expReceived: []string{"--repo=foo"}},
+		{mode: lock.ModeWait, expErr: context.DeadlineExceeded, expReceived: []string{"--repo=foo"}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			dir := t.TempDir()
+
+			// Pretend another process is operating upon this destination.
+			held, err := lock.Acquire(context.Background(), dir, lock.Holder{Repo: "bar"}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = held.Release() }()
+
+			var received []string
+			observer := Observer{}
+			batch := exec.ResticBatch{
+				Subcommand: "test",
+				Run:        true,
+				Sink:       &Sink{},
+				Observer:   &observer,
+				LockDir:    dir,
+				LockMode:   test.mode,
+				NewCommand: func() exec.Command {
+					return &Command{RunResp: func(ctx context.Context, args ...string) error {
+						received = append(received, args[1])
+
+						// While restic runs, the destination is locked.
+						if _, err := lock.Acquire(ctx, dir, lock.Holder{Repo: "foo"}, false); !errors.Is(err, lock.ErrLocked) {
+							t.Errorf("expected error %v, got %v", lock.ErrLocked, err)
+						}
+						return nil
+					}}
+				},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err = batch.Do(ctx, resolve(t, "", datastores))
+			if test.expErr == nil && err != nil {
+				t.Fatal(err)
+			} else if !errors.Is(err, test.expErr) {
+				t.Fatalf("expected error %v, got %v", test.expErr, err)
+			}
+
+			if strings.Join(received, " ") != strings.Join(test.expReceived, " ") {
+				t.Errorf("wrong received args; got %q, expected %q", received, test.expReceived)
+			}
+
+			// A locked destination is never started, so it's not observed.
+			for _, event := range observer.events {
+				if strings.Contains(event, "things bar") {
+					t.Errorf("unexpected event %q", event)
+				}
+			}
+
+			// The lock is released afterwards.
+			next, err := lock.Acquire(context.Background(), dir, lock.Holder{Repo: "foo"}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = next.Release()
+		})
+	}
+}
+
+func TestResticBatchLockTimeout(t *testing.T) {
+	params, err := config.Parse(strings.NewReader(`
+[datastores.stuff.destinations.foo]
+path = 'foo'
+defaults.timeout.backup = '50ms'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// Pretend another process is operating upon this destination, for longer
+	// than the timeout.
+	held, err := lock.Acquire(context.Background(), dir, lock.Holder{Repo: "foo"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = held.Release() }()
+
+	var ran bool
+	batch := exec.ResticBatch{
+		Subcommand: "backup",
+		Run:        true,
+		LockDir:    dir,
+		LockMode:   lock.ModeWait,
+		NewCommand: func() exec.Command {
+			return &Command{RunResp: func(ctx context.Context, args ...string) error {
+				ran = true
+				return nil
+			}}
+		},
+	}
+
+	result, err := batch.Do(context.Background(), resolve(t, "", config.SelectDatastores(params.Datastores, nil, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Error("restic should not run without the lock")
+	}
+	if len(result.Destinations) != 1 {
+		t.Fatalf("wrong number of results; got %d, expected %d", len(result.Destinations), 1)
+	}
+	if got := result.Destinations[0].Outcome; got != exec.OutcomeTimeout {
+		t.Errorf("wrong Outcome; got %q, expected %q", got, exec.OutcomeTimeout)
+	}
+}
+
 type Sink struct{ data []string }
 
 func (s *Sink) Write(p []byte) (n int, err error) {
@@ -442,8 +1585,55 @@ func (c *Command) Run(ctx context.Context, args ...string) error {
 	return c.RunResp(ctx, args...)
 }
 
+type Observer struct{ events []string }
+
+func (o *Observer) Observe(ctx context.Context, event exec.Event) {
+	var out string
+	switch event.Kind {
+	case exec.EventStart:
+		out = "start " + event.Subcommand
+	case exec.EventFinish:
+		out = "finish " + event.Subcommand
+	case exec.EventSkip:
+		out = "skip " + event.Subcommand
+	}
+
+	if event.Destination != nil {
+		out += " " + event.Store.Name() + " " + event.Destination.Name()
+	}
+	if event.Kind != exec.EventStart {
+		out += fmt.Sprintf(" %v", event.Err)
+	}
+
+	o.events = append(o.events, out)
+}
+
 func pointToString(in string) (out *string) { return &in }
 
+// resolve outputs datastores as resolved config, in the same order. A
+// Datastore without a Name is named by its position.
+func resolve(t *testing.T, configDir string, datastores []config.Datastore) (out []config.ResolvedDatastore) {
+	t.Helper()
+
+	params := config.Params{Datastores: make(map[string]config.Datastore, len(datastores))}
+	names := make([]string, len(datastores))
+	for i, store := range datastores {
+		if names[i] = store.Name; names[i] == "" {
+			names[i] = strconv.Itoa(i)
+		}
+		params.Datastores[names[i]] = store
+	}
+
+	resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{ConfigDir: configDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		out = append(out, resolved.Select([]string{name}, nil)...)
+	}
+	return
+}
+
 // A primitive is any builtin type that is also the field type on a struct type
 // from this package.
 type primitive interface {
@@ -0,0 +1,217 @@
+// Package lock coordinates separate wrestic processes with advisory file locks,
+// so that no more than one of them operates upon a restic repository at a time.
+package lock
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mode says what to do when a lock is already held by another process.
+type Mode string
+
+const (
+	// ModeWait waits for the lock to be released.
+	ModeWait Mode = "wait"
+	// ModeSkip skips the destination and moves on.
+	ModeSkip Mode = "skip"
+	// ModeFail stops with an error.
+	ModeFail Mode = "fail"
+)
+
+// Modes are the known values for Mode.
+var Modes = []Mode{ModeWait, ModeSkip, ModeFail}
+
+// ParseMode converts in to a Mode. An empty input is ModeWait.
+func ParseMode(in string) (out Mode, err error) {
+	if in == "" {
+		out = ModeWait
+		return
+	}
+
+	for _, mode := range Modes {
+		if Mode(in) == mode {
+			out = mode
+			return
+		}
+	}
+
+	err = fmt.Errorf("invalid lock mode %q, should be one of %q", in, Modes)
+	return
+}
+
+// ErrLocked means that a lock is held by another process.
+var ErrLocked = errors.New("locked")
+
+// Holder describes the process holding a lock. It's written into the lock file,
+// so that other processes may report what's running.
+type Holder struct {
+	Repo        string    `json:"repo"`
+	Store       string    `json:"store"`
+	Destination string    `json:"destination"`
+	Subcommand  string    `json:"subcommand"`
+	PID         int       `json:"pid"`
+	Command     []string  `json:"command"`
+	Acquired    time.Time `json:"acquired"`
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("pid %d (%s)", h.PID, strings.Join(h.Command, " "))
+}
+
+// A Lock is held upon a restic repository until it's released.
+type Lock struct {
+	file *os.File
+}
+
+// Release gives up the Lock.
+func (l *Lock) Release() (err error) {
+	if l == nil || l.file == nil {
+		return
+	}
+
+	// Clear out the holder first, so that nobody reads stale info about it.
+	if err = l.file.Truncate(0); err != nil {
+		_ = l.file.Close()
+		return
+	}
+	if err = unlockFile(l.file); err != nil {
+		_ = l.file.Close()
+		return
+	}
+	err = l.file.Close()
+	l.file = nil
+	return
+}
+
+// pollInterval is how often to try for a lock while waiting for it.
+var pollInterval = 250 * time.Millisecond
+
+// Acquire takes the lock on holder.Repo, in the directory dir. The PID and
+// Acquired fields of holder are filled in. If the lock is held by another
+// process and wait is false, then the error is ErrLocked. Otherwise, it waits
+// until the lock is released or ctx is done.
+//
+// The operating system releases the lock if the process exits without calling
+// Release, so a lock is never stale.
+func Acquire(ctx context.Context, dir string, holder Holder, wait bool) (out *Lock, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, filename(holder.Repo)), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	for {
+		err = tryLockFile(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLocked) || !wait {
+			if errors.Is(err, ErrLocked) {
+				if held, ok := readHolder(file); ok {
+					err = fmt.Errorf("%w by %s", err, held)
+				}
+			}
+			_ = file.Close()
+			return
+		}
+
+		timer := time.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			_ = file.Close()
+			err = ctx.Err()
+			return
+		case <-timer.C:
+		}
+	}
+
+	holder.PID, holder.Acquired = os.Getpid(), time.Now()
+	if err = writeHolder(file, holder); err != nil {
+		_ = unlockFile(file)
+		_ = file.Close()
+		return
+	}
+
+	out = &Lock{file: file}
+	return
+}
+
+// List outputs the holders of every lock in dir that's currently held, sorted
+// by repo. A missing dir is not an error.
+func List(dir string) (out []Holder, err error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.lock"))
+	if err != nil {
+		return
+	}
+
+	for _, name := range filenames {
+		file, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err = tryLockFile(file); err == nil {
+			// Nobody else has it.
+			_ = unlockFile(file)
+			_ = file.Close()
+			continue
+		} else if !errors.Is(err, ErrLocked) {
+			_ = file.Close()
+			return nil, err
+		}
+
+		// The holder may not have written itself down yet. Report what's known.
+		holder, _ := readHolder(file)
+		_ = file.Close()
+		out = append(out, holder)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Repo < out[j].Repo })
+	return
+}
+
+// filename is derived from the repo, which could be a path, URL or some other
+// restic backend specifier, so hash it for a safe name.
+func filename(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	return hex.EncodeToString(sum[:16]) + ".lock"
+}
+
+func writeHolder(file *os.File, holder Holder) (err error) {
+	raw, err := json.Marshal(holder)
+	if err != nil {
+		return
+	}
+
+	if err = file.Truncate(0); err != nil {
+		return
+	}
+	_, err = file.WriteAt(raw, 0)
+	return
+}
+
+func readHolder(file *os.File) (out Holder, ok bool) {
+	raw, err := os.ReadFile(file.Name())
+	if err != nil || len(raw) < 1 {
+		return
+	}
+
+	ok = json.Unmarshal(raw, &out) == nil
+	return
+}
@@ -0,0 +1,127 @@
+package lock_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/lock"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in       string
+		expOut   lock.Mode
+		expError bool
+	}{
+		{in: "", expOut: lock.ModeWait},
+		{in: "wait", expOut: lock.ModeWait},
+		{in: "skip", expOut: lock.ModeSkip},
+		{in: "fail", expOut: lock.ModeFail},
+		{in: "nope", expError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := lock.ParseMode(test.in)
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatal("expected an error")
+			}
+			if got != test.expOut {
+				t.Errorf("wrong output; got %q, expected %q", got, test.expOut)
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	holder := lock.Holder{Repo: "/srv/restic/foo", Store: "stuff", Destination: "foo", Subcommand: "backup", Command: []string{"wrestic", "exec", "backup"}}
+
+	held, err := lock.Acquire(ctx, dir, holder, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A different repo is not affected.
+	other, err := lock.Acquire(ctx, dir, lock.Holder{Repo: "/srv/restic/bar"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("List", func(t *testing.T) {
+		holders, err := lock.List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(holders) != 1 {
+			t.Fatalf("wrong number of holders; got %d, expected %d", len(holders), 1)
+		}
+
+		got := holders[0]
+		if got.Repo != holder.Repo || got.Store != holder.Store || got.Destination != holder.Destination || got.Subcommand != holder.Subcommand {
+			t.Errorf("wrong holder; got %#v, expected %#v", got, holder)
+		}
+		if got.PID != os.Getpid() {
+			t.Errorf("wrong PID; got %d, expected %d", got.PID, os.Getpid())
+		}
+		if got.Acquired.IsZero() {
+			t.Error("expected non-empty Acquired")
+		}
+	})
+
+	t.Run("no wait", func(t *testing.T) {
+		_, err := lock.Acquire(ctx, dir, holder, false)
+		if !errors.Is(err, lock.ErrLocked) {
+			t.Fatalf("expected error %v, got %v", lock.ErrLocked, err)
+		}
+		if msg := err.Error(); msg != "locked by pid "+strconv.Itoa(os.Getpid())+" (wrestic exec backup)" {
+			t.Errorf("wrong error message %q", msg)
+		}
+	})
+
+	t.Run("wait canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := lock.Acquire(ctx, dir, holder, true)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected error %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = held.Release()
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		next, err := lock.Acquire(ctx, dir, holder, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = next.Release(); err != nil {
+			t.Fatal(err)
+		}
+
+		holders, err := lock.List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(holders) != 0 {
+			t.Errorf("expected no holders after release, got %#v", holders)
+		}
+	})
+}
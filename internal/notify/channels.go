@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Webhook sends a Message to URL with an HTTP POST request.
+type Webhook struct {
+	URL string
+	// Template is the request body, see config.NotifyWebhook.
+	Template string
+	Headers  map[string]string
+	Client   *http.Client
+}
+
+// Send implements Channel.
+func (w Webhook) Send(ctx context.Context, msg Message) (err error) {
+	var body bytes.Buffer
+
+	if w.Template == "" {
+		err = json.NewEncoder(&body).Encode(msg)
+	} else {
+		err = renderWebhookBody(&body, w.Template, msg)
+	}
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range w.Headers {
+		req.Header.Set(key, val)
+	}
+
+	return doRequest(w.Client, req)
+}
+
+func renderWebhookBody(w io.Writer, text string, msg Message) error {
+	fns := template.FuncMap{
+		"json": func(in any) (string, error) {
+			raw, err := json.Marshal(in)
+			return string(raw), err
+		},
+	}
+
+	tmpl, err := template.New("webhook").Funcs(fns).Parse(text)
+	if err != nil {
+		return fmt.Errorf("%w: webhook template is invalid", err)
+	}
+
+	return tmpl.Execute(w, msg)
+}
+
+// Healthchecks pings URL in the style of https://healthchecks.io.
+type Healthchecks struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements Channel.
+func (h Healthchecks) Send(ctx context.Context, msg Message) (err error) {
+	url := strings.TrimSuffix(h.URL, "/")
+	switch msg.Status {
+	case StatusStart:
+		url += "/start"
+	case StatusFailure:
+		url += "/fail"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(msg.Summary()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	return doRequest(h.Client, req)
+}
+
+func doRequest(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %q from %s", resp.Status, req.URL.Redacted())
+	}
+
+	return nil
+}
+
+// SMTP sends a Message as mail.
+type SMTP struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// Send implements Channel. The context is not consulted, because the standard
+// library's SMTP client does not take one.
+func (s SMTP) Send(_ context.Context, msg Message) error {
+	if len(s.To) < 1 {
+		return fmt.Errorf("smtp: no recipients")
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := strings.Cut(s.Addr, ":")
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", headerValue(s.From))
+	fmt.Fprintf(&body, "To: %s\r\n", headerValue(strings.Join(s.To, ", ")))
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(msg.Summary())))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&body, "host:        %s\r\n", msg.Host)
+	fmt.Fprintf(&body, "subcommand:  %s\r\n", msg.Subcommand)
+	if msg.Store != "" || msg.Destination != "" {
+		fmt.Fprintf(&body, "store:       %s\r\n", msg.Store)
+		fmt.Fprintf(&body, "destination: %s\r\n", msg.Destination)
+	}
+	fmt.Fprintf(&body, "status:      %s\r\n", msg.Status)
+	fmt.Fprintf(&body, "started:     %s\r\n", msg.Started.Format(time.RFC3339))
+	fmt.Fprintf(&body, "finished:    %s\r\n", msg.Finished.Format(time.RFC3339))
+	if msg.Error != "" {
+		// Any more lines are indented, so that they're told apart from the
+		// fields above.
+		lines := splitLines(msg.Error)
+		fmt.Fprintf(&body, "error:       %s\r\n", strings.Join(lines, "\r\n             "))
+	}
+
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, body.Bytes())
+}
+
+// headerValue puts in on one line, so that it cannot end a mail header and
+// start another. The output of restic, in an error, may have several lines.
+func headerValue(in string) string {
+	return strings.Join(splitLines(in), " ")
+}
+
+// splitLines splits in at any CR or LF, and leaves out empty lines.
+func splitLines(in string) []string {
+	return strings.FieldsFunc(in, func(r rune) bool { return r == '\r' || r == '\n' })
+}
@@ -0,0 +1,262 @@
+// Package notify reports outcomes of running restic subcommands through
+// channels such as webhooks, healthchecks.io-style pings and mail.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+)
+
+// Status is the state of a Message.
+type Status string
+
+const (
+	StatusStart   Status = "start"
+	StatusSuccess Status = "success"
+	StatusFailure Status = "failure"
+)
+
+// Message is the data sent through a channel. It's also the data available to
+// a webhook template.
+type Message struct {
+	Host        string    `json:"host"`
+	Subcommand  string    `json:"subcommand"`
+	Store       string    `json:"store,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Status      Status    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	// Recovered is true when the Status is a success after a failure.
+	Recovered bool `json:"recovered"`
+}
+
+// Summary is a one-line human-readable description of the Message.
+func (m Message) Summary() (out string) {
+	out = fmt.Sprintf("wrestic %s %s", m.Subcommand, m.Status)
+	if m.Store != "" || m.Destination != "" {
+		out += fmt.Sprintf(" store=%q destination=%q", m.Store, m.Destination)
+	}
+	if m.Host != "" {
+		out += fmt.Sprintf(" host=%q", m.Host)
+	}
+	if m.Error != "" {
+		out += ": " + m.Error
+	}
+	return
+}
+
+// A Channel delivers a Message somewhere.
+type Channel interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Dispatcher sends notifications about a batch of restic subcommands, per the
+// NotifyConfig found in merged Defaults. It implements exec.Observer.
+type Dispatcher struct {
+	// Defaults are the top-level configuration values. They're consulted for
+	// notifications scoped to the whole batch.
+	Defaults config.Defaults
+	// StateDir is where the outcomes of previous runs are recorded, so that a
+	// recovery may be detected. If empty, then recoveries are not detected.
+	StateDir string
+	// ErrSink captures errors from sending notifications. A failure to notify
+	// does not fail the restic subcommand.
+	ErrSink io.Writer
+
+	mtx     sync.Mutex
+	started map[string]time.Time
+}
+
+// Observe implements exec.Observer.
+func (d *Dispatcher) Observe(ctx context.Context, event exec.Event) {
+	if event.Kind == exec.EventSkip {
+		// Restic didn't run, so there's no outcome to report.
+		return
+	}
+
+	var (
+		key  = stateKey(event)
+		conf *config.NotifyConfig
+		msg  = Message{Subcommand: event.Subcommand}
+	)
+
+	msg.Host, _ = os.Hostname()
+
+	if event.Destination == nil {
+		conf = d.Defaults.Notify
+		if conf == nil || valueOr(conf.Scope, config.NotifyScopeDestination) != config.NotifyScopeBatch {
+			return
+		}
+	} else {
+		merged, err := event.Destination.Merge()
+		if err != nil {
+			d.logErr(err)
+			return
+		}
+		conf = merged.Notify
+		if conf == nil || valueOr(conf.Scope, config.NotifyScopeDestination) != config.NotifyScopeDestination {
+			return
+		}
+		msg.Store, msg.Destination = event.Store.Name(), event.Destination.Name()
+	}
+
+	channels := Channels(conf)
+	if len(channels) < 1 {
+		return
+	}
+
+	d.mtx.Lock()
+	if d.started == nil {
+		d.started = make(map[string]time.Time)
+	}
+	switch event.Kind {
+	case exec.EventStart:
+		d.started[key] = event.Time
+		msg.Status, msg.Started = StatusStart, event.Time
+	case exec.EventFinish:
+		msg.Started, msg.Finished = d.started[key], event.Time
+		delete(d.started, key)
+		if event.Err != nil {
+			msg.Status, msg.Error = StatusFailure, event.Err.Error()
+		} else {
+			msg.Status = StatusSuccess
+		}
+	}
+	d.mtx.Unlock()
+
+	if msg.Status != StatusStart {
+		prev, err := d.swapState(key, msg.Status)
+		if err != nil {
+			d.logErr(err)
+		}
+		msg.Recovered = msg.Status == StatusSuccess && prev == StatusFailure
+	}
+
+	on := valueOr(conf.On, config.NotifyOnFailure)
+	for _, channel := range channels {
+		if _, ok := channel.(Healthchecks); !ok && !ShouldSend(on, msg) {
+			continue
+		}
+		if err := channel.Send(ctx, msg); err != nil {
+			d.logErr(fmt.Errorf("%w: %s", err, msg.Summary()))
+		}
+	}
+}
+
+// ShouldSend decides if msg should be sent, given on, a value of
+// config.NotifyConfig.On. Start messages are never sent by this criteria.
+func ShouldSend(on string, msg Message) bool {
+	if msg.Status == StatusStart {
+		return false
+	}
+
+	switch on {
+	case config.NotifyOnAlways:
+		return true
+	case config.NotifyOnRecovery:
+		return msg.Status == StatusFailure || msg.Recovered
+	default:
+		return msg.Status == StatusFailure
+	}
+}
+
+// Channels constructs a Channel for each one configured in conf.
+func Channels(conf *config.NotifyConfig) (out []Channel) {
+	if conf == nil {
+		return
+	}
+
+	if conf.Webhook != nil && conf.Webhook.URL != nil {
+		out = append(out, Webhook{
+			URL:      *conf.Webhook.URL,
+			Template: valueOr(conf.Webhook.Template, ""),
+			Headers:  valueOr(conf.Webhook.Headers, nil),
+		})
+	}
+	if conf.Healthchecks != nil && conf.Healthchecks.URL != nil {
+		out = append(out, Healthchecks{URL: *conf.Healthchecks.URL})
+	}
+	if conf.SMTP != nil && conf.SMTP.Addr != nil {
+		smtp := SMTP{
+			Addr:     *conf.SMTP.Addr,
+			From:     valueOr(conf.SMTP.From, ""),
+			To:       valueOr(conf.SMTP.To, nil),
+			Username: valueOr(conf.SMTP.Username, ""),
+		}
+		if conf.SMTP.PasswordEnv != nil {
+			smtp.Password = os.Getenv(*conf.SMTP.PasswordEnv)
+		}
+		out = append(out, smtp)
+	}
+
+	return
+}
+
+func (d *Dispatcher) logErr(err error) {
+	if d.ErrSink != nil {
+		fmt.Fprintf(d.ErrSink, "notify: %v\n", err)
+	}
+}
+
+// stateMtx guards the state file, which may be shared by several Dispatchers
+// in a long-running process.
+var stateMtx sync.Mutex
+
+// swapState records the latest Status for key and returns the previous one.
+func (d *Dispatcher) swapState(key string, curr Status) (prev Status, err error) {
+	if d.StateDir == "" {
+		return
+	}
+
+	stateMtx.Lock()
+	defer stateMtx.Unlock()
+
+	filename := filepath.Join(d.StateDir, "notify.json")
+	state := make(map[string]Status)
+
+	raw, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err == nil {
+		if err = json.Unmarshal(raw, &state); err != nil {
+			return
+		}
+	}
+
+	prev = state[key]
+	state[key] = curr
+
+	if raw, err = json.Marshal(state); err != nil {
+		return
+	}
+	if err = os.MkdirAll(d.StateDir, 0700); err != nil {
+		return
+	}
+	err = os.WriteFile(filename, raw, 0600)
+	return
+}
+
+func stateKey(event exec.Event) string {
+	if event.Destination == nil {
+		return event.Subcommand
+	}
+	return event.Subcommand + "/" + event.Store.Name() + "/" + event.Destination.Name()
+}
+
+func valueOr[T any](in *T, otherwise T) T {
+	if in == nil {
+		return otherwise
+	}
+	return *in
+}
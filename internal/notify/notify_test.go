@@ -0,0 +1,316 @@
+package notify_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/exec"
+	"github.com/rafaelespinoza/wrestic/internal/notify"
+)
+
+func TestShouldSend(t *testing.T) {
+	tests := []struct {
+		on       string
+		msg      notify.Message
+		expected bool
+	}{
+		{on: "failure", msg: notify.Message{Status: notify.StatusStart}, expected: false},
+		{on: "failure", msg: notify.Message{Status: notify.StatusFailure}, expected: true},
+		{on: "failure", msg: notify.Message{Status: notify.StatusSuccess}, expected: false},
+		{on: "failure", msg: notify.Message{Status: notify.StatusSuccess, Recovered: true}, expected: false},
+		{on: "", msg: notify.Message{Status: notify.StatusFailure}, expected: true},
+		{on: "always", msg: notify.Message{Status: notify.StatusStart}, expected: false},
+		{on: "always", msg: notify.Message{Status: notify.StatusFailure}, expected: true},
+		{on: "always", msg: notify.Message{Status: notify.StatusSuccess}, expected: true},
+		{on: "recovery", msg: notify.Message{Status: notify.StatusFailure}, expected: true},
+		{on: "recovery", msg: notify.Message{Status: notify.StatusSuccess}, expected: false},
+		{on: "recovery", msg: notify.Message{Status: notify.StatusSuccess, Recovered: true}, expected: true},
+	}
+
+	for i, test := range tests {
+		got := notify.ShouldSend(test.on, test.msg)
+		if got != test.expected {
+			t.Errorf("test[%d] on=%q, status=%q, recovered=%t; got %t, expected %t",
+				i, test.on, test.msg.Status, test.msg.Recovered, got, test.expected)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		status    int
+		expBody   string
+		expError  bool
+		expHeader string
+	}{
+		{
+			name:    "default body",
+			status:  http.StatusOK,
+			expBody: `{"host":"h","subcommand":"backup","store":"s","destination":"d","status":"failure","error":"oops","started":"0001-01-01T00:00:00Z","finished":"0001-01-01T00:00:00Z","recovered":false}`,
+		},
+		{
+			name:     "template",
+			template: `{"text": {{ json .Summary }}, "dest": {{ json .Destination }}}`,
+			status:   http.StatusNoContent,
+			expBody:  `{"text": "wrestic backup failure store=\"s\" destination=\"d\" host=\"h\": oops", "dest": "d"}`,
+		},
+		{
+			name:     "bad template",
+			template: `{{ nope }}`,
+			expError: true,
+		},
+		{
+			name:     "error response",
+			status:   http.StatusInternalServerError,
+			expError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotBody, gotHeader string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				raw, _ := io.ReadAll(r.Body)
+				gotBody, gotHeader = strings.TrimSpace(string(raw)), r.Header.Get("X-Test")
+				w.WriteHeader(test.status)
+			}))
+			defer srv.Close()
+
+			webhook := notify.Webhook{URL: srv.URL, Template: test.template, Headers: map[string]string{"X-Test": "yes"}}
+			msg := notify.Message{Host: "h", Subcommand: "backup", Store: "s", Destination: "d", Status: notify.StatusFailure, Error: "oops"}
+
+			err := webhook.Send(context.Background(), msg)
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatal("expected an error")
+			} else if test.expError {
+				return
+			}
+
+			if gotBody != test.expBody {
+				t.Errorf("wrong body\ngot %s\nexp %s", gotBody, test.expBody)
+			}
+			if gotHeader != "yes" {
+				t.Errorf("wrong header; got %q, expected %q", gotHeader, "yes")
+			}
+		})
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		received []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if r.URL.Path == "/hook" {
+			var msg notify.Message
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+				t.Error(err)
+			}
+			received = append(received, "hook "+string(msg.Status)+" "+msg.Destination)
+			return
+		}
+		received = append(received, "ping "+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	params, err := config.Parse(strings.NewReader(`
+[defaults.notify]
+on = 'recovery'
+
+[defaults.notify.webhook]
+url = '` + srv.URL + `/hook'
+
+[datastores.stuff.destinations.foo]
+path = 'foo'
+
+[datastores.stuff.destinations.foo.defaults.notify.healthchecks]
+url = '` + srv.URL + `/hc/foo'
+
+[datastores.stuff.destinations.bar]
+path = 'bar'
+
+[datastores.stuff.destinations.bar.defaults.notify]
+on = 'always'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := config.Resolve([]config.Params{params}, config.ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := notify.Dispatcher{Defaults: params.Defaults, StateDir: t.TempDir()}
+	store := resolved.Datastores()[0]
+	bar, foo := store.Destinations()[0], store.Destinations()[1]
+
+	run := func(dest config.ResolvedDestination, err error) {
+		ctx := context.Background()
+		dispatcher.Observe(ctx, exec.Event{Kind: exec.EventStart, Subcommand: "backup", Store: &store, Destination: &dest, Time: time.Now()})
+		dispatcher.Observe(ctx, exec.Event{Kind: exec.EventFinish, Subcommand: "backup", Store: &store, Destination: &dest, Time: time.Now(), Err: err})
+	}
+
+	run(foo, nil)
+	run(foo, errors.New("oops"))
+	run(foo, errors.New("oops"))
+	run(foo, nil)
+	run(foo, nil)
+	run(bar, nil)
+
+	// batch-scoped notifications are not configured, should be ignored.
+	dispatcher.Observe(context.Background(), exec.Event{Kind: exec.EventFinish, Subcommand: "backup", Err: errors.New("oops")})
+
+	expected := []string{
+		"ping /hc/foo/start", "ping /hc/foo",
+		"ping /hc/foo/start", "hook failure foo", "ping /hc/foo/fail",
+		"ping /hc/foo/start", "hook failure foo", "ping /hc/foo/fail",
+		"ping /hc/foo/start", "hook success foo", "ping /hc/foo",
+		"ping /hc/foo/start", "ping /hc/foo",
+		"hook success bar",
+	}
+
+	testStrings(t, "received", received, expected)
+}
+
+func TestSMTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         string
+		expected    []string
+		notExpected []string
+	}{
+		{
+			name: "ok",
+			err:  "oops",
+			expected: []string{
+				"From: wrestic@localhost\r\n",
+				"To: root@localhost\r\n",
+				`Subject: wrestic check failure store="s" destination="d" host="h": oops` + "\r\n",
+				"error:       oops\r\n",
+			},
+		},
+		{
+			// The error, from restic, may have several lines. They should not
+			// end the subject and start other headers.
+			name: "multi-line error",
+			err:  "oops\r\nBcc: someone@example.com\nmore",
+			expected: []string{
+				`Subject: wrestic check failure store="s" destination="d" host="h": oops Bcc: someone@example.com more` + "\r\n",
+				"error:       oops\r\n             Bcc: someone@example.com\r\n             more\r\n",
+			},
+			notExpected: []string{"\nBcc:"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = ln.Close() }()
+
+			gotData := make(chan string, 1)
+			go serveFakeSMTP(t, ln, gotData)
+
+			mailer := notify.SMTP{Addr: ln.Addr().String(), From: "wrestic@localhost", To: []string{"root@localhost"}}
+			msg := notify.Message{Host: "h", Subcommand: "check", Store: "s", Destination: "d", Status: notify.StatusFailure, Error: test.err}
+
+			if err = mailer.Send(context.Background(), msg); err != nil {
+				t.Fatal(err)
+			}
+
+			data := <-gotData
+			for _, exp := range test.expected {
+				if !strings.Contains(data, exp) {
+					t.Errorf("expected mail data to contain %q\n%s", exp, data)
+				}
+			}
+			for _, unexp := range test.notExpected {
+				if strings.Contains(data, unexp) {
+					t.Errorf("expected mail data not to contain %q\n%s", unexp, data)
+				}
+			}
+		})
+	}
+}
+
+// serveFakeSMTP accepts one connection and speaks just enough SMTP to receive
+// one message. The message data is sent to out.
+func serveFakeSMTP(t *testing.T, ln net.Listener, out chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	reply := func(line string) {
+		_, _ = rw.WriteString(line + "\r\n")
+		_ = rw.Flush()
+	}
+
+	reply("220 localhost fake")
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err = rw.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			out <- data.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func testStrings(t *testing.T, errPrefix string, actual, expected []string) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("%s wrong length; got %d, expected %d\n%q", errPrefix, len(actual), len(expected), actual)
+	}
+
+	for i, got := range actual {
+		if exp := expected[i]; got != exp {
+			t.Errorf("%s[%d] got %q, expected %q", errPrefix, i, got, exp)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package schedule
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+)
+
+// Jobs collects each scheduled subcommand of datastores. Subcommands not
+// listed in subcmds are rejected. The output is sorted by store name and then
+// by subcommand.
+func Jobs(datastores []config.Datastore, subcmds []string, bin, configDir string) (out []Job, err error) {
+	known := make(map[string]bool, len(subcmds))
+	for _, subcmd := range subcmds {
+		known[subcmd] = true
+	}
+
+	for _, store := range datastores {
+		for subcmd, text := range store.Schedule {
+			if !known[subcmd] {
+				return nil, fmt.Errorf("store %q: unknown subcommand %q in schedule, should be one of %q", store.Name, subcmd, subcmds)
+			}
+
+			spec, err := Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("store %q: %w", store.Name, err)
+			}
+
+			out = append(out, Job{Store: store.Name, Subcommand: subcmd, Spec: spec, Bin: bin, ConfigDir: configDir})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Store != out[j].Store {
+			return out[i].Store < out[j].Store
+		}
+		return out[i].Subcommand < out[j].Subcommand
+	})
+
+	// The names of stores are escaped for systemd, so different names may end
+	// up the same. Then one job's units would overwrite another's.
+	stores := make(map[string]string, len(out))
+	for _, job := range out {
+		if other, ok := stores[job.Name()]; ok && other != job.Store {
+			return nil, fmt.Errorf("stores %q and %q would have the same unit name, %q; rename one of them", other, job.Store, job.Name())
+		}
+		stores[job.Name()] = job.Store
+	}
+
+	return
+}
@@ -0,0 +1,261 @@
+package schedule_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelespinoza/wrestic/internal/config"
+	"github.com/rafaelespinoza/wrestic/internal/schedule"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input         string
+		expCron       string
+		expOnCalendar string
+		expError      bool
+	}{
+		{input: "hourly", expCron: "0 * * * *", expOnCalendar: "*-*-* *:00:00"},
+		{input: "hourly :30", expCron: "30 * * * *", expOnCalendar: "*-*-* *:30:00"},
+		{input: "@daily", expCron: "0 0 * * *", expOnCalendar: "*-*-* 00:00:00"},
+		{input: "daily 02:00", expCron: "0 2 * * *", expOnCalendar: "*-*-* 02:00:00"},
+		{input: "Daily 14:05", expCron: "5 14 * * *", expOnCalendar: "*-*-* 14:05:00"},
+		{input: "weekly", expCron: "0 0 * * 1", expOnCalendar: "Mon *-*-* 00:00:00"},
+		{input: "weekly sun 03:30", expCron: "30 3 * * 0", expOnCalendar: "Sun *-*-* 03:30:00"},
+		{input: "monthly", expCron: "0 0 1 * *", expOnCalendar: "*-*-01 00:00:00"},
+		{input: "monthly 15 01:00", expCron: "0 1 15 * *", expOnCalendar: "*-*-15 01:00:00"},
+		{input: "*/15 * * * *", expCron: "0,15,30,45 * * * *", expOnCalendar: "*-*-* *:00,15,30,45:00"},
+		{input: "0 9-17 * * mon-fri", expCron: "0 9,10,11,12,13,14,15,16,17 * * 1,2,3,4,5", expOnCalendar: "Mon..Fri *-*-* 09..17:00:00"},
+		{input: "0 0 * jan,jul 7", expCron: "0 0 * 1,7 0", expOnCalendar: "Sun *-01,07-* 00:00:00"},
+		{input: "", expError: true},
+		{input: "daily 25:00", expError: true},
+		{input: "hourly 02:00", expError: true},
+		{input: "daily sun", expError: true},
+		{input: "* * *", expError: true},
+		{input: "60 * * * *", expError: true},
+		{input: "*/0 * * * *", expError: true},
+		{input: "5-1 * * * *", expError: true},
+		{input: "0 0 1 * mon", expError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			spec, err := schedule.Parse(test.input)
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatalf("expected an error; got %q", spec.Cron())
+			} else if test.expError {
+				return
+			}
+
+			if got := spec.Cron(); got != test.expCron {
+				t.Errorf("wrong Cron; got %q, expected %q", got, test.expCron)
+			}
+			if got := spec.OnCalendar(); got != test.expOnCalendar {
+				t.Errorf("wrong OnCalendar; got %q, expected %q", got, test.expOnCalendar)
+			}
+			if got := spec.String(); got != test.input {
+				t.Errorf("wrong String; got %q, expected %q", got, test.input)
+			}
+		})
+	}
+}
+
+func TestSpecNext(t *testing.T) {
+	loc := time.UTC
+	from := time.Date(2024, time.January, 31, 23, 30, 15, 0, loc) // a Wednesday
+
+	tests := []struct {
+		input    string
+		expected time.Time
+	}{
+		{input: "hourly", expected: time.Date(2024, time.February, 1, 0, 0, 0, 0, loc)},
+		{input: "hourly :45", expected: time.Date(2024, time.January, 31, 23, 45, 0, 0, loc)},
+		{input: "daily 02:00", expected: time.Date(2024, time.February, 1, 2, 0, 0, 0, loc)},
+		{input: "daily 23:31", expected: time.Date(2024, time.January, 31, 23, 31, 0, 0, loc)},
+		{input: "daily 23:30", expected: time.Date(2024, time.February, 1, 23, 30, 0, 0, loc)},
+		{input: "weekly", expected: time.Date(2024, time.February, 5, 0, 0, 0, 0, loc)},
+		{input: "weekly wed 23:59", expected: time.Date(2024, time.January, 31, 23, 59, 0, 0, loc)},
+		{input: "monthly 29", expected: time.Date(2024, time.February, 29, 0, 0, 0, 0, loc)},
+		{input: "0 12 * mar *", expected: time.Date(2024, time.March, 1, 12, 0, 0, 0, loc)},
+		{input: "* * * * *", expected: time.Date(2024, time.January, 31, 23, 31, 0, 0, loc)},
+		{input: "0 0 31 2 *", expected: time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			spec, err := schedule.Parse(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := spec.Next(from); !got.Equal(test.expected) {
+				t.Errorf("got %s, expected %s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestJobs(t *testing.T) {
+	datastores := []config.Datastore{
+		{Name: "things", Schedule: map[string]string{"check": "weekly", "backup": "daily 02:00"}},
+		{Name: "nothing"},
+		{Name: "my stuff", Schedule: map[string]string{"backup": "hourly"}},
+	}
+
+	jobs, err := schedule.Jobs(datastores, []string{"backup", "check"}, "/usr/bin/wrestic", "/etc/wrestic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, job := range jobs {
+		got = append(got, schedule.CrontabLine(job))
+	}
+	expected := []string{
+		"0 * * * * /usr/bin/wrestic exec backup -x -storenames 'my stuff' -config-dir /etc/wrestic",
+		"0 2 * * * /usr/bin/wrestic exec backup -x -storenames things -config-dir /etc/wrestic",
+		"0 0 * * 1 /usr/bin/wrestic exec check -x -storenames things -config-dir /etc/wrestic",
+	}
+	testStrings(t, "CrontabLine", got, expected)
+
+	withFile := jobs[0]
+	withFile.ConfigFile = "/etc/wrestic/other.toml"
+	withFile.SystemConfigFile = pointTo("/opt/wrestic.toml")
+	if got, exp := schedule.CrontabLine(withFile), "0 * * * * /usr/bin/wrestic exec backup -x -storenames 'my stuff' -config-dir /etc/wrestic -config-file /etc/wrestic/other.toml -system-config=/opt/wrestic.toml"; got != exp {
+		t.Errorf("wrong CrontabLine with config files\ngot %q\nexp %q", got, exp)
+	}
+
+	// An empty system config file says to ignore it, so it's passed along too.
+	withoutSystem := jobs[0]
+	withoutSystem.SystemConfigFile = pointTo("")
+	if got, exp := schedule.CrontabLine(withoutSystem), "0 * * * * /usr/bin/wrestic exec backup -x -storenames 'my stuff' -config-dir /etc/wrestic -system-config="; got != exp {
+		t.Errorf("wrong CrontabLine without system config\ngot %q\nexp %q", got, exp)
+	}
+	if exp := "ExecStart=/usr/bin/wrestic exec backup -x -storenames \"my stuff\" -config-dir /etc/wrestic -system-config=\n"; !strings.Contains(schedule.SystemdUnits(withoutSystem)[0].Contents, exp) {
+		t.Errorf("expected service to contain %q\n%s", exp, schedule.SystemdUnits(withoutSystem)[0].Contents)
+	}
+
+	units := schedule.SystemdUnits(jobs[0])
+	if len(units) != 2 {
+		t.Fatalf("wrong number of units; got %d, expected %d", len(units), 2)
+	}
+	if units[0].Name != "wrestic-my_stuff-backup.service" {
+		t.Errorf("wrong service name %q", units[0].Name)
+	}
+	if exp := `ExecStart=/usr/bin/wrestic exec backup -x -storenames "my stuff" -config-dir /etc/wrestic`; !strings.Contains(units[0].Contents, exp) {
+		t.Errorf("expected service to contain %q\n%s", exp, units[0].Contents)
+	}
+	if units[1].Name != "wrestic-my_stuff-backup.timer" {
+		t.Errorf("wrong timer name %q", units[1].Name)
+	}
+	if exp := "OnCalendar=*-*-* *:00:00\n"; !strings.Contains(units[1].Contents, exp) {
+		t.Errorf("expected timer to contain %q\n%s", exp, units[1].Contents)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := schedule.Jobs([]config.Datastore{{Name: "x", Schedule: map[string]string{"prune": "daily"}}}, []string{"backup"}, "wrestic", "")
+		if err == nil || !strings.Contains(err.Error(), "unknown subcommand") {
+			t.Errorf("expected error about unknown subcommand, got %v", err)
+		}
+
+		_, err = schedule.Jobs([]config.Datastore{{Name: "x", Schedule: map[string]string{"backup": "sometimes"}}}, []string{"backup"}, "wrestic", "")
+		if err == nil || !strings.Contains(err.Error(), `store "x"`) {
+			t.Errorf("expected error about store, got %v", err)
+		}
+
+		for _, name := range []string{"a_b", "a b"} {
+			_, err = schedule.Jobs([]config.Datastore{
+				{Name: "a-b", Schedule: map[string]string{"backup": "daily"}},
+				{Name: name, Schedule: map[string]string{"backup": "weekly"}},
+			}, []string{"backup"}, "wrestic", "")
+			if err == nil || !strings.Contains(err.Error(), "same unit name") {
+				t.Errorf("expected error about the same unit name for %q, got %v", name, err)
+			}
+		}
+	})
+}
+
+func TestInstall(t *testing.T) {
+	dir := t.TempDir()
+
+	// A file not generated by wrestic should be left alone.
+	handwritten := filepath.Join(dir, "wrestic-handwritten.timer")
+	if err := os.WriteFile(handwritten, []byte("[Timer]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := schedule.Parse("daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alfa := schedule.SystemdUnits(schedule.Job{Store: "alfa", Subcommand: "backup", Spec: spec, Bin: "wrestic"})
+	bravo := schedule.SystemdUnits(schedule.Job{Store: "bravo", Subcommand: "backup", Spec: spec, Bin: "wrestic"})
+
+	if err = schedule.Install(dir, append(alfa, bravo...)); err != nil {
+		t.Fatal(err)
+	}
+	testDirEntries(t, dir, []string{
+		"wrestic-alfa-backup.service", "wrestic-alfa-backup.timer",
+		"wrestic-bravo-backup.service", "wrestic-bravo-backup.timer",
+		"wrestic-handwritten.timer",
+	})
+
+	// Units which are not wanted anymore should be removed.
+	write, remove, err := schedule.Plan(dir, bravo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStrings(t, "write", write, []string{"wrestic-bravo-backup.service", "wrestic-bravo-backup.timer"})
+	testStrings(t, "remove", remove, []string{"wrestic-alfa-backup.service", "wrestic-alfa-backup.timer"})
+
+	if err = schedule.Install(dir, bravo); err != nil {
+		t.Fatal(err)
+	}
+	testDirEntries(t, dir, []string{
+		"wrestic-bravo-backup.service", "wrestic-bravo-backup.timer",
+		"wrestic-handwritten.timer",
+	})
+
+	removed, err := schedule.Uninstall(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStrings(t, "removed", removed, []string{"wrestic-bravo-backup.service", "wrestic-bravo-backup.timer"})
+	testDirEntries(t, dir, []string{"wrestic-handwritten.timer"})
+}
+
+func testDirEntries(t *testing.T, dir string, expected []string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	testStrings(t, dir, got, expected)
+}
+
+func testStrings(t *testing.T, errPrefix string, actual, expected []string) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("%s wrong length; got %d, expected %d\n%q", errPrefix, len(actual), len(expected), actual)
+	}
+
+	for i, got := range actual {
+		if exp := expected[i]; got != exp {
+			t.Errorf("%s[%d] got %q, expected %q", errPrefix, i, got, exp)
+		}
+	}
+}
+
+func pointTo(in string) *string { return &in }
@@ -0,0 +1,330 @@
+// Package schedule interprets schedules from the configuration file and
+// renders them as systemd units or crontab entries, or computes when they are
+// next due.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a parsed schedule. It's represented as a set of allowed values for
+// each field of a cron expression.
+type Spec struct {
+	text   string
+	minute field
+	hour   field
+	dom    field
+	month  field
+	dow    field
+}
+
+// Parse interprets text as a schedule. These forms are accepted:
+//
+//	hourly [:MM]
+//	daily [HH:MM]
+//	weekly [DAY] [HH:MM]
+//	monthly [DD] [HH:MM]
+//	MINUTE HOUR DAY_OF_MONTH MONTH DAY_OF_WEEK
+//
+// The last one is a cron expression. Each of its fields may be a "*", a number,
+// a range such as "1-5", a step such as "*/15" or "1-30/2", or a
+// comma-separated list of those. Months and days of the week may also be
+// abbreviated names, such as "jan" or "mon". The forms, "@hourly", "@daily",
+// "@weekly" and "@monthly" are also accepted. Weekly schedules default to
+// Monday, monthly schedules default to the 1st, and the time defaults to 00:00.
+func Parse(text string) (out Spec, err error) {
+	out.text = text
+	parts := strings.Fields(strings.ToLower(text))
+	if len(parts) < 1 {
+		err = fmt.Errorf("schedule %q is empty", text)
+		return
+	}
+
+	var cron []string
+	switch strings.TrimPrefix(parts[0], "@") {
+	case "hourly":
+		cron, err = parseNamed(parts[1:], "", false, false)
+	case "daily":
+		cron, err = parseNamed(parts[1:], "*", false, true)
+	case "weekly":
+		cron, err = parseNamed(parts[1:], "*", true, true)
+	case "monthly":
+		cron, err = parseNamed(parts[1:], "1", false, true)
+	default:
+		cron = parts
+	}
+	if err != nil {
+		err = fmt.Errorf("schedule %q: %w", text, err)
+		return
+	}
+
+	if len(cron) != 5 {
+		err = fmt.Errorf("schedule %q: expected a named schedule or 5 cron fields, got %d fields", text, len(cron))
+		return
+	}
+
+	fields := []*field{&out.minute, &out.hour, &out.dom, &out.month, &out.dow}
+	for i, bounds := range fieldBounds {
+		if *fields[i], err = parseField(cron[i], bounds); err != nil {
+			err = fmt.Errorf("schedule %q: %s field: %w", text, bounds.name, err)
+			return
+		}
+	}
+
+	// In cron, restricting both of these means either one may match. Other
+	// schedulers, such as systemd, need both to match. Avoid the ambiguity.
+	if !out.dom.any && !out.dow.any {
+		err = fmt.Errorf("schedule %q: cannot restrict both the day of month and day of week", text)
+	}
+
+	return
+}
+
+// parseNamed converts the arguments to a named schedule into cron fields.
+func parseNamed(args []string, dom string, weekday, clock bool) (out []string, err error) {
+	var (
+		minute, hour = "0", "*"
+		dow          = "*"
+	)
+	if clock {
+		hour = "0"
+	}
+	if weekday {
+		dow = "mon"
+	}
+
+	for _, arg := range args {
+		switch {
+		case strings.Contains(arg, ":"):
+			h, m, _ := strings.Cut(arg, ":")
+			if !clock && h != "" {
+				return nil, fmt.Errorf("unexpected hour in %q", arg)
+			}
+			if clock {
+				hour = strings.TrimPrefix(h, "0")
+				if hour == "" {
+					hour = "0"
+				}
+			}
+			minute = strings.TrimPrefix(m, "0")
+			if minute == "" {
+				minute = "0"
+			}
+		case weekday:
+			dow = arg
+		case dom != "*" && dom != "":
+			dom = arg
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+
+	if dom == "" {
+		dom = "*"
+	}
+
+	return []string{minute, hour, dom, "*", dow}, nil
+}
+
+// String returns the original text of the Spec.
+func (s Spec) String() string { return s.text }
+
+// Cron renders the Spec as the 5 time fields of a crontab entry.
+func (s Spec) Cron() string {
+	return strings.Join([]string{
+		s.minute.cron(), s.hour.cron(), s.dom.cron(), s.month.cron(), s.dow.cron(),
+	}, " ")
+}
+
+// OnCalendar renders the Spec as a systemd calendar event expression, suitable
+// for the OnCalendar setting of a systemd timer.
+func (s Spec) OnCalendar() string {
+	var bld strings.Builder
+
+	if !s.dow.any {
+		bld.WriteString(s.dow.systemd(func(v int) string { return weekdayNames[v] }) + " ")
+	}
+
+	pad := func(v int) string { return fmt.Sprintf("%02d", v) }
+	fmt.Fprintf(&bld, "*-%s-%s %s:%s:00",
+		s.month.systemd(pad), s.dom.systemd(pad), s.hour.systemd(pad), s.minute.systemd(pad))
+
+	return bld.String()
+}
+
+// Next outputs the earliest time after t that matches the Spec, at a minute
+// granularity. The location of t is used. If nothing matches within several
+// years, such as for "0 0 31 2 *", then the output is the zero time.
+func (s Spec) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !s.month.has(int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dom.has(t.Day()) || !s.dow.has(int(t.Weekday())) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.hour.has(t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !s.minute.has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+type bounds struct {
+	name     string
+	min, max int
+	names    []string // names, when non-empty, are aliases for min, min+1, ...
+}
+
+var (
+	weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+	monthNames   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	fieldBounds  = []bounds{
+		{name: "minute", min: 0, max: 59},
+		{name: "hour", min: 0, max: 23},
+		{name: "day of month", min: 1, max: 31},
+		{name: "month", min: 1, max: 12, names: monthNames},
+		{name: "day of week", min: 0, max: 6, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+	}
+)
+
+// field is the set of allowed values for one part of a cron expression.
+type field struct {
+	bits uint64
+	any  bool
+}
+
+func (f field) has(v int) bool { return f.bits&(1<<uint(v)) != 0 }
+
+func (f field) values() (out []int) {
+	for v := 0; v < 64; v++ {
+		if f.has(v) {
+			out = append(out, v)
+		}
+	}
+	return
+}
+
+func (f field) cron() string {
+	if f.any {
+		return "*"
+	}
+
+	vals := f.values()
+	out := make([]string, len(vals))
+	for i, v := range vals {
+		out[i] = strconv.Itoa(v)
+	}
+	return strings.Join(out, ",")
+}
+
+// systemd renders the field as a list, collapsing consecutive values into
+// ranges.
+func (f field) systemd(format func(int) string) string {
+	if f.any {
+		return "*"
+	}
+
+	var out []string
+	vals := f.values()
+	for i := 0; i < len(vals); {
+		j := i
+		for j+1 < len(vals) && vals[j+1] == vals[j]+1 {
+			j++
+		}
+
+		if j-i >= 2 {
+			out = append(out, format(vals[i])+".."+format(vals[j]))
+		} else {
+			for k := i; k <= j; k++ {
+				out = append(out, format(vals[k]))
+			}
+		}
+		i = j + 1
+	}
+
+	return strings.Join(out, ",")
+}
+
+func parseField(text string, b bounds) (out field, err error) {
+	if text == "*" {
+		out.any = true
+		for v := b.min; v <= b.max; v++ {
+			out.bits |= 1 << uint(v)
+		}
+		return
+	}
+
+	for _, item := range strings.Split(text, ",") {
+		rng, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return out, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		lo, hi := b.min, b.max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			if lo, err = parseValue(loText, b); err != nil {
+				return
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(hiText, b); err != nil {
+					return
+				}
+			} else if hasStep {
+				hi = b.max
+			}
+		}
+		if lo > hi {
+			return out, fmt.Errorf("invalid range %q", rng)
+		}
+
+		for v := lo; v <= hi; v += step {
+			out.bits |= 1 << uint(v)
+		}
+	}
+
+	return
+}
+
+func parseValue(text string, b bounds) (out int, err error) {
+	for i, name := range b.names {
+		if text == name {
+			return b.min + i, nil
+		}
+	}
+
+	if out, err = strconv.Atoi(text); err != nil {
+		return out, fmt.Errorf("invalid value %q", text)
+	}
+
+	// Like cron, accept 7 as Sunday.
+	if b.name == "day of week" && out == 7 {
+		out = 0
+	}
+
+	if out < b.min || out > b.max {
+		err = fmt.Errorf("value %d out of range [%d, %d]", out, b.min, b.max)
+	}
+	return
+}
@@ -0,0 +1,253 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Job is a wrestic subcommand to run upon a datastore per a schedule.
+type Job struct {
+	Store      string
+	Subcommand string
+	Spec       Spec
+	// Bin is the path to the wrestic executable.
+	Bin string
+	// ConfigDir, when non-empty, is passed along to the wrestic executable.
+	ConfigDir string
+	// ConfigFile, when non-empty, is passed along to the wrestic executable.
+	ConfigFile string
+	// SystemConfigFile, when non-nil, is passed along to the wrestic
+	// executable. It may be empty, which says to ignore the system-wide
+	// config file.
+	SystemConfigFile *string
+}
+
+// Args are the command line arguments for running the Job, starting with the
+// path to the wrestic executable.
+func (j Job) Args() []string {
+	out := []string{j.Bin, "exec", j.Subcommand, "-x", "-storenames", j.Store}
+	if j.ConfigDir != "" {
+		out = append(out, "-config-dir", j.ConfigDir)
+	}
+	if j.ConfigFile != "" {
+		out = append(out, "-config-file", j.ConfigFile)
+	}
+	if j.SystemConfigFile != nil {
+		// Attach the value with "=", so that an empty one is not dropped.
+		out = append(out, "-system-config="+*j.SystemConfigFile)
+	}
+	return out
+}
+
+// Name is the base name of generated files for the Job.
+func (j Job) Name() string {
+	return "wrestic-" + escapeUnitName(j.Store) + "-" + escapeUnitName(j.Subcommand)
+}
+
+// generatedMarker is at the top of generated files. It identifies files that
+// may be safely removed.
+const generatedMarker = "# Generated by wrestic. Changes will be overwritten."
+
+// A Unit is a file to install into a systemd unit directory.
+type Unit struct {
+	Name     string
+	Contents string
+}
+
+// SystemdUnits renders a service unit and a timer unit for j.
+func SystemdUnits(j Job) []Unit {
+	service := fmt.Sprintf(`%s
+[Unit]
+Description=wrestic %s for store %s
+
+[Service]
+Type=oneshot
+ExecStart=%s
+`,
+		generatedMarker, j.Subcommand, j.Store, quoteCommand(j.Args(), systemdQuote))
+
+	timer := fmt.Sprintf(`%s
+[Unit]
+Description=Timer for wrestic %s for store %s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`,
+		generatedMarker, j.Subcommand, j.Store, j.Spec.OnCalendar())
+
+	return []Unit{
+		{Name: j.Name() + ".service", Contents: service},
+		{Name: j.Name() + ".timer", Contents: timer},
+	}
+}
+
+// CrontabLine renders j as an entry in a crontab.
+func CrontabLine(j Job) string {
+	// A "%" in the command of a crontab entry is a newline, unless escaped.
+	cmd := strings.ReplaceAll(quoteCommand(j.Args(), shellQuote), "%", `\%`)
+	return j.Spec.Cron() + " " + cmd
+}
+
+// DefaultSystemdDir is where systemd looks for units of the current user.
+func DefaultSystemdDir() (out string, err error) {
+	baseConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		return
+	}
+
+	out = filepath.Join(baseConfigDir, "systemd", "user")
+	return
+}
+
+// Plan compares units with the wrestic-generated files already in dir. It
+// outputs the names of units to write, and the names of stale generated files
+// to remove. Files in dir that were not generated by wrestic are left alone.
+func Plan(dir string, units []Unit) (write, remove []string, err error) {
+	existing, err := generatedFiles(dir)
+	if err != nil {
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, unit := range units {
+		wanted[unit.Name] = true
+		write = append(write, unit.Name)
+	}
+
+	for _, name := range existing {
+		if !wanted[name] {
+			remove = append(remove, name)
+		}
+	}
+
+	return
+}
+
+// Install writes units into dir and removes any stale wrestic-generated files.
+func Install(dir string, units []Unit) (err error) {
+	_, remove, err := Plan(dir, units)
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	for _, unit := range units {
+		if err = os.WriteFile(filepath.Join(dir, unit.Name), []byte(unit.Contents), 0600); err != nil {
+			return
+		}
+	}
+
+	for _, name := range remove {
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Uninstall removes every wrestic-generated file from dir and outputs their
+// names.
+func Uninstall(dir string) (removed []string, err error) {
+	names, err := generatedFiles(dir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return
+		}
+		removed = append(removed, name)
+	}
+
+	return
+}
+
+func generatedFiles(dir string) (out []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "wrestic-") {
+			continue
+		}
+		if !strings.HasSuffix(name, ".service") && !strings.HasSuffix(name, ".timer") {
+			continue
+		}
+
+		raw, err := os.ReadFile(filepath.Clean(filepath.Join(dir, name)))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(string(raw), generatedMarker) {
+			out = append(out, name)
+		}
+	}
+
+	sort.Strings(out)
+	return
+}
+
+// escapeUnitName replaces characters that should not be in a systemd unit
+// name.
+func escapeUnitName(in string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, in)
+}
+
+func quoteCommand(args []string, quote func(string) string) string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = quote(arg)
+	}
+	return strings.Join(out, " ")
+}
+
+func shellQuote(in string) string {
+	if in != "" && strings.IndexFunc(in, needsQuote) < 0 {
+		return in
+	}
+	return `'` + strings.ReplaceAll(in, `'`, `'\''`) + `'`
+}
+
+// systemdQuote quotes in for a systemd Exec setting, where "%" introduces a
+// specifier and "$" introduces an environment variable.
+func systemdQuote(in string) string {
+	in = strings.NewReplacer("%", "%%", "$", "$$").Replace(in)
+	if in != "" && strings.IndexFunc(in, needsQuote) < 0 {
+		return in
+	}
+	in = strings.ReplaceAll(in, `\`, `\\`)
+	return `"` + strings.ReplaceAll(in, `"`, `\"`) + `"`
+}
+
+func needsQuote(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./=:,@+%", r)
+}
@@ -0,0 +1,149 @@
+// Package version parses restic versions and checks them against constraints.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a restic release version.
+type Version struct{ Major, Minor, Patch int }
+
+// Parse reads a version such as "0.16.4", "v0.16" or "0.17.0-dev". Missing
+// components are 0 and any pre-release or build suffix is ignored.
+func Parse(in string) (out Version, err error) {
+	text := strings.TrimPrefix(strings.TrimSpace(in), "v")
+	if i := strings.IndexAny(text, "-+ "); i >= 0 {
+		text = text[:i]
+	}
+
+	parts := strings.Split(text, ".")
+	if len(parts) > 3 || text == "" {
+		err = fmt.Errorf("invalid version %q", in)
+		return
+	}
+
+	nums := make([]int, 3)
+	for i, part := range parts {
+		if nums[i], err = strconv.Atoi(part); err != nil || nums[i] < 0 {
+			err = fmt.Errorf("invalid version %q", in)
+			return
+		}
+	}
+
+	out = Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}
+	return
+}
+
+// MustParse is like Parse, but panics upon error. It's for initializing
+// package-level variables.
+func MustParse(in string) Version {
+	out, err := Parse(in)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// ParseResticOutput reads the version from the output of "restic version",
+// which looks like: "restic 0.16.4 compiled with go1.21.6 on linux/amd64".
+func ParseResticOutput(in string) (out Version, err error) {
+	fields := strings.Fields(in)
+	if len(fields) < 2 || fields[0] != "restic" {
+		err = fmt.Errorf("unexpected output from restic version %q", in)
+		return
+	}
+
+	return Parse(fields[1])
+}
+
+func (v Version) String() string { return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch) }
+
+// Compare outputs -1 if v is less than w, 0 if they are the same, or +1 if v is
+// greater than w.
+func (v Version) Compare(w Version) int {
+	pairs := [][2]int{{v.Major, w.Major}, {v.Minor, w.Minor}, {v.Patch, w.Patch}}
+	for _, pair := range pairs {
+		if pair[0] < pair[1] {
+			return -1
+		} else if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Constraint is a set of comparisons that a Version must satisfy, such as
+// ">= 0.16, < 0.18".
+type Constraint struct {
+	text  string
+	terms []term
+}
+
+type term struct {
+	op      string
+	version Version
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseConstraint reads comma-separated comparisons. Each one is an operator,
+// one of ">=", "<=", "!=", ">", "<", "=", followed by a version. Without an
+// operator, it's "=".
+func ParseConstraint(in string) (out Constraint, err error) {
+	out.text = strings.TrimSpace(in)
+	if out.text == "" {
+		err = fmt.Errorf("empty version constraint")
+		return
+	}
+
+	for _, part := range strings.Split(out.text, ",") {
+		part = strings.TrimSpace(part)
+
+		t := term{op: "="}
+		for _, op := range operators {
+			if strings.HasPrefix(part, op) {
+				t.op, part = op, strings.TrimSpace(part[len(op):])
+				break
+			}
+		}
+
+		if t.version, err = Parse(part); err != nil {
+			err = fmt.Errorf("%w: in version constraint %q", err, in)
+			return
+		}
+		out.terms = append(out.terms, t)
+	}
+
+	return
+}
+
+// Check says if v satisfies every comparison in the Constraint.
+func (c Constraint) Check(v Version) bool {
+	for _, t := range c.terms {
+		cmp := v.Compare(t.version)
+
+		var ok bool
+		switch t.op {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Constraint) String() string { return c.text }
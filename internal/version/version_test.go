@@ -0,0 +1,110 @@
+package version_test
+
+import (
+	"testing"
+
+	"github.com/rafaelespinoza/wrestic/internal/version"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected version.Version
+		expError bool
+	}{
+		{input: "0.16.4", expected: version.Version{Major: 0, Minor: 16, Patch: 4}},
+		{input: "v0.16", expected: version.Version{Major: 0, Minor: 16}},
+		{input: "1", expected: version.Version{Major: 1}},
+		{input: "0.17.0-dev", expected: version.Version{Major: 0, Minor: 17}},
+		{input: "", expError: true},
+		{input: "0.16.4.1", expError: true},
+		{input: "0.x", expError: true},
+		{input: "0.-1", expError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := version.Parse(test.input)
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatal("expected an error")
+			}
+			if got != test.expected {
+				t.Errorf("wrong version; got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseResticOutput(t *testing.T) {
+	got, err := version.ParseResticOutput("restic 0.16.4 compiled with go1.21.6 on linux/amd64\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := version.MustParse("0.16.4"); got != exp {
+		t.Errorf("wrong version; got %v, expected %v", got, exp)
+	}
+
+	if _, err = version.ParseResticOutput("rustic 0.6.1"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "0.16.4", b: "0.16.4", expected: 0},
+		{a: "0.16.4", b: "0.16.5", expected: -1},
+		{a: "0.17.0", b: "0.16.5", expected: 1},
+		{a: "1.0.0", b: "0.99.99", expected: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+" "+test.b, func(t *testing.T) {
+			got := version.MustParse(test.a).Compare(version.MustParse(test.b))
+			if got != test.expected {
+				t.Errorf("wrong result; got %d, expected %d", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		expected   bool
+		expError   bool
+	}{
+		{constraint: "0.16.4", version: "0.16.4", expected: true},
+		{constraint: "= 0.16.4", version: "0.16.3", expected: false},
+		{constraint: ">= 0.16, < 0.18", version: "0.17.3", expected: true},
+		{constraint: ">= 0.16, < 0.18", version: "0.18.0", expected: false},
+		{constraint: ">0.16", version: "0.16.0", expected: false},
+		{constraint: "<=0.16", version: "0.16.0", expected: true},
+		{constraint: "!= 0.16.3", version: "0.16.3", expected: false},
+		{constraint: "", expError: true},
+		{constraint: ">= 0.16,", expError: true},
+		{constraint: "~> 0.16", expError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.constraint, func(t *testing.T) {
+			constraint, err := version.ParseConstraint(test.constraint)
+			if err != nil && !test.expError {
+				t.Fatal(err)
+			} else if err == nil && test.expError {
+				t.Fatal("expected an error")
+			} else if err != nil {
+				return
+			}
+
+			if got := constraint.Check(version.MustParse(test.version)); got != test.expected {
+				t.Errorf("wrong result; got %t, expected %t", got, test.expected)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/rafaelespinoza/wrestic/internal/cmd"
 )
@@ -15,7 +17,18 @@ func init() {
 }
 
 func main() {
-	if err := root.RunContext(context.Background(), os.Args); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Upon the first signal, the context is canceled so that things may stop
+	// gracefully. Restore the default behavior, so that another signal stops
+	// the program right away.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := root.RunContext(ctx, os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
 	}